@@ -5,9 +5,11 @@
 package servercore
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -28,29 +30,63 @@ type Server struct {
 	sessions      sessionStore
 	scheduler     *gocron.Scheduler
 	stopScheduler chan bool
+
+	// Temporary folder into which the schemes of conf.SchemesPaths are merged, if any
+	mergedSchemesPath string
 }
 
 func New(conf *server.Configuration) (*Server, error) {
 	s := &Server{
 		conf:      conf,
 		scheduler: gocron.NewScheduler(),
-		sessions: &memorySessionStore{
-			requestor: make(map[string]*session),
-			client:    make(map[string]*session),
-			conf:      conf,
-		},
 	}
+	if err := s.verifyConfiguration(s.conf); err != nil {
+		return nil, err
+	}
+
+	if conf.SessionStoragePath != "" {
+		store, err := newFileSessionStore(conf)
+		if err != nil {
+			return nil, server.LogError(err)
+		}
+		s.sessions = store
+	} else {
+		s.sessions = newMemorySessionStore(conf)
+	}
+
 	s.scheduler.Every(10).Seconds().Do(func() {
-		s.sessions.deleteExpired()
+		s.sessions.deleteExpired(context.Background())
 	})
 	s.stopScheduler = s.scheduler.Start()
 
-	return s, s.verifyConfiguration(s.conf)
+	return s, nil
 }
 
 func (s *Server) Stop() {
 	s.stopScheduler <- true
 	s.sessions.stop()
+	if s.mergedSchemesPath != "" {
+		if err := os.RemoveAll(s.mergedSchemesPath); err != nil {
+			_ = server.LogWarning(errors.WrapPrefix(err, "Failed to remove merged schemes path", 0))
+		}
+	}
+}
+
+// schemeUpdateOptions returns the options of the automatic scheme updater, using the default
+// jitter and backoff if they are not configured.
+func (s *Server) schemeUpdateOptions() irma.SchemeUpdateOptions {
+	jitter, backoff := defaultSchemesUpdateJitter, defaultSchemesUpdateBackoff
+	if s.conf.SchemesUpdateJitter != nil {
+		jitter = *s.conf.SchemesUpdateJitter
+	}
+	if s.conf.SchemesUpdateBackoff != nil {
+		backoff = *s.conf.SchemesUpdateBackoff
+	}
+	return irma.SchemeUpdateOptions{
+		Interval: time.Duration(s.conf.SchemesUpdateInterval) * time.Minute,
+		Jitter:   time.Duration(jitter) * time.Second,
+		Backoff:  time.Duration(backoff) * time.Second,
+	}
 }
 
 func (s *Server) verifyConfiguration(configuration *server.Configuration) error {
@@ -60,11 +96,67 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	server.Logger = s.conf.Logger
 	irma.Logger = s.conf.Logger
 
+	if s.conf.EnableMetrics && s.conf.Metrics == nil {
+		s.conf.Metrics = server.NewMetrics()
+	}
+
+	if s.conf.MaxDisjunctions == 0 {
+		s.conf.MaxDisjunctions = defaultMaxDisjunctions
+	}
+	if s.conf.MaxAttributes == 0 {
+		s.conf.MaxAttributes = defaultMaxAttributes
+	}
+	if s.conf.MaxRequestBodyBytes == 0 {
+		s.conf.MaxRequestBodyBytes = defaultMaxRequestBodyBytes
+	}
+	if s.conf.MaxSignatureMessageBytes == 0 {
+		s.conf.MaxSignatureMessageBytes = defaultMaxSignatureMessageBytes
+	}
+	if s.conf.MaxDisclosureAttempts == 0 {
+		s.conf.MaxDisclosureAttempts = defaultMaxDisclosureAttempts
+	}
+	if s.conf.ResultRetention < 0 {
+		return server.LogError(errors.New("result_retention must not be negative"))
+	}
+	if s.conf.ScanTimeout < 0 {
+		return server.LogError(errors.New("scan_timeout must not be negative"))
+	}
+	if s.conf.InteractionTimeout < 0 {
+		return server.LogError(errors.New("interaction_timeout must not be negative"))
+	}
+	if s.conf.TokenGenerator != nil {
+		if s.conf.Production {
+			return server.LogError(errors.New("TokenGenerator must not be set in production mode"))
+		}
+		s.conf.Logger.Warn("Using custom session token generator, session tokens are predictable; only use this for testing")
+	}
+	if s.conf.SessionTokenChars != "" {
+		if err := validateSessionChars(s.conf.SessionTokenChars); err != nil {
+			return server.LogError(err)
+		}
+	}
+	if err := validateRedactedAttributes(s.conf.RedactedAttributes); err != nil {
+		return server.LogError(err)
+	}
+
 	if s.conf.IrmaConfiguration == nil {
 		var (
 			err    error
 			exists bool
 		)
+		if len(s.conf.SchemesPaths) > 0 {
+			if s.conf.SchemesPath != "" {
+				return server.LogError(errors.New("schemes_path and schemes_paths cannot be combined"))
+			}
+			if len(s.conf.SchemesPaths) == 1 {
+				s.conf.SchemesPath = s.conf.SchemesPaths[0]
+			} else {
+				if s.mergedSchemesPath, err = s.mergeSchemesPaths(); err != nil {
+					return server.LogError(err)
+				}
+				s.conf.SchemesPath = s.mergedSchemesPath
+			}
+		}
 		if s.conf.SchemesPath == "" {
 			s.conf.SchemesPath = server.DefaultSchemesPath() // Returns an existing path
 		}
@@ -99,7 +191,7 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		if s.conf.SchemesUpdateInterval == 0 {
 			s.conf.SchemesUpdateInterval = 60
 		}
-		s.conf.IrmaConfiguration.AutoUpdateSchemes(uint(s.conf.SchemesUpdateInterval))
+		s.conf.IrmaConfiguration.AutoUpdateSchemesWithOptions(s.schemeUpdateOptions())
 	} else {
 		s.conf.SchemesUpdateInterval = 0
 	}
@@ -151,6 +243,10 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 				s.conf.DisableTLS = true
 				s.conf.Logger.Warnf("TLS is not enabled on the url \"%s\" to which the IRMA app will connect. "+
 					"Ensure that attributes are encrypted in transit by either enabling TLS or adding TLS in a reverse proxy.", s.conf.URL)
+				if s.conf.Production && strings.HasPrefix(s.conf.URL, "http://") {
+					s.conf.Logger.Warn("!!! Running in production mode with a plain HTTP url: IRMA apps will send attributes unencrypted " +
+						"unless a reverse proxy redirects them to https:// !!!")
+				}
 			} else {
 				return server.LogError(errors.Errorf("Running without TLS in production mode is unsafe without a reverse proxy. " +
 					"Either use a https:// URL or explicitly disable TLS."))
@@ -166,7 +262,7 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 			return server.LogError(errors.New("Invalid email address specified"))
 		}
 		t := irma.NewHTTPTransport("https://metrics.privacybydesign.foundation/history")
-		t.SetHeader("User-Agent", "irmaserver")
+		t.SetUserAgent("irmaserver")
 		var x string
 		_ = t.Post("email", &x, s.conf.Email)
 	}
@@ -174,6 +270,45 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	return nil
 }
 
+// mergeSchemesPaths copies the schemes in each of the configured schemes paths into a new
+// temporary folder, in order, such that a scheme in a later path replaces a scheme of the same
+// name from an earlier path. It returns the path to the new folder.
+func (s *Server) mergeSchemesPaths() (string, error) {
+	dir, err := ioutil.TempDir("", "irma_configuration")
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Failed to create folder for merged schemes", 0)
+	}
+	sources := map[string]string{}
+	for _, path := range s.conf.SchemesPaths {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", errors.WrapPrefix(err, "Failed to read schemes path "+path, 0)
+		}
+		for _, file := range files {
+			name := file.Name()
+			if !file.IsDir() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			logger := s.conf.Logger.WithFields(logrus.Fields{"scheme": name, "schemes_path": path})
+			if prev, ok := sources[name]; ok {
+				logger.WithField("replaced", prev).Warn("Scheme replaces the scheme of the same name from an earlier schemes path")
+				err = os.RemoveAll(filepath.Join(dir, name))
+			}
+			if err == nil {
+				err = fs.CopyDirectory(filepath.Join(path, name), filepath.Join(dir, name))
+			}
+			if err != nil {
+				_ = os.RemoveAll(dir)
+				return "", errors.WrapPrefix(err, "Failed to copy scheme "+name, 0)
+			}
+			sources[name] = path
+			logger.Info("Loaded scheme")
+		}
+	}
+	return dir, nil
+}
+
 func (s *Server) validateRequest(request irma.SessionRequest) error {
 	if _, err := s.conf.IrmaConfiguration.Download(request); err != nil {
 		return err
@@ -181,49 +316,234 @@ func (s *Server) validateRequest(request irma.SessionRequest) error {
 	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
 }
 
-func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
+// ValidateRequest parses and validates the session request like starting a session does,
+// returning the parsed request, without starting a session.
+func (s *Server) ValidateRequest(req interface{}) (irma.RequestorRequest, error) {
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
 	request := rrequest.SessionRequest()
-	action := request.Action()
-
+	if err := s.validateRequestSize(request); err != nil {
+		return nil, err
+	}
 	if err := s.validateRequest(request); err != nil {
-		return nil, "", err
+		return nil, err
 	}
-
-	if action == irma.ActionIssuing {
+	if err := s.validateReturnURL(rrequest.Base().ReturnURL); err != nil {
+		return nil, err
+	}
+	if err := validateContext(request.Base().Context); err != nil {
+		return nil, err
+	}
+	if request.Action() == irma.ActionIssuing {
 		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
-			return nil, "", err
+			return nil, err
+		}
+	}
+	if request.Action() == irma.ActionSigning {
+		if err := s.validateSignatureMessage(request.(*irma.SignatureRequest).Message); err != nil {
+			return nil, err
 		}
 	}
+	return rrequest, nil
+}
 
-	session := s.newSession(action, rrequest)
-	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
+func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
+	return s.StartSessionContext(context.Background(), req, nil)
+}
+
+// StartSessionContext is like StartSession, using the specified options if not nil, and passing
+// ctx (e.g. that of the HTTP request of the requestor) to the session store.
+func (s *Server) StartSessionContext(ctx context.Context, req interface{}, opts *server.SessionOptions) (*irma.Qr, string, error) {
+	if opts == nil {
+		opts = &server.SessionOptions{}
+	}
+	return s.startSession(ctx, req, sessionOptions{requestor: opts.Requestor, idempotencyKey: opts.IdempotencyKey})
+}
+
+func (s *Server) startSession(ctx context.Context, req interface{}, opts sessionOptions) (*irma.Qr, string, error) {
+	if opts.requestor == "" {
+		opts.requestor = anonymousRequestor
+	}
+	if opts.idempotencyKey != "" {
+		if session := s.sessions.idempotentGet(ctx, opts.requestor, opts.idempotencyKey); session != nil {
+			return s.existingSession(session)
+		}
+	}
+
+	rrequest, err := s.ValidateRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+	action := rrequest.SessionRequest().Action()
+	if err := s.filterRequest(opts.requestor, rrequest); err != nil {
+		return nil, "", err
+	}
+
+	session, err := s.newSession(ctx, action, rrequest, opts)
+	if err == errIdempotencyKeyInUse {
+		// Another session with this key was started concurrently
+		return s.existingSession(s.sessions.idempotentGet(ctx, opts.requestor, opts.idempotencyKey))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token, "requestor": session.requestor}).Infof("Session started")
 	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request: ", server.ToJson(rrequest))
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "requestor": session.requestor}).Info("Session request: ", server.ToJson(purgeRequest(rrequest, s.conf.Redacts)))
 	} else {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "requestor": session.requestor}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest, func(irma.AttributeTypeIdentifier) bool { return true })))
+	}
+	return s.qr(session), session.token, nil
+}
+
+// filterRequest passes the session request to the RequestFilter of the configuration, if any,
+// returning the error with which it rejected the request.
+func (s *Server) filterRequest(requestor string, rrequest irma.RequestorRequest) error {
+	if s.conf.RequestFilter == nil {
+		return nil
+	}
+	err := s.conf.RequestFilter(requestor, rrequest)
+	if err == nil {
+		return nil
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Session request rejected by filter: ", err.Error())
+	if rerr, ok := err.(*irma.RemoteError); ok {
+		return rerr
+	}
+	return server.RemoteError(server.ErrorRequestRejected, err.Error())
+}
+
+func (s *Server) existingSession(session *session) (*irma.Qr, string, error) {
+	if session == nil { // deleted in the meantime
+		return nil, "", errors.New("Session with this idempotency key no longer exists")
 	}
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "requestor": session.requestor}).
+		Info("Idempotency key already used, returning existing session")
+	return s.qr(session), session.token, nil
+}
+
+func (s *Server) qr(session *session) *irma.Qr {
 	return &irma.Qr{
-		Type: action,
+		Type: session.action,
 		URL:  s.conf.URL + "session/" + session.clientToken,
-	}, session.token, nil
+	}
+}
+
+// startNextSession starts the follow-up session of the specified finished session, if the
+// NextSessionHandler returns a request for it given the result of the session. The caller must
+// not hold the session lock.
+func (s *Server) startNextSession(ctx context.Context, session *session, result *server.SessionResult) {
+	request, err := s.conf.NextSessionHandler(result)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to determine next session", 0))
+		return
+	}
+	if request == nil {
+		return
+	}
+	qr, token, err := s.startSession(ctx, request, sessionOptions{requestor: session.requestor, prevToken: session.token})
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to start next session", 0))
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	session.result.NextSession = qr
+	session.result.NextToken = token
+	session.sessions.update(ctx, session)
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "next": token}).Info("Next session started")
 }
 
 func (s *Server) GetSessionResult(token string) *server.SessionResult {
-	session := s.sessions.get(token)
+	return s.GetSessionResultContext(context.Background(), token)
+}
+
+// GetSessionResultContext is like GetSessionResult, passing ctx to the session store.
+func (s *Server) GetSessionResultContext(ctx context.Context, token string) *server.SessionResult {
+	session := s.sessions.get(ctx, token)
 	if session == nil {
 		s.conf.Logger.Warn("Session result requested of unknown session ", token)
 		return nil
 	}
-	return session.result
+	session.Lock()
+	defer session.Unlock()
+	return session.resultCopy()
+}
+
+// WaitStatus blocks until the status of the specified session differs from the specified status,
+// or until the timeout has passed, and then returns the current status of the session.
+func (s *Server) WaitStatus(token string, status server.Status, timeout time.Duration) (server.Status, error) {
+	return s.WaitStatusContext(context.Background(), token, status, timeout)
+}
+
+// WaitStatusContext is like WaitStatus, but also returns the current status of the session
+// when ctx is done, e.g. because the requestor closed the connection.
+func (s *Server) WaitStatusContext(ctx context.Context, token string, status server.Status, timeout time.Duration) (server.Status, error) {
+	session := s.sessions.get(ctx, token)
+	if session == nil {
+		return "", server.LogWarning(errors.Errorf("can't wait for status of unknown session %s", token))
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	deadline := time.Now().Add(timeout)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		session.Lock()
+		defer session.Unlock()
+		session.statusChanged().Broadcast()
+	}()
+	for session.status == status && time.Now().Before(deadline) && ctx.Err() == nil {
+		session.statusChanged().Wait()
+	}
+	return session.status, nil
+}
+
+// SessionCount returns the amount of sessions currently in the session store,
+// including finished sessions whose result may still be retrieved.
+func (s *Server) SessionCount() int {
+	return s.sessions.count()
+}
+
+// Sessions returns information about all sessions currently in the session store.
+func (s *Server) Sessions() []server.SessionInfo {
+	infos := make([]server.SessionInfo, 0, s.sessions.count())
+	s.sessions.iterate(func(session *session) {
+		session.Lock()
+		defer session.Unlock()
+		infos = append(infos, server.SessionInfo{
+			Token:      session.token,
+			Requestor:  session.requestor,
+			Label:      session.rrequest.Base().Label,
+			Type:       session.action,
+			Status:     session.status,
+			Created:    session.created,
+			LastActive: session.lastActive,
+		})
+	})
+	return infos
 }
 
 func (s *Server) GetRequest(token string) irma.RequestorRequest {
-	session := s.sessions.get(token)
+	return s.GetRequestContext(context.Background(), token)
+}
+
+// GetRequestContext is like GetRequest, passing ctx to the session store.
+func (s *Server) GetRequestContext(ctx context.Context, token string) irma.RequestorRequest {
+	session := s.sessions.get(ctx, token)
 	if session == nil {
 		s.conf.Logger.Warn("Session request requested of unknown session ", token)
 		return nil
@@ -231,17 +551,47 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	return session.rrequest
 }
 
+// GetPairingCode returns the code that the user must enter in the IRMA app before the specified
+// session proceeds, or the empty string if pairing is not enabled for the session.
+func (s *Server) GetPairingCode(token string) string {
+	return s.GetPairingCodeContext(context.Background(), token)
+}
+
+// GetPairingCodeContext is like GetPairingCode, passing ctx to the session store.
+func (s *Server) GetPairingCodeContext(ctx context.Context, token string) string {
+	session := s.sessions.get(ctx, token)
+	if session == nil {
+		s.conf.Logger.Warn("Pairing code requested of unknown session ", token)
+		return ""
+	}
+	return session.pairingCode
+}
+
+// CancelSession cancels the specified session, informing any SSE listeners of its new status.
+// It returns an error if the session is unknown or already finished.
 func (s *Server) CancelSession(token string) error {
-	session := s.sessions.get(token)
+	return s.CancelSessionContext(context.Background(), token)
+}
+
+// CancelSessionContext is like CancelSession, passing ctx to the session store.
+func (s *Server) CancelSessionContext(ctx context.Context, token string) error {
+	session := s.sessions.get(ctx, token)
 	if session == nil {
 		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
 	}
-	session.handleDelete()
+
+	session.Lock()
+	defer session.Unlock()
+	if session.status.Finished() {
+		return server.LogWarning(errors.Errorf("can't cancel finished session %s", token))
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"session": token, "requestor": session.requestor}).Info("Session cancelled by requestor")
+	session.handleDelete(ctx)
 	return nil
 }
 
 func ParsePath(path string) (string, string, error) {
-	pattern := regexp.MustCompile("session/(\\w+)/?(|commitments|proofs|status|statusevents)$")
+	pattern := regexp.MustCompile("session/(\\w+)/?(|commitments|proofs|pairing|status|frontendstatus|statusevents|request)$")
 	matches := pattern.FindStringSubmatch(path)
 	if len(matches) != 3 {
 		return "", "", server.LogWarning(errors.Errorf("Invalid URL: %s", path))
@@ -256,19 +606,19 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 
 	var session *session
 	if requestor {
-		session = s.sessions.get(token)
+		session = s.sessions.get(r.Context(), token)
 	} else {
-		session = s.sessions.clientGet(token)
+		session = s.sessions.clientGet(r.Context(), token)
 	}
 	if session == nil {
 		return server.LogError(errors.Errorf("can't subscribe to server sent events of unknown session %s", token))
 	}
-	if session.status.Finished() {
-		return server.LogError(errors.Errorf("can't subscribe to server sent events of finished session %s", token))
-	}
 
 	session.Lock()
 	defer session.Unlock()
+	if session.status.Finished() {
+		return server.LogError(errors.Errorf("can't subscribe to server sent events of finished session %s", token))
+	}
 
 	// The EventSource.onopen Javascript callback is not consistently called across browsers (Chrome yes, Firefox+Safari no).
 	// However, when the SSE connection has been opened the webclient needs some signal so that it can early detect SSE failures.
@@ -290,6 +640,18 @@ func (s *Server) HandleProtocolMessage(
 	method string,
 	headers map[string][]string,
 	message []byte,
+) (int, []byte, *server.SessionResult) {
+	return s.HandleProtocolMessageContext(context.Background(), path, method, headers, message)
+}
+
+// HandleProtocolMessageContext is like HandleProtocolMessage, passing ctx (e.g. that of the HTTP
+// request of the IRMA app) to the session store.
+func (s *Server) HandleProtocolMessageContext(
+	ctx context.Context,
+	path string,
+	method string,
+	headers map[string][]string,
+	message []byte,
 ) (int, []byte, *server.SessionResult) {
 	var start time.Time
 	if s.conf.Verbose >= 2 {
@@ -297,7 +659,7 @@ func (s *Server) HandleProtocolMessage(
 		server.LogRequest("client", method, path, "", http.Header(headers), message)
 	}
 
-	status, output, result := s.handleProtocolMessage(path, method, headers, message)
+	status, output, result := s.handleProtocolMessage(ctx, path, method, headers, message)
 
 	if s.conf.Verbose >= 2 {
 		server.LogResponse(status, time.Now().Sub(start), output)
@@ -307,6 +669,7 @@ func (s *Server) HandleProtocolMessage(
 }
 
 func (s *Server) handleProtocolMessage(
+	ctx context.Context,
 	path string,
 	method string,
 	headers map[string][]string,
@@ -329,21 +692,38 @@ func (s *Server) handleProtocolMessage(
 	}
 
 	// Fetch the session
-	session := s.sessions.clientGet(token)
+	session := s.sessions.clientGet(ctx, token)
 	if session == nil {
 		s.conf.Logger.WithField("clientToken", token).Warn("Session not found")
 		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorSessionUnknown, ""))
 		return
 	}
+
+	// If the session finished successfully, start the follow-up session if any. As this involves
+	// the session store, this must happen after the session lock is released below.
+	defer func() {
+		if result != nil && result.Status == server.StatusDone && s.conf.NextSessionHandler != nil {
+			s.startNextSession(ctx, session, result)
+		}
+	}()
+
 	session.Lock()
 	defer session.Unlock()
 
+	// Save the changes that handling the message made to the session, such as the time at which
+	// it was last active. Requests of the status or the public request change nothing.
+	defer func() {
+		if method != http.MethodGet || noun == "" {
+			session.sessions.persist(ctx, session)
+		}
+	}()
+
 	// However we return, if the session status has been updated
 	// then we should inform the user by returning a SessionResult
 	defer func() {
 		if session.status != session.prevStatus {
 			session.prevStatus = session.status
-			result = session.result
+			result = session.resultCopy()
 		}
 	}()
 
@@ -351,12 +731,16 @@ func (s *Server) handleProtocolMessage(
 	switch len(noun) {
 	case 0:
 		if method == http.MethodDelete {
-			session.handleDelete()
+			session.handleDelete(ctx)
 			status = http.StatusOK
 			return
 		}
 		if method == http.MethodGet {
-			status, output = session.checkCache(message, server.StatusConnected)
+			expectedStatus := server.StatusConnected
+			if session.pairingCode != "" {
+				expectedStatus = server.StatusPairing
+			}
+			status, output = session.checkCache(ctx, message, expectedStatus)
 			if len(output) != 0 {
 				return
 			}
@@ -364,18 +748,18 @@ func (s *Server) handleProtocolMessage(
 			min := &irma.ProtocolVersion{}
 			max := &irma.ProtocolVersion{}
 			if err := json.Unmarshal([]byte(h.Get(irma.MinVersionHeader)), min); err != nil {
-				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
+				status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorMalformedInput, err.Error()))
 				return
 			}
 			if err := json.Unmarshal([]byte(h.Get(irma.MaxVersionHeader)), max); err != nil {
-				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
+				status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handleGetRequest(min, max))
-			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusConnected}
+			status, output = server.JsonResponse(session.handleGetRequest(ctx, min, max))
+			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: expectedStatus}
 			return
 		}
-		status, output = server.JsonResponse(nil, session.fail(server.ErrorInvalidRequest, ""))
+		status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorInvalidRequest, ""))
 		return
 
 	default:
@@ -390,58 +774,84 @@ func (s *Server) handleProtocolMessage(
 			return
 		}
 
+		if method == http.MethodGet && noun == "frontendstatus" {
+			status, output = server.JsonResponse(session.handleGetFrontendStatus())
+			return
+		}
+
+		if method == http.MethodGet && noun == "request" {
+			status, output = server.JsonResponse(session.handleGetPublicRequest())
+			return
+		}
+
 		// Below are only POST enpoints
 		if method != http.MethodPost {
-			status, output = server.JsonResponse(nil, session.fail(server.ErrorInvalidRequest, ""))
+			status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorInvalidRequest, ""))
+			return
+		}
+
+		if noun == "pairing" {
+			msg := &irma.PairingCodeMessage{}
+			if err = irma.UnmarshalValidate(message, msg); err != nil {
+				status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorMalformedInput, err.Error()))
+				return
+			}
+			status, output = server.JsonResponse(session.handlePostPairingCode(ctx, msg))
 			return
 		}
 
 		if noun == "commitments" && session.action == irma.ActionIssuing {
-			status, output = session.checkCache(message, server.StatusDone)
+			status, output = session.checkCache(ctx, message, server.StatusDone)
 			if len(output) != 0 {
 				return
 			}
 			commitments := &irma.IssueCommitmentMessage{}
 			if err = irma.UnmarshalValidate(message, commitments); err != nil {
-				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
+				status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostCommitments(commitments))
+			status, output = server.JsonResponse(session.handlePostCommitments(ctx, commitments))
 			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusDone}
 			return
 		}
 
 		if noun == "proofs" && session.action == irma.ActionDisclosing {
-			status, output = session.checkCache(message, server.StatusDone)
+			status, output = session.checkCache(ctx, message, server.StatusDone)
 			if len(output) != 0 {
 				return
 			}
 			disclosure := &irma.Disclosure{}
 			if err = irma.UnmarshalValidate(message, disclosure); err != nil {
-				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
+				status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostDisclosure(disclosure))
+			status, output = server.JsonResponse(session.handlePostDisclosure(ctx, disclosure))
+			if session.status == server.StatusConnected {
+				return // proofs rejected, don't replay the rejection against another attempt
+			}
 			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusDone}
 			return
 		}
 
 		if noun == "proofs" && session.action == irma.ActionSigning {
-			status, output = session.checkCache(message, server.StatusDone)
+			status, output = session.checkCache(ctx, message, server.StatusDone)
 			if len(output) != 0 {
 				return
 			}
 			signature := &irma.SignedMessage{}
 			if err = irma.UnmarshalValidate(message, signature); err != nil {
-				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
+				status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostSignature(signature))
+			status, output = server.JsonResponse(session.handlePostSignature(ctx, signature))
+			if session.status == server.StatusConnected {
+				return // proofs rejected, don't replay the rejection against another attempt
+			}
 			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusDone}
 			return
 		}
 
-		status, output = server.JsonResponse(nil, session.fail(server.ErrorInvalidRequest, ""))
+		status, output = server.JsonResponse(nil, session.fail(ctx, server.ErrorInvalidRequest, ""))
 		return
 	}
 }
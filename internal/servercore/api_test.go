@@ -0,0 +1,59 @@
+package servercore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeSchemesPaths(t *testing.T) {
+	var paths []string
+	for _, schemes := range [][]string{{"irma-demo", "test"}, {"test", "test-requestors"}} {
+		dir, err := ioutil.TempDir("", "schemes")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		for _, scheme := range schemes {
+			require.NoError(t, fs.EnsureDirectoryExists(filepath.Join(dir, scheme)))
+			require.NoError(t, fs.SaveFile(filepath.Join(dir, scheme, "description.xml"), []byte(dir)))
+		}
+		paths = append(paths, dir)
+	}
+
+	s := &Server{conf: &server.Configuration{Logger: logrus.New(), SchemesPaths: paths}}
+	merged, err := s.mergeSchemesPaths()
+	require.NoError(t, err)
+	defer os.RemoveAll(merged)
+
+	// Schemes in later paths take precedence
+	for scheme, path := range map[string]string{"irma-demo": paths[0], "test": paths[1], "test-requestors": paths[1]} {
+		bts, err := ioutil.ReadFile(filepath.Join(merged, scheme, "description.xml"))
+		require.NoError(t, err)
+		require.Equal(t, path, string(bts))
+	}
+
+	s.conf.SchemesPaths = append(s.conf.SchemesPaths, filepath.Join(paths[0], "nonexisting"))
+	_, err = s.mergeSchemesPaths()
+	require.Error(t, err)
+}
+
+func TestSchemeUpdateOptions(t *testing.T) {
+	s := &Server{conf: &server.Configuration{SchemesUpdateInterval: 60}}
+	require.Equal(t, irma.SchemeUpdateOptions{
+		Interval: time.Hour,
+		Jitter:   time.Minute,
+		Backoff:  time.Minute,
+	}, s.schemeUpdateOptions())
+
+	// Jitter and backoff can be disabled
+	zero := 0
+	s.conf.SchemesUpdateJitter, s.conf.SchemesUpdateBackoff = &zero, &zero
+	require.Equal(t, irma.SchemeUpdateOptions{Interval: time.Hour}, s.schemeUpdateOptions())
+}
@@ -0,0 +1,250 @@
+package servercore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// fileSessionStore keeps sessions in memory like memorySessionStore, and additionally journals
+// them to JSON files in a directory, named after the session token, from which they are loaded
+// on startup. This way sessions survive a restart of the server. Sessions are written to disk
+// whenever they change, so that no changes are lost if the server crashes.
+type fileSessionStore struct {
+	*memorySessionStore
+	path string
+}
+
+// sessionData contains the fields of a session that are saved to disk.
+type sessionData struct {
+	Action             irma.Action                                   `json:"action"`
+	Requestor          string                                        `json:"requestor"`
+	IdempotencyKey     string                                        `json:"idempotencyKey,omitempty"`
+	Token              string                                        `json:"token"`
+	ClientToken        string                                        `json:"clientToken"`
+	Version            *irma.ProtocolVersion                         `json:"version,omitempty"`
+	Request            json.RawMessage                               `json:"request"`
+	LegacyCompatible   bool                                          `json:"legacyCompatible"`
+	PairingCode        string                                        `json:"pairingCode,omitempty"`
+	PairingAttempts    int                                           `json:"pairingAttempts,omitempty"`
+	DisclosureAttempts int                                           `json:"disclosureAttempts,omitempty"`
+	Status             server.Status                                 `json:"status"`
+	PrevStatus         server.Status                                 `json:"prevStatus"`
+	ResponseCache      responseCacheData                             `json:"responseCache"`
+	Created            time.Time                                     `json:"created"`
+	LastActive         time.Time                                     `json:"lastActive"`
+	Result             *server.SessionResult                         `json:"result"`
+	LegacySession      bool                                          `json:"legacySession"`
+	KssProofs          map[irma.SchemeManagerIdentifier]*gabi.ProofP `json:"kssProofs,omitempty"`
+}
+
+type responseCacheData struct {
+	Message       []byte        `json:"message,omitempty"`
+	Response      []byte        `json:"response,omitempty"`
+	Status        int           `json:"status,omitempty"`
+	SessionStatus server.Status `json:"sessionStatus,omitempty"`
+}
+
+const sessionFileExtension = ".json"
+
+func newFileSessionStore(conf *server.Configuration) (*fileSessionStore, error) {
+	if err := fs.EnsureDirectoryExists(conf.SessionStoragePath); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to create session storage path", 0)
+	}
+	s := &fileSessionStore{
+		memorySessionStore: newMemorySessionStore(conf),
+		path:               conf.SessionStoragePath,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSessionStore) add(ctx context.Context, session *session) error {
+	if err := s.memorySessionStore.add(ctx, session); err != nil {
+		return err
+	}
+	// The session can now be found, and so be concurrently updated and saved
+	session.Lock()
+	defer session.Unlock()
+	s.save(session)
+	return nil
+}
+
+func (s *fileSessionStore) update(ctx context.Context, session *session) {
+	s.save(session)
+	s.memorySessionStore.update(ctx, session)
+}
+
+func (s *fileSessionStore) persist(ctx context.Context, session *session) {
+	s.save(session)
+}
+
+func (s *fileSessionStore) deleteExpired(ctx context.Context) {
+	for _, token := range s.deleteExpiredSessions(ctx) {
+		if err := os.Remove(s.filename(token)); err != nil && !os.IsNotExist(err) {
+			_ = server.LogError(errors.WrapPrefix(err, "Failed to delete session file", 0))
+		}
+	}
+}
+
+func (s *fileSessionStore) filename(token string) string {
+	return filepath.Join(s.path, token+sessionFileExtension)
+}
+
+// save writes the session to disk. The caller must hold the session lock, so that the session
+// is not modified while it is serialised, and so that saves of the same session don't interleave.
+func (s *fileSessionStore) save(session *session) {
+	bts, err := session.marshal()
+	if err == nil {
+		err = fs.SaveFile(s.filename(session.token), bts) // writes to a temp file and renames it
+	}
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to save session "+session.token, 0))
+	}
+}
+
+// load reads all sessions from disk into memory, removing files that cannot be read,
+// and then removes expired sessions.
+func (s *fileSessionStore) load() error {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read session storage path", 0)
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), sessionFileExtension) {
+			continue
+		}
+		filename := filepath.Join(s.path, file.Name())
+		session, err := s.loadSession(filename)
+		if err != nil {
+			_ = server.LogWarning(errors.WrapPrefix(err, "Removing unreadable session file "+filename, 0))
+			_ = os.Remove(filename)
+			continue
+		}
+		s.requestor[session.token] = session
+		s.client[session.clientToken] = session
+		if session.idempotencyKey != "" {
+			s.idempotent[session.idempotentKey()] = session
+		}
+		if session.correlationID() != "" {
+			s.correlated[session.correlationKey()] = session
+		}
+		s.activate(session)
+		// Restored sessions are deleted from the metrics when they expire, so they must be added too
+		if s.conf.Metrics != nil {
+			s.conf.Metrics.SessionCreated(session.action)
+		}
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"path": s.path, "sessions": len(s.requestor)}).Info("Loaded sessions from disk")
+
+	s.deleteExpired(context.Background())
+	return nil
+}
+
+func (s *fileSessionStore) loadSession(filename string) (*session, error) {
+	bts, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var data sessionData
+	if err = json.Unmarshal(bts, &data); err != nil {
+		return nil, err
+	}
+	if filepath.Base(filename) != data.Token+sessionFileExtension {
+		return nil, errors.New("session token does not match filename")
+	}
+
+	var rrequest irma.RequestorRequest
+	switch data.Action {
+	case irma.ActionDisclosing:
+		rrequest = &irma.ServiceProviderRequest{}
+	case irma.ActionSigning:
+		rrequest = &irma.SignatureRequestorRequest{}
+	case irma.ActionIssuing:
+		rrequest = &irma.IdentityProviderRequest{}
+	default:
+		return nil, errors.Errorf("unknown session type %s", data.Action)
+	}
+	if err = json.Unmarshal(data.Request, rrequest); err != nil {
+		return nil, err
+	}
+	if data.Result == nil {
+		return nil, errors.New("session result missing")
+	}
+	data.Result.LegacySession = data.LegacySession
+
+	return &session{
+		action:             data.Action,
+		requestor:          data.Requestor,
+		idempotencyKey:     data.IdempotencyKey,
+		token:              data.Token,
+		clientToken:        data.ClientToken,
+		version:            data.Version,
+		rrequest:           rrequest,
+		request:            rrequest.SessionRequest(),
+		legacyCompatible:   data.LegacyCompatible,
+		pairingCode:        data.PairingCode,
+		pairingAttempts:    data.PairingAttempts,
+		disclosureAttempts: data.DisclosureAttempts,
+		status:             data.Status,
+		prevStatus:         data.PrevStatus,
+		responseCache: responseCache{
+			message:       data.ResponseCache.Message,
+			response:      data.ResponseCache.Response,
+			status:        data.ResponseCache.Status,
+			sessionStatus: data.ResponseCache.SessionStatus,
+		},
+		created:    data.Created,
+		lastActive: data.LastActive,
+		result:     data.Result,
+		kssProofs:  data.KssProofs,
+		conf:       s.conf,
+		sessions:   s,
+	}, nil
+}
+
+func (session *session) marshal() ([]byte, error) {
+	request, err := json.Marshal(session.rrequest)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sessionData{
+		Action:             session.action,
+		Requestor:          session.requestor,
+		IdempotencyKey:     session.idempotencyKey,
+		Token:              session.token,
+		ClientToken:        session.clientToken,
+		Version:            session.version,
+		Request:            request,
+		LegacyCompatible:   session.legacyCompatible,
+		PairingCode:        session.pairingCode,
+		PairingAttempts:    session.pairingAttempts,
+		DisclosureAttempts: session.disclosureAttempts,
+		Status:             session.status,
+		PrevStatus:         session.prevStatus,
+		ResponseCache: responseCacheData{
+			Message:       session.responseCache.message,
+			Response:      session.responseCache.response,
+			Status:        session.responseCache.status,
+			SessionStatus: session.responseCache.sessionStatus,
+		},
+		Created:       session.created,
+		LastActive:    session.lastActive,
+		Result:        session.result,
+		LegacySession: session.result.LegacySession,
+		KssProofs:     session.kssProofs,
+	})
+}
@@ -0,0 +1,147 @@
+package servercore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+)
+
+// newFileStoreTestServer returns a test server whose sessions are stored in a temporary
+// directory, along with a function that removes the directory.
+func newFileStoreTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "sessions")
+	require.NoError(t, err)
+
+	conf := newTestServer().conf
+	conf.SessionStoragePath = dir
+	store, err := newFileSessionStore(conf)
+	require.NoError(t, err)
+	return &Server{conf: conf, sessions: store}, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestFileSessionStore(t *testing.T) {
+	s, cleanup := newFileStoreTestServer(t)
+	defer cleanup()
+	conf := s.conf
+	store := s.sessions.(*fileSessionStore)
+
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{requestor: "requestor"})
+	require.NoError(t, err)
+	ses.Lock()
+	ses.setStatus(context.Background(), server.StatusConnected)
+	ses.Unlock()
+	require.FileExists(t, store.filename(ses.token))
+
+	// Load the sessions into a new store, as if the server restarted
+	s.sessions.stop()
+	store, err = newFileSessionStore(conf)
+	require.NoError(t, err)
+	loaded := store.get(context.Background(), ses.token)
+	require.NotNil(t, loaded)
+	require.Equal(t, loaded, store.clientGet(context.Background(), ses.clientToken))
+	require.Equal(t, server.StatusConnected, loaded.status)
+	require.Equal(t, server.StatusConnected, loaded.result.Status)
+	require.Equal(t, irma.ActionDisclosing, loaded.action)
+	require.Equal(t, "requestor", loaded.requestor)
+	require.Zero(t, ses.request.Base().Nonce.Cmp(loaded.request.Base().Nonce))
+	require.Equal(t, store, loaded.sessions)
+
+	// Expired finished sessions are deleted from disk
+	loaded.setStatus(context.Background(), server.StatusDone)
+	expire(loaded)
+	store.deleteExpired(context.Background())
+	require.Nil(t, store.get(context.Background(), ses.token))
+	_, err = os.Stat(store.filename(ses.token))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFileSessionStoreCrash(t *testing.T) {
+	s, cleanup := newFileStoreTestServer(t)
+	defer cleanup()
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.PairingMethod = irma.PairingMethodPin
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	ses.Lock()
+	ses.setStatus(context.Background(), server.StatusPairing)
+	ses.Unlock()
+
+	// A wrong pairing code changes the session but not its status
+	status, _, _ := s.HandleProtocolMessage("session/"+ses.clientToken+"/pairing", http.MethodPost, nil, []byte(`{"pairingCode":"wrong"}`))
+	require.Equal(t, server.ErrorPairingCodeWrong.Status, status)
+
+	// Load the sessions into a new store without stopping the old one, as if the server crashed
+	store, err := newFileSessionStore(s.conf)
+	require.NoError(t, err)
+	loaded := store.get(context.Background(), ses.token)
+	require.NotNil(t, loaded)
+	require.Equal(t, 1, loaded.pairingAttempts)
+	require.True(t, ses.lastActive.Equal(loaded.lastActive))
+}
+
+func TestFileSessionStoreConcurrentUpdates(t *testing.T) {
+	s, cleanup := newFileStoreTestServer(t)
+	defer cleanup()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ses.Lock()
+			defer ses.Unlock()
+			ses.markAlive()
+			ses.sessions.persist(context.Background(), ses)
+		}()
+	}
+	wg.Wait()
+
+	// The file contains the latest state of the session
+	store, err := newFileSessionStore(s.conf)
+	require.NoError(t, err)
+	loaded := store.get(context.Background(), ses.token)
+	require.NotNil(t, loaded)
+	require.True(t, ses.lastActive.Equal(loaded.lastActive))
+}
+
+func TestFileSessionStoreMetrics(t *testing.T) {
+	s, cleanup := newFileStoreTestServer(t)
+	defer cleanup()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	ses.Lock()
+	ses.setStatus(context.Background(), server.StatusDone)
+	ses.Unlock()
+
+	// After a restart the restored session is active, until it is deleted when it expires
+	s.sessions.stop()
+	s.conf.Metrics = server.NewMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(s.conf.Metrics)
+	store, err := newFileSessionStore(s.conf)
+	require.NoError(t, err)
+	activeSessions := func() string {
+		w := httptest.NewRecorder()
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return w.Body.String()
+	}
+	require.Contains(t, activeSessions(), `irma_server_sessions_active{action="disclosing"} 1`+"\n")
+
+	loaded := store.get(context.Background(), ses.token)
+	expire(loaded)
+	store.deleteExpired(context.Background())
+	require.Nil(t, store.get(context.Background(), ses.token))
+	require.Contains(t, activeSessions(), `irma_server_sessions_active{action="disclosing"} 0`+"\n")
+}
@@ -1,6 +1,13 @@
 package servercore
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
@@ -12,17 +19,27 @@ import (
 // Maintaining the session state is done here, as well as checking whether the session is in the
 // appropriate status before handling the request.
 
-func (session *session) handleDelete() {
+func (session *session) handleDelete(ctx context.Context) {
 	if session.status.Finished() {
 		return
 	}
 	session.markAlive()
 
-	session.result = &server.SessionResult{Token: session.token, Status: server.StatusCancelled, Type: session.action}
-	session.setStatus(server.StatusCancelled)
+	session.result = &server.SessionResult{
+		Token:         session.token,
+		Status:        server.StatusCancelled,
+		Type:          session.action,
+		Label:         session.rrequest.Base().Label,
+		CorrelationID: session.correlationID(),
+		Metadata:      session.rrequest.Base().Metadata,
+
+		CreatedAt:         session.result.CreatedAt,
+		ClientConnectedAt: session.result.ClientConnectedAt,
+	}
+	session.setStatus(ctx, server.StatusCancelled)
 }
 
-func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.SessionRequest, *irma.RemoteError) {
+func (session *session) handleGetRequest(ctx context.Context, min, max *irma.ProtocolVersion) (irma.SessionRequest, *irma.RemoteError) {
 	if session.status != server.StatusInitialized {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session already started")
 	}
@@ -40,12 +57,17 @@ func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.S
 
 	var err error
 	if session.version, err = session.chooseProtocolVersion(min, max); err != nil {
-		return nil, session.fail(server.ErrorProtocolVersion, "")
+		return nil, session.fail(ctx, server.ErrorProtocolVersion, "")
 	}
 	logger.WithFields(logrus.Fields{"version": session.version.String()}).Debugf("Protocol version negotiated")
 	session.request.Base().ProtocolVersion = session.version
 
-	session.setStatus(server.StatusConnected)
+	if session.pairingCode != "" {
+		logger.Debug("Awaiting pairing code")
+		session.setStatus(ctx, server.StatusPairing)
+	} else {
+		session.setStatus(ctx, server.StatusConnected)
+	}
 
 	if session.version.Below(2, 5) {
 		logger.Info("Returning legacy session format")
@@ -59,69 +81,178 @@ func (session *session) handleGetStatus() (server.Status, *irma.RemoteError) {
 	return session.status, nil
 }
 
-func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irma.ProofStatus, *irma.RemoteError) {
+func (session *session) handleGetFrontendStatus() (*server.FrontendStatus, *irma.RemoteError) {
+	status := &server.FrontendStatus{Status: session.status}
+	if session.status == server.StatusDone {
+		status.ReturnURL = session.rrequest.Base().ReturnURL
+	}
+	return status, nil
+}
+
+// handleGetPublicRequest returns the session request for display to the user, for example by a
+// web frontend showing what will be disclosed, signed or issued. Unlike handleGetRequest, it does
+// not start the session, and the fields that the server sets for the IRMA protocol (the context,
+// nonce and protocol version) are left out.
+func (session *session) handleGetPublicRequest() (irma.SessionRequest, *irma.RemoteError) {
+	// Copy the request using JSON, as in purgeRequest(), so that we can safely strip fields from it
+	cpy := reflect.New(reflect.TypeOf(session.request).Elem()).Interface().(irma.SessionRequest)
+	bts, err := json.Marshal(session.request)
+	if err != nil {
+		return nil, server.RemoteError(server.ErrorUnknown, err.Error())
+	}
+	if err = json.Unmarshal(bts, cpy); err != nil {
+		return nil, server.RemoteError(server.ErrorUnknown, err.Error())
+	}
+
+	base := cpy.Base()
+	base.Context = nil
+	base.Nonce = nil
+	base.ProtocolVersion = nil
+	return cpy, nil
+}
+
+func (session *session) handlePostPairingCode(ctx context.Context, msg *irma.PairingCodeMessage) (server.Status, *irma.RemoteError) {
+	if session.status != server.StatusPairing {
+		return "", server.RemoteError(server.ErrorUnexpectedRequest, "Session not awaiting pairing")
+	}
+	session.markAlive()
+
+	if subtle.ConstantTimeCompare([]byte(msg.PairingCode), []byte(session.pairingCode)) != 1 {
+		session.pairingAttempts++
+		if session.pairingAttempts >= maxPairingAttempts {
+			return "", session.fail(ctx, server.ErrorPairingFailed, "")
+		}
+		return "", server.RemoteError(server.ErrorPairingCodeWrong,
+			fmt.Sprintf("%d attempts left", maxPairingAttempts-session.pairingAttempts))
+	}
+
+	session.setStatus(ctx, server.StatusConnected)
+	return session.status, nil
+}
+
+func (session *session) handlePostSignature(ctx context.Context, signature *irma.SignedMessage) (*irma.ProofStatus, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
+	session.setStatus(ctx, server.StatusCommunicating)
 
 	var err error
 	var rerr *irma.RemoteError
 	session.result.Signature = signature
-	session.result.Disclosed, session.result.ProofStatus, err = signature.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.SignatureRequest))
+	request := session.request.(*irma.SignatureRequest)
+	session.result.Disclosed, session.result.ProofStatus, err = signature.Verify(session.conf.IrmaConfiguration, request)
+	if err == nil && session.result.ProofStatus == irma.ProofStatusValid {
+		if rerr = session.checkUnrequested(ctx); rerr != nil {
+			return nil, rerr
+		}
+	}
+	if err == nil && session.result.ProofStatus != irma.ProofStatusValid {
+		return nil, session.rejectProofs(ctx)
+	}
 	if err == nil {
-		session.setStatus(server.StatusDone)
+		session.result.Disjunctions = request.Disclose.DisjunctionStatuses(session.result.Disclosed)
+		session.setStatus(ctx, server.StatusDone)
 	} else {
 		if err == irma.ErrorMissingPublicKey {
-			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
+			rerr = session.fail(ctx, server.ErrorUnknownPublicKey, err.Error())
 		} else {
-			rerr = session.fail(server.ErrorUnknown, err.Error())
+			rerr = session.fail(ctx, server.ErrorUnknown, err.Error())
 		}
 	}
 	return &session.result.ProofStatus, rerr
 }
 
-func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma.ProofStatus, *irma.RemoteError) {
+// checkUnrequested fails the session if the client disclosed attributes that do not correspond to
+// any of the requested disjunctions, which honest clients never do, naming those attributes.
+func (session *session) checkUnrequested(ctx context.Context) *irma.RemoteError {
+	var extra []string
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			if attr.Status == irma.AttributeProofStatusExtra {
+				extra = append(extra, attr.Identifier.String())
+			}
+		}
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "attributes": extra}).
+		Warn("Client disclosed attributes that were not requested")
+	return session.fail(ctx, server.ErrorUnrequested, strings.Join(extra, ", "))
+}
+
+// rejectProofs rejects the proofs that the client submitted, which verified but were not valid.
+// If the proofs lacked requested attributes or contained expired ones, the client may submit proofs
+// again and the session returns to StatusConnected, unless this was the last attempt. Other proofs,
+// e.g. cryptographically invalid ones, are not the result of an honest mistake and fail the session.
+func (session *session) rejectProofs(ctx context.Context) *irma.RemoteError {
+	status := session.result.ProofStatus
+	if status != irma.ProofStatusMissingAttributes && status != irma.ProofStatusExpired {
+		return session.fail(ctx, server.ErrorInvalidProofs, fmt.Sprintf("proof status %s", status))
+	}
+	session.disclosureAttempts++
+	if session.disclosureAttempts >= session.conf.MaxDisclosureAttempts {
+		return session.fail(ctx, server.ErrorTooManyAttempts,
+			fmt.Sprintf("proof status %s, no attempts left", status))
+	}
+	session.result.Disclosed, session.result.ProofStatus, session.result.Signature = nil, "", nil
+	session.setStatus(ctx, server.StatusConnected)
+	return server.RemoteError(server.ErrorProofsRejected,
+		fmt.Sprintf("proof status %s, %d attempts left", status, session.conf.MaxDisclosureAttempts-session.disclosureAttempts))
+}
+
+func (session *session) handlePostDisclosure(ctx context.Context, disclosure *irma.Disclosure) (*irma.ProofStatus, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
+	session.setStatus(ctx, server.StatusCommunicating)
 
 	var err error
 	var rerr *irma.RemoteError
-	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.DisclosureRequest))
+	request := session.request.(*irma.DisclosureRequest)
+	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(session.conf.IrmaConfiguration, request)
+	if err == nil && session.result.ProofStatus == irma.ProofStatusValid {
+		if rerr = session.checkUnrequested(ctx); rerr != nil {
+			return nil, rerr
+		}
+	}
+	if err == nil && session.result.ProofStatus != irma.ProofStatusValid {
+		return nil, session.rejectProofs(ctx)
+	}
 	if err == nil {
-		session.setStatus(server.StatusDone)
+		session.result.Disjunctions = request.Disclose.DisjunctionStatuses(session.result.Disclosed)
+		session.setStatus(ctx, server.StatusDone)
 	} else {
 		if err == irma.ErrorMissingPublicKey {
-			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
+			rerr = session.fail(ctx, server.ErrorUnknownPublicKey, err.Error())
 		} else {
-			rerr = session.fail(server.ErrorUnknown, err.Error())
+			rerr = session.fail(ctx, server.ErrorUnknown, err.Error())
 		}
 	}
 	return &session.result.ProofStatus, rerr
 }
 
-func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
+func (session *session) handlePostCommitments(ctx context.Context, commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
+	session.setStatus(ctx, server.StatusCommunicating)
 
 	request := session.request.(*irma.IssuanceRequest)
 
 	discloseCount := len(commitments.Proofs) - len(request.Credentials)
 	if discloseCount < 0 {
-		return nil, session.fail(server.ErrorMalformedInput, "Received insufficient proofs")
+		return nil, session.fail(ctx, server.ErrorMalformedInput, "Received insufficient proofs")
 	}
 
 	// Compute list of public keys against which to verify the received proofs
 	disclosureproofs := irma.ProofList(commitments.Proofs[:discloseCount])
 	pubkeys, err := disclosureproofs.ExtractPublicKeys(session.conf.IrmaConfiguration)
 	if err != nil {
-		return nil, session.fail(server.ErrorMalformedInput, err.Error())
+		return nil, session.fail(ctx, server.ErrorMalformedInput, err.Error())
 	}
 	for _, cred := range request.Credentials {
 		iss := cred.CredentialTypeID.IssuerIdentifier()
@@ -136,7 +267,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		if session.conf.IrmaConfiguration.SchemeManagers[schemeid].Distributed() {
 			proofP, err := session.getProofP(commitments, schemeid)
 			if err != nil {
-				return nil, session.fail(server.ErrorKeyshareProofMissing, err.Error())
+				return nil, session.fail(ctx, server.ErrorKeyshareProofMissing, err.Error())
 			}
 			proof.MergeProofP(proofP, pubkey)
 		}
@@ -147,17 +278,21 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		session.conf.IrmaConfiguration, request.Disclose, request.GetContext(), request.GetNonce(nil), pubkeys, false)
 	if err != nil {
 		if err == irma.ErrorMissingPublicKey {
-			return nil, session.fail(server.ErrorUnknownPublicKey, "")
+			return nil, session.fail(ctx, server.ErrorUnknownPublicKey, "")
 		} else {
-			return nil, session.fail(server.ErrorUnknown, "")
+			return nil, session.fail(ctx, server.ErrorUnknown, "")
 		}
 	}
 	if session.result.ProofStatus == irma.ProofStatusExpired {
-		return nil, session.fail(server.ErrorAttributesExpired, "")
+		return nil, session.fail(ctx, server.ErrorAttributesExpired, "")
 	}
 	if session.result.ProofStatus != irma.ProofStatusValid {
-		return nil, session.fail(server.ErrorInvalidProofs, "")
+		return nil, session.fail(ctx, server.ErrorInvalidProofs, "")
+	}
+	if rerr := session.checkUnrequested(ctx); rerr != nil {
+		return nil, rerr
 	}
+	session.result.Disjunctions = request.Disclose.DisjunctionStatuses(session.result.Disclosed)
 
 	// Compute CL signatures
 	var sigs []*gabi.IssueSignatureMessage
@@ -165,22 +300,22 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		id := cred.CredentialTypeID.IssuerIdentifier()
 		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
 		sk, _ := session.conf.PrivateKey(id)
-		issuer := gabi.NewIssuer(sk, pk, one)
+		issuer := gabi.NewIssuer(sk, pk, request.GetContext())
 		proof, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
 		if !ok {
-			return nil, session.fail(server.ErrorMalformedInput, "Received invalid issuance commitment")
+			return nil, session.fail(ctx, server.ErrorMalformedInput, "Received invalid issuance commitment")
 		}
 		attributes, err := cred.AttributeList(session.conf.IrmaConfiguration, 0x03)
 		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+			return nil, session.fail(ctx, server.ErrorIssuanceFailed, err.Error())
 		}
 		sig, err := issuer.IssueSignature(proof.U, attributes.Ints, commitments.Nonce2)
 		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+			return nil, session.fail(ctx, server.ErrorIssuanceFailed, err.Error())
 		}
 		sigs = append(sigs, sig)
 	}
 
-	session.setStatus(server.StatusDone)
+	session.setStatus(ctx, server.StatusDone)
 	return sigs, nil
 }
@@ -1,16 +1,24 @@
 package servercore
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
@@ -24,27 +32,128 @@ func (session *session) markAlive() {
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debugf("Session marked active, expiry delayed")
 }
 
-func (session *session) setStatus(status server.Status) {
-	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "prevStatus": session.prevStatus, "status": status}).
+// setStatus updates the status of the session, informing anyone waiting for status updates.
+// All changes of the session status must go through this function, while holding the session lock.
+func (session *session) setStatus(ctx context.Context, status server.Status) {
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "requestor": session.requestor, "prevStatus": session.prevStatus, "status": status}).
 		Info("Session status updated")
+	if session.conf.Metrics != nil && !session.status.Finished() && status.Finished() {
+		session.conf.Metrics.SessionFinished(session.action, status)
+	}
+	finished := !session.status.Finished() && status.Finished()
+	now := time.Now()
+	if status == server.StatusConnected && session.result.ClientConnectedAt == nil {
+		session.result.ClientConnectedAt = &now
+	}
+	if finished {
+		session.result.FinishedAt = &now
+	}
 	session.status = status
 	session.result.Status = status
-	session.sessions.update(session)
+	session.sessions.update(ctx, session)
+	if finished && session.conf.AuditLogger != nil {
+		session.audit()
+	}
+}
+
+// audit logs the result of the finished session to the audit logger.
+func (session *session) audit() {
+	result := session.result
+	fields := logrus.Fields{
+		"session":   session.token,
+		"requestor": session.requestor,
+		"action":    session.action,
+		"status":    result.Status,
+	}
+	if result.Label != "" {
+		fields["label"] = result.Label
+	}
+	if result.ProofStatus != "" {
+		fields["proofStatus"] = result.ProofStatus
+	}
+	if result.Err != nil {
+		fields["error"] = result.Err.ErrorName
+	}
+	if request, ok := session.rrequest.SessionRequest().(*irma.IssuanceRequest); ok && result.Status == server.StatusDone {
+		var creds []string
+		for _, cred := range request.Credentials {
+			creds = append(creds, cred.CredentialTypeID.String())
+		}
+		fields["issued"] = creds
+	}
+
+	var disclosed []string
+	values := map[string]*string{}
+	for _, attrs := range result.Disclosed {
+		for _, attr := range attrs {
+			disclosed = append(disclosed, attr.Identifier.String())
+			values[attr.Identifier.String()] = attr.RawValue
+			if attr.RawValue != nil && session.conf.Redacts(attr.Identifier) {
+				redacted := server.RedactedValue
+				values[attr.Identifier.String()] = &redacted
+			}
+		}
+	}
+	if len(disclosed) > 0 {
+		fields["disclosed"] = disclosed
+		if session.conf.AuditIncludeValues {
+			fields["values"] = values
+		}
+	}
+
+	session.conf.AuditLogger.WithFields(fields).Info("Session finished")
+}
+
+// resultCopy returns a copy of the session result, which may still be read after the session lock
+// is released, unlike session.result which is modified when the status changes. The caller must
+// hold the session lock.
+func (session *session) resultCopy() *server.SessionResult {
+	result := *session.result
+	return &result
 }
 
+// onUpdate informs anyone waiting for status updates. The caller must hold the session lock.
 func (session *session) onUpdate() {
+	if session.statusCond != nil {
+		session.statusCond.Broadcast()
+	}
 	if session.evtSource != nil {
 		session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "status": session.status}).
 			Debug("Sending status to SSE listeners")
+		// No more updates follow a final status, so we can stop listeners now instead of at expiry
+		if session.status.Finished() {
+			session.closeEventSource()
+			return
+		}
 		// We send JSON like the other APIs, so quote
 		session.evtSource.SendEventMessage(fmt.Sprintf(`"%s"`, session.status), "", "")
 	}
 }
 
-func (session *session) fail(err server.Error, message string) *irma.RemoteError {
+// statusChanged returns the condition variable that is signalled when the session is updated.
+// The caller must hold the session lock.
+func (session *session) statusChanged() *sync.Cond {
+	if session.statusCond == nil {
+		session.statusCond = sync.NewCond(&session.Mutex)
+	}
+	return session.statusCond
+}
+
+func (session *session) fail(ctx context.Context, err server.Error, message string) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
-	session.setStatus(server.StatusCancelled)
-	session.result = &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action}
+	session.result = &server.SessionResult{
+		Err:           rerr,
+		Token:         session.token,
+		Status:        server.StatusCancelled,
+		Type:          session.action,
+		Label:         session.rrequest.Base().Label,
+		CorrelationID: session.correlationID(),
+		Metadata:      session.rrequest.Base().Metadata,
+
+		CreatedAt:         session.result.CreatedAt,
+		ClientConnectedAt: session.result.ClientConnectedAt,
+	}
+	session.setStatus(ctx, server.StatusCancelled)
 	return rerr
 }
 
@@ -55,7 +164,7 @@ const retryTimeLimit = 10 * time.Second
 // - the same was POSTed as last time
 // - last time was not more than 10 seconds ago (retryablehttp client gives up before this)
 // - the session status is what it is expected to be when receiving the request for a second time.
-func (session *session) checkCache(message []byte, expectedStatus server.Status) (int, []byte) {
+func (session *session) checkCache(ctx context.Context, message []byte, expectedStatus server.Status) (int, []byte) {
 	if len(session.responseCache.response) > 0 {
 		if session.responseCache.sessionStatus != expectedStatus {
 			// don't replay a cache value that was set in a previous session state
@@ -65,13 +174,120 @@ func (session *session) checkCache(message []byte, expectedStatus server.Status)
 		if sha256.Sum256(session.responseCache.message) != sha256.Sum256(message) ||
 			session.lastActive.Before(time.Now().Add(-retryTimeLimit)) ||
 			session.status != expectedStatus {
-			return server.JsonResponse(nil, session.fail(server.ErrorUnexpectedRequest, ""))
+			return server.JsonResponse(nil, session.fail(ctx, server.ErrorUnexpectedRequest, ""))
 		}
 		return session.responseCache.status, session.responseCache.response
 	}
 	return 0, nil
 }
 
+const (
+	defaultMaxDisjunctions     = 100
+	defaultMaxAttributes       = 500
+	defaultMaxRequestBodyBytes = 1 << 20
+
+	defaultMaxSignatureMessageBytes = 1 << 16
+	defaultMaxDisclosureAttempts    = 3
+
+	defaultSchemesUpdateJitter  = 60 // seconds
+	defaultSchemesUpdateBackoff = 60 // seconds
+)
+
+// validateRequestSize checks that the disclosure request does not contain more disjunctions or
+// attributes than configured. Both bounds are always enforced: verifyConfiguration replaces zero
+// bounds by their defaults.
+func (s *Server) validateRequestSize(request irma.SessionRequest) error {
+	condiscon := request.Disclosure().Disclose
+	if len(condiscon) > s.conf.MaxDisjunctions {
+		return server.RemoteError(server.ErrorRequestTooLarge,
+			fmt.Sprintf("request contains %d disjunctions, at most %d allowed", len(condiscon), s.conf.MaxDisjunctions))
+	}
+	count := 0
+	_ = condiscon.Iterate(func(*irma.AttributeRequest) error {
+		count++
+		return nil
+	})
+	if count > s.conf.MaxAttributes {
+		return server.RemoteError(server.ErrorRequestTooLarge,
+			fmt.Sprintf("request contains %d attributes, at most %d allowed", count, s.conf.MaxAttributes))
+	}
+	return nil
+}
+
+// validateSignatureMessage checks that the message to be signed is not larger than configured,
+// and that it is text if so configured.
+func (s *Server) validateSignatureMessage(message string) error {
+	if s.conf.MaxSignatureMessageBytes > 0 && len(message) > s.conf.MaxSignatureMessageBytes {
+		return server.RemoteError(server.ErrorRequestTooLarge,
+			fmt.Sprintf("message to be signed is %d bytes, at most %d allowed", len(message), s.conf.MaxSignatureMessageBytes))
+	}
+	if !s.conf.SignatureMessageText {
+		return nil
+	}
+	if !utf8.ValidString(message) {
+		return server.RemoteError(server.ErrorInvalidRequest, "message to be signed is not valid UTF-8")
+	}
+	for _, r := range message {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return server.RemoteError(server.ErrorInvalidRequest,
+				fmt.Sprintf("message to be signed contains control character %U", r))
+		}
+	}
+	return nil
+}
+
+// maxContextBits is the size of the challenge hash of the zero-knowledge proofs, into which the
+// context of the session is hashed.
+var maxContextBits = int(gabi.DefaultSystemParameters[2048].Lh)
+
+// validateContext checks that the context specified in a session request, if any, is a positive
+// integer of at most maxContextBits bits.
+func validateContext(context *big.Int) error {
+	if context == nil {
+		return nil
+	}
+	if context.Sign() <= 0 || context.BitLen() > maxContextBits {
+		return server.RemoteError(server.ErrorInvalidRequest,
+			fmt.Sprintf("context must be a positive integer of at most %d bits", maxContextBits))
+	}
+	return nil
+}
+
+// validateReturnURL checks that the return URL of a session request, if any, is allowed by the
+// configuration. Its syntax is already checked when validating the request.
+func (s *Server) validateReturnURL(returnURL string) error {
+	if returnURL == "" || len(s.conf.AllowedReturnURLs) == 0 {
+		return nil
+	}
+	u, err := url.Parse(returnURL)
+	if err != nil {
+		return errors.WrapPrefix(err, "Invalid return URL", 0)
+	}
+	for _, allowed := range s.conf.AllowedReturnURLs {
+		a, err := url.Parse(allowed)
+		if err == nil && returnURLAllowed(u, a) {
+			return nil
+		}
+	}
+	return errors.Errorf("Return URL %s not allowed", returnURL)
+}
+
+// returnURLAllowed checks that the return URL has the same scheme and host as the allowed URL,
+// and that its path lies within the path of the allowed URL. Comparing the parsed URLs instead of
+// their strings prevents e.g. https://example.com.evil.org or https://example.com@evil.org from
+// matching https://example.com.
+func returnURLAllowed(u, allowed *url.URL) bool {
+	if u.User != nil || !strings.EqualFold(u.Scheme, allowed.Scheme) || !strings.EqualFold(u.Host, allowed.Host) {
+		return false
+	}
+	prefix := strings.TrimSuffix(allowed.Path, "/")
+	if prefix == "" {
+		return true
+	}
+	p := path.Clean("/" + u.Path)
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
 // Issuance helpers
 
 func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
@@ -99,19 +315,38 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 			return err
 		}
 
-		// Ensure the credential has an expiry date
-		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
+		// Ensure the credential has an expiry date, within the maximum validity if configured
 		if cred.Validity == nil {
+			defaultValidity := irma.Timestamp(s.defaultCredentialValidity())
 			cred.Validity = &defaultValidity
 		}
 		if cred.Validity.Before(irma.Timestamp(time.Now())) {
 			return errors.New("cannot issue expired credentials")
 		}
+		if s.conf.MaxCredentialValidity > 0 &&
+			cred.Validity.After(irma.Timestamp(time.Now().AddDate(0, 0, s.conf.MaxCredentialValidity))) {
+			return errors.Errorf("validity of credential %s exceeds the maximum of %d days",
+				cred.CredentialTypeID, s.conf.MaxCredentialValidity)
+		}
 	}
 
 	return nil
 }
 
+// defaultCredentialValidity returns the expiry date of issued credentials whose validity the
+// issuance request does not specify.
+func (s *Server) defaultCredentialValidity() time.Time {
+	now := time.Now()
+	validity := now.AddDate(0, 6, 0)
+	if s.conf.DefaultCredentialValidity > 0 {
+		validity = now.AddDate(0, 0, s.conf.DefaultCredentialValidity)
+	}
+	if max := now.AddDate(0, 0, s.conf.MaxCredentialValidity); s.conf.MaxCredentialValidity > 0 && validity.After(max) {
+		validity = max
+	}
+	return validity
+}
+
 func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, scheme irma.SchemeManagerIdentifier) (*gabi.ProofP, error) {
 	if session.kssProofs == nil {
 		session.kssProofs = make(map[irma.SchemeManagerIdentifier]*gabi.ProofP)
@@ -142,16 +377,53 @@ func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, sche
 
 var eventHeaders = [][]byte{[]byte("Access-Control-Allow-Origin: *")}
 
+// eventSource returns the event source of the session, creating it if necessary. It returns nil
+// if server sent events are disabled, in which case onUpdate and closeEventSource do nothing.
 func (session *session) eventSource() eventsource.EventSource {
-	if session.evtSource != nil {
+	if session.evtSource != nil || !session.conf.EnableSSE {
 		return session.evtSource
 	}
 
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debug("Making server sent event source")
 	session.evtSource = eventsource.New(nil, func(_ *http.Request) [][]byte { return eventHeaders })
+	if session.conf.SSEKeepaliveInterval > 0 {
+		session.evtStop = make(chan struct{})
+		go keepalive(session.evtSource, time.Duration(session.conf.SSEKeepaliveInterval)*time.Second, session.evtStop)
+	}
 	return session.evtSource
 }
 
+// keepalive periodically sends a ping event to the listeners of the event source until it receives
+// from stop, preventing e.g. mobile networks from dropping idle connections. As stop is unbuffered,
+// no ping is being sent once the send on stop completes, so the event source can then be closed.
+func keepalive(evtSource eventsource.EventSource, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			evtSource.SendEventMessage("", "ping", "")
+		case <-stop:
+			return
+		}
+	}
+}
+
+// closeEventSource sends the session status one last time to the SSE listeners, if any, so that
+// they stop listening, and then closes the event source. The caller must hold the session lock.
+func (session *session) closeEventSource() {
+	if session.evtSource == nil {
+		return
+	}
+	session.evtSource.SendEventMessage(fmt.Sprintf(`"%s"`, session.status), "", "")
+	if session.evtStop != nil {
+		session.evtStop <- struct{}{}
+		session.evtStop = nil
+	}
+	session.evtSource.Close()
+	session.evtSource = nil
+}
+
 // Other
 
 func (session *session) chooseProtocolVersion(minClient, maxClient *irma.ProtocolVersion) (*irma.ProtocolVersion, error) {
@@ -161,18 +433,39 @@ func (session *session) chooseProtocolVersion(minClient, maxClient *irma.Protoco
 		minServer = &irma.ProtocolVersion{2, 5}
 	}
 
-	if minClient.AboveVersion(maxProtocolVersion) || maxClient.BelowVersion(minServer) || maxClient.BelowVersion(minClient) {
-		return nil, server.LogWarning(errors.Errorf("Protocol version negotiation failed, min=%s max=%s minServer=%s maxServer=%s", minClient.String(), maxClient.String(), minServer.String(), maxProtocolVersion.String()))
+	version, err := irma.NegotiateVersion(&irma.Qr{ProtocolVersion: minServer, ProtocolMaxVersion: maxProtocolVersion}, minClient, maxClient)
+	if err != nil {
+		return nil, server.LogWarning(errors.WrapPrefix(err, "Protocol version negotiation failed", 0))
 	}
-	if maxClient.AboveVersion(maxProtocolVersion) {
-		return maxProtocolVersion, nil
-	} else {
-		return maxClient, nil
+	return version, nil
+}
+
+// copyRequest returns a copy of the requestor request with its own copy of the session request,
+// such that setting the fields of the session request that the server chooses per session (the
+// nonce, context and protocol version) does not modify the request of the caller, who may start
+// other sessions with it. The copy is shallow: its other fields are shared with the original.
+func copyRequest(request irma.RequestorRequest) irma.RequestorRequest {
+	switch r := request.(type) {
+	case *irma.ServiceProviderRequest:
+		cpy, req := *r, *r.Request
+		cpy.Request = &req
+		return &cpy
+	case *irma.SignatureRequestorRequest:
+		cpy, req := *r, *r.Request
+		cpy.Request = &req
+		return &cpy
+	case *irma.IdentityProviderRequest:
+		cpy, req := *r, *r.Request
+		cpy.Request = &req
+		return &cpy
+	default:
+		return request
 	}
 }
 
-// purgeRequest logs the request excluding any attribute values.
-func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
+// purgeRequest returns a copy of the request for logging, excluding the values of the attributes
+// for which purge returns true.
+func purgeRequest(request irma.RequestorRequest, purge func(irma.AttributeTypeIdentifier) bool) irma.RequestorRequest {
 	// We want to log as much as possible of the request, but no attribute values.
 	// We cannot just remove them from the request parameter as that would break the calling code.
 	// So we create a deep copy of the request from which we can then safely remove whatever we want to.
@@ -186,7 +479,9 @@ func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	// Remove required attribute values from any attributes to be disclosed
 	_ = cpy.(irma.RequestorRequest).SessionRequest().Disclosure().Disclose.Iterate(
 		func(attr *irma.AttributeRequest) error {
-			attr.Value = nil
+			if purge(attr.Type) {
+				attr.Value = nil
+			}
 			return nil
 		},
 	)
@@ -194,7 +489,11 @@ func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	// Remove attribute values from attributes to be issued
 	if isreq, ok := cpy.(*irma.IdentityProviderRequest); ok {
 		for _, cred := range isreq.Request.Credentials {
-			cred.Attributes = nil
+			for name := range cred.Attributes {
+				if purge(irma.NewAttributeTypeIdentifier(cred.CredentialTypeID.String() + "." + name)) {
+					delete(cred.Attributes, name)
+				}
+			}
 		}
 	}
 
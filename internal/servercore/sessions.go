@@ -1,10 +1,17 @@
 package servercore
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
@@ -17,6 +24,8 @@ type session struct {
 	sync.Mutex
 
 	action           irma.Action
+	requestor        string // name of the requestor that started the session, or anonymousRequestor
+	idempotencyKey   string // if nonempty, starting a session with this key returns this session
 	token            string
 	clientToken      string
 	version          *irma.ProtocolVersion
@@ -24,11 +33,21 @@ type session struct {
 	request          irma.SessionRequest
 	legacyCompatible bool // if the request is convertible to pre-condiscon format
 
+	pairingCode     string // if nonempty, the client must submit this code before the session proceeds
+	pairingAttempts int    // amount of incorrect pairing codes submitted so far
+
+	disclosureAttempts int // amount of rejected proofs submitted so far
+
+	active bool // if the session is not yet finished and so counts towards the MaxSessions limit of the store
+
 	status        server.Status
 	prevStatus    server.Status
 	evtSource     eventsource.EventSource
+	evtStop       chan struct{} // sent on to stop sending keepalives to SSE listeners
+	statusCond    *sync.Cond    // signalled on updates, for long-polling requestors; see statusChanged()
 	responseCache responseCache
 
+	created    time.Time
 	lastActive time.Time
 	result     *server.SessionResult
 
@@ -45,26 +64,61 @@ type responseCache struct {
 	sessionStatus server.Status
 }
 
+// sessionStore keeps track of all sessions. The context passed to its methods is that of the HTTP
+// request being handled, if any; stores that make remote calls should honour its deadline and
+// cancellation. The memory and file stores ignore it.
 type sessionStore interface {
-	get(token string) *session
-	clientGet(token string) *session
-	add(session *session)
-	update(session *session)
-	deleteExpired()
+	get(ctx context.Context, token string) *session
+	clientGet(ctx context.Context, token string) *session
+	idempotentGet(ctx context.Context, requestor, key string) *session
+	add(ctx context.Context, session *session) error
+	// update is called after the status of the session changed, and persist after other changes.
+	// The caller must hold the session lock.
+	update(ctx context.Context, session *session)
+	persist(ctx context.Context, session *session)
+	count() int
+	iterate(f func(session *session))
+	deleteExpired(ctx context.Context)
 	stop()
 }
 
 type memorySessionStore struct {
+	// Amount of sessions that are not yet finished, which is limited by MaxSessions; accessed
+	// atomically, and so kept first in the struct to ensure its 64-bit alignment
+	active int64
+
 	sync.RWMutex
 	conf *server.Configuration
 
-	requestor map[string]*session
-	client    map[string]*session
+	requestor  map[string]*session
+	client     map[string]*session
+	idempotent map[requestorKey]*session
+	correlated map[requestorKey]*session
+}
+
+// requestorKey identifies a session by the idempotency key with which it was started, or by the
+// correlation ID of its request. Keys are scoped per requestor, so that requestors cannot obtain
+// each other's sessions.
+type requestorKey struct {
+	requestor, key string
 }
 
 const (
-	maxSessionLifetime = 5 * time.Minute // After this a session is cancelled
+	maxSessionLifetime = 5 * time.Minute // Default session timeout and result retention
 	sessionChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	sessionTokenLength = 20
+	minSessionChars    = 28 // Such that session tokens contain at least 96 bits of entropy
+	maxTokenAttempts   = 10 // Amount of times we try to generate unused session tokens
+	anonymousRequestor = "anonymous"
+	maxPairingAttempts = 3 // After this many incorrect pairing codes the session is cancelled
+)
+
+var (
+	// Source of randomness for session tokens; may be replaced in tests
+	tokenRandReader io.Reader = rand.Reader
+
+	errTokenCollision      = errors.New("session token already in use")
+	errIdempotencyKeyInUse = errors.New("idempotency key already in use")
 )
 
 var (
@@ -72,40 +126,144 @@ var (
 	maxProtocolVersion = irma.NewVersion(2, 5)
 )
 
-func (s *memorySessionStore) get(t string) *session {
+func newMemorySessionStore(conf *server.Configuration) *memorySessionStore {
+	return &memorySessionStore{
+		requestor:  make(map[string]*session),
+		client:     make(map[string]*session),
+		idempotent: make(map[requestorKey]*session),
+		correlated: make(map[requestorKey]*session),
+		conf:       conf,
+	}
+}
+
+func (s *memorySessionStore) get(ctx context.Context, t string) *session {
 	s.RLock()
 	defer s.RUnlock()
 	return s.requestor[t]
 }
 
-func (s *memorySessionStore) clientGet(t string) *session {
+func (s *memorySessionStore) clientGet(ctx context.Context, t string) *session {
 	s.RLock()
 	defer s.RUnlock()
 	return s.client[t]
 }
 
-func (s *memorySessionStore) add(session *session) {
+func (s *memorySessionStore) idempotentGet(ctx context.Context, requestor, key string) *session {
+	s.RLock()
+	defer s.RUnlock()
+	return s.idempotent[requestorKey{requestor, key}]
+}
+
+func (s *memorySessionStore) add(ctx context.Context, session *session) error {
 	s.Lock()
 	defer s.Unlock()
+	if s.conf.MaxSessions > 0 && atomic.LoadInt64(&s.active) >= int64(s.conf.MaxSessions) {
+		return server.RemoteError(server.ErrorTooManySessions, "")
+	}
+	if session.idempotencyKey != "" && s.idempotent[session.idempotentKey()] != nil {
+		return errIdempotencyKeyInUse
+	}
+	if session.correlationID() != "" && s.correlated[session.correlationKey()] != nil {
+		return server.RemoteError(server.ErrorDuplicateCorrelationID, session.correlationID())
+	}
+	if s.requestor[session.token] != nil || s.client[session.clientToken] != nil {
+		return errTokenCollision
+	}
 	s.requestor[session.token] = session
 	s.client[session.clientToken] = session
+	if session.idempotencyKey != "" {
+		s.idempotent[session.idempotentKey()] = session
+	}
+	if session.correlationID() != "" {
+		s.correlated[session.correlationKey()] = session
+	}
+	s.activate(session)
+	return nil
 }
 
-func (s *memorySessionStore) update(session *session) {
+func (s *memorySessionStore) update(ctx context.Context, session *session) {
+	if session.status.Finished() {
+		s.deactivate(session)
+	}
 	session.onUpdate()
 }
 
+// activate counts the session as active if it is not yet finished. The session must not yet be
+// accessible by others, or the caller must hold the session lock.
+func (s *memorySessionStore) activate(session *session) {
+	if !session.status.Finished() {
+		session.active = true
+		atomic.AddInt64(&s.active, 1)
+	}
+}
+
+// deactivate stops counting the session as active, if it was. The caller must hold the session lock.
+func (s *memorySessionStore) deactivate(session *session) {
+	if session.active {
+		session.active = false
+		atomic.AddInt64(&s.active, -1)
+	}
+}
+
+func (s *memorySessionStore) persist(ctx context.Context, session *session) {}
+
+func (s *memorySessionStore) count() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.requestor)
+}
+
+// iterate calls f on all sessions, while holding the read lock of the session store.
+// f must therefore not modify the session store.
+func (s *memorySessionStore) iterate(f func(session *session)) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, session := range s.requestor {
+		f(session)
+	}
+}
+
 func (s *memorySessionStore) stop() {
 	s.Lock()
 	defer s.Unlock()
 	for _, session := range s.requestor {
-		if session.evtSource != nil {
-			session.evtSource.Close()
+		session.Lock()
+		session.closeEventSource()
+		session.Unlock()
+	}
+}
+
+func (s *memorySessionStore) deleteExpired(ctx context.Context) {
+	s.deleteExpiredSessions(ctx)
+}
+
+// resultRetention returns how long the results of finished sessions are retained.
+func (s *memorySessionStore) resultRetention() time.Duration {
+	if s.conf.ResultRetention == 0 {
+		return maxSessionLifetime
+	}
+	return time.Duration(s.conf.ResultRetention) * time.Second
+}
+
+// timeout returns how long the specified unfinished session may be inactive before it times out:
+// the scan timeout if the client has not yet connected, and the interaction timeout otherwise.
+func (s *memorySessionStore) timeout(session *session) time.Duration {
+	timeout := s.conf.InteractionTimeout
+	if session.status == server.StatusInitialized {
+		if session.rrequest.Base().ClientTimeout != 0 {
+			return time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
 		}
+		timeout = s.conf.ScanTimeout
 	}
+	if timeout == 0 {
+		return maxSessionLifetime
+	}
+	return time.Duration(timeout) * time.Second
 }
 
-func (s *memorySessionStore) deleteExpired() {
+// deleteExpiredSessions times out expired sessions, deletes expired finished sessions,
+// and returns the tokens of the latter.
+func (s *memorySessionStore) deleteExpiredSessions(ctx context.Context) []string {
 	// First check which sessions have expired
 	// We don't need a write lock for this yet, so postpone that for actual deleting
 	s.RLock()
@@ -113,20 +271,17 @@ func (s *memorySessionStore) deleteExpired() {
 	for token, session := range s.requestor {
 		session.Lock()
 
-		timeout := maxSessionLifetime
-		if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
-		}
-
-		if session.lastActive.Add(timeout).Before(time.Now()) {
-			if !session.status.Finished() {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
-				session.markAlive()
-				session.setStatus(server.StatusTimeout)
-			} else {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
+		if session.status.Finished() {
+			// The result of finished sessions is retained for the requestor independently of
+			// the activity of the client
+			if session.finished().Add(s.resultRetention()).Before(time.Now()) {
+				s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "requestor": session.requestor}).Infof("Deleting session")
 				expired = append(expired, token)
 			}
+		} else if session.lastActive.Add(s.timeout(session)).Before(time.Now()) {
+			s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "requestor": session.requestor}).Infof("Session expired")
+			session.markAlive()
+			session.setStatus(ctx, server.StatusTimeout)
 		}
 		session.Unlock()
 	}
@@ -136,61 +291,274 @@ func (s *memorySessionStore) deleteExpired() {
 	s.Lock()
 	for _, token := range expired {
 		session := s.requestor[token]
-		if session.evtSource != nil {
-			session.evtSource.Close()
-		}
+		session.Lock()
+		session.closeEventSource()
+		s.deactivate(session)
+		session.Unlock()
 		delete(s.client, session.clientToken)
 		delete(s.requestor, token)
+		if session.idempotencyKey != "" {
+			delete(s.idempotent, session.idempotentKey())
+		}
+		if session.correlationID() != "" {
+			delete(s.correlated, session.correlationKey())
+		}
+		if s.conf.Metrics != nil {
+			s.conf.Metrics.SessionDeleted(session.action)
+		}
 	}
 	s.Unlock()
+
+	return expired
 }
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
-	token := newSessionToken()
-	clientToken := newSessionToken()
+// sessionOptions are the parameters of a new session besides its request.
+type sessionOptions struct {
+	requestor      string // see server.SessionOptions
+	idempotencyKey string // see server.SessionOptions
+	prevToken      string // token of the session of which the new session is the follow-up, if any
+}
 
+func (s *Server) newSession(ctx context.Context, action irma.Action, request irma.RequestorRequest, opts sessionOptions) (*session, error) {
+	if opts.requestor == "" {
+		opts.requestor = anonymousRequestor
+	}
+	// Below we set the nonce and context on the session request, which must not affect other
+	// sessions started from the same request object
+	request = copyRequest(request)
+	now := time.Now()
 	ses := &session{
-		action:      action,
-		rrequest:    request,
-		request:     request.SessionRequest(),
-		lastActive:  time.Now(),
-		token:       token,
-		clientToken: clientToken,
-		status:      server.StatusInitialized,
-		prevStatus:  server.StatusInitialized,
-		conf:        s.conf,
-		sessions:    s.sessions,
+		requestor:      opts.requestor,
+		idempotencyKey: opts.idempotencyKey,
+		action:         action,
+		rrequest:       request,
+		request:        request.SessionRequest(),
+		created:        now,
+		lastActive:     now,
+		status:         server.StatusInitialized,
+		prevStatus:     server.StatusInitialized,
+		conf:           s.conf,
+		sessions:       s.sessions,
 		result: &server.SessionResult{
 			LegacySession: request.SessionRequest().Base().Legacy(),
-			Token:         token,
 			Type:          action,
 			Status:        server.StatusInitialized,
+			PrevToken:     opts.prevToken,
+			Label:         request.Base().Label,
+			CorrelationID: request.Base().CorrelationID,
+			Metadata:      request.Base().Metadata,
+			CreatedAt:     &now,
 		},
 	}
 
-	s.conf.Logger.WithFields(logrus.Fields{"session": ses.token}).Debug("New session started")
-	nonce, _ := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
+	bits, err := s.nonceBits(ses.request)
+	if err != nil {
+		return nil, err
+	}
+	nonce, _ := gabi.RandomBigInt(bits)
 	ses.request.Base().Nonce = nonce
-	ses.request.Base().Context = one
-	s.sessions.add(ses)
+	if ses.request.Base().Context == nil {
+		ses.request.Base().Context = s.newContext()
+	}
+	if request.Base().PairingMethod == irma.PairingMethodPin {
+		ses.pairingCode = newPairingCode()
+	}
+
+	// Add the session to the store, generating new tokens in the (unlikely) case they are already in use
+	for i := 0; i < maxTokenAttempts; i++ {
+		ses.token = s.newToken()
+		ses.clientToken = s.newToken()
+		ses.result.Token = ses.token
+		if err = s.sessions.add(ctx, ses); err != errTokenCollision {
+			break
+		}
+		s.conf.Logger.Warn("Generated session token already in use, generating new one")
+	}
+	if err == errTokenCollision {
+		return nil, errors.Errorf("Failed to generate unused session token in %d attempts", maxTokenAttempts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"session": ses.token, "requestor": ses.requestor}).Debug("New session started")
+	if s.conf.Metrics != nil {
+		s.conf.Metrics.SessionCreated(action)
+	}
+	if s.conf.OnSessionCreate != nil {
+		s.conf.OnSessionCreate(ses.token, action, ses.request)
+	}
+
+	return ses, nil
+}
+
+// nonceBits returns the size in bits of the nonce of a session with the specified request: the
+// largest statistical zero-knowledge security parameter of the system parameters of the public
+// keys involved, and at least that of 2048-bit keys. For issuance these are the keys with which
+// the credentials are issued; for disclosure, in which any key of the issuer may be used, the
+// latest key of each issuer. Keys of unsupported length, having no system parameters, are skipped.
+func (s *Server) nonceBits(request irma.SessionRequest) (uint, error) {
+	keys := map[irma.IssuerIdentifier]map[int]struct{}{}
+	addKey := func(issuer irma.IssuerIdentifier, counter int) {
+		if keys[issuer] == nil {
+			keys[issuer] = map[int]struct{}{}
+		}
+		keys[issuer][counter] = struct{}{}
+	}
+
+	if isreq, ok := request.(*irma.IssuanceRequest); ok {
+		for _, cred := range isreq.Credentials {
+			addKey(cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter)
+		}
+	}
+	err := request.Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+		issuer := attr.Type.CredentialTypeIdentifier().IssuerIdentifier()
+		counters, err := s.conf.IrmaConfiguration.PublicKeyIndices(issuer)
+		if err != nil {
+			return err
+		}
+		if len(counters) == 0 {
+			return nil
+		}
+		latest := counters[0]
+		for _, counter := range counters {
+			if counter > latest {
+				latest = counter
+			}
+		}
+		addKey(issuer, latest)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bits := gabi.DefaultSystemParameters[2048].Lstatzk
+	for issuer, counters := range keys {
+		for counter := range counters {
+			pk, err := s.conf.IrmaConfiguration.PublicKey(issuer, counter)
+			if err != nil {
+				return 0, err
+			}
+			if pk == nil || pk.Params == nil {
+				continue
+			}
+			if pk.Params.Lstatzk > bits {
+				bits = pk.Params.Lstatzk
+			}
+		}
+	}
+	return bits, nil
+}
+
+// newContext returns the context for sessions whose request does not specify one: 1, unless
+// RandomSessionContext is enabled.
+func (s *Server) newContext() *big.Int {
+	if !s.conf.RandomSessionContext {
+		return one
+	}
+	for {
+		context, _ := gabi.RandomBigInt(uint(maxContextBits))
+		if context.Sign() > 0 {
+			return context
+		}
+	}
+}
+
+// finished returns when the session finished, or when it was last active if that is unknown
+// (which is the case for sessions stored before this was recorded).
+func (session *session) finished() time.Time {
+	if session.result.FinishedAt == nil {
+		return session.lastActive
+	}
+	return *session.result.FinishedAt
+}
+
+func (session *session) idempotentKey() requestorKey {
+	return requestorKey{session.requestor, session.idempotencyKey}
+}
+
+// correlationID returns the correlation ID that the requestor specified in the session request, if any.
+func (session *session) correlationID() string {
+	return session.rrequest.Base().CorrelationID
+}
+
+func (session *session) correlationKey() requestorKey {
+	return requestorKey{session.requestor, session.correlationID()}
+}
+
+// newPairingCode returns a random 4-digit numeric code.
+func newPairingCode() string {
+	r := make([]byte, 4)
+	_, err := io.ReadFull(rand.Reader, r)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%04d", binary.BigEndian.Uint32(r)%10000)
+}
 
-	return ses
+// newToken returns a new session token, using the configured TokenGenerator if any.
+func (s *Server) newToken() string {
+	if s.conf.TokenGenerator != nil {
+		return s.conf.TokenGenerator()
+	}
+	return newSessionToken(s.conf.SessionTokenChars)
 }
 
-func newSessionToken() string {
-	count := 20
+// newSessionToken returns a random session token consisting of the specified characters,
+// or of sessionChars if chars is empty.
+func newSessionToken(chars string) string {
+	if chars == "" {
+		chars = sessionChars
+	}
 
-	r := make([]byte, count)
-	_, err := rand.Read(r)
+	r := make([]byte, sessionTokenLength)
+	_, err := io.ReadFull(tokenRandReader, r)
 	if err != nil {
 		panic(err)
 	}
 
-	b := make([]byte, count)
+	b := make([]byte, sessionTokenLength)
 	for i := range b {
-		b[i] = sessionChars[r[i]%byte(len(sessionChars))]
+		b[i] = chars[r[i]%byte(len(chars))]
 	}
 	return string(b)
 }
+
+// validateSessionChars checks that session tokens consisting of the specified characters are
+// unguessable, and can be used in URL paths and filenames.
+func validateSessionChars(chars string) error {
+	seen := map[rune]bool{}
+	for _, c := range chars {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return errors.Errorf("session_token_chars may only contain letters, digits and underscores, found %q", c)
+		}
+		if seen[c] {
+			return errors.Errorf("session_token_chars contains %q more than once", c)
+		}
+		seen[c] = true
+	}
+	if len(chars) < minSessionChars {
+		return errors.Errorf("session_token_chars must contain at least %d characters (has %d)", minSessionChars, len(chars))
+	}
+	return nil
+}
+
+// validateRedactedAttributes checks that the patterns of RedactedAttributes are well-formed, so
+// that the values of sensitive attributes are not accidentally left unredacted.
+func validateRedactedAttributes(patterns []string) error {
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, ".")
+		malformed := len(parts) > 4 || (len(parts) < 4 && parts[len(parts)-1] != "*")
+		for i, part := range parts {
+			if part == "" || (strings.Contains(part, "*") && (part != "*" || i != len(parts)-1)) {
+				malformed = true
+			}
+		}
+		if malformed {
+			return errors.Errorf("redacted attribute '%s' must be an attribute type, or a pattern ending in .*", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,923 @@
+package servercore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer() *Server {
+	irmaconf, err := irma.NewConfigurationReadOnly(filepath.Join("..", "..", "testdata", "irma_configuration"))
+	if err == nil {
+		err = irmaconf.ParseFolder()
+	}
+	if err != nil {
+		panic(err)
+	}
+	conf := &server.Configuration{
+		Logger:            logrus.New(),
+		IrmaConfiguration: irmaconf,
+		MaxDisjunctions:   defaultMaxDisjunctions,
+		MaxAttributes:     defaultMaxAttributes,
+	}
+	return &Server{
+		conf:     conf,
+		sessions: newMemorySessionStore(conf),
+	}
+}
+
+func newTestRequest() irma.RequestorRequest {
+	return &irma.ServiceProviderRequest{
+		Request: irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+}
+
+// expire moves the last activity of the session, and its finishing time if it is finished, so far
+// into the past that it is deleted or timed out when expired sessions are next deleted.
+func expire(ses *session) {
+	past := time.Now().Add(-2 * maxSessionLifetime)
+	ses.lastActive = past
+	if ses.result.FinishedAt != nil {
+		ses.result.FinishedAt = &past
+	}
+}
+
+// tokenRandomness returns a reader from which each consecutive token consists of the
+// specified byte, i.e., the character of sessionChars at that index.
+func tokenRandomness(chars ...byte) io.Reader {
+	var bts []byte
+	for _, c := range chars {
+		bts = append(bts, bytes.Repeat([]byte{c}, 20)...)
+	}
+	return bytes.NewReader(bts)
+}
+
+func TestSessionTokenCollision(t *testing.T) {
+	defer func() { tokenRandReader = rand.Reader }()
+	s := newTestServer()
+
+	tokenRandReader = tokenRandomness(0, 1, 0, 2, 3, 4)
+	first, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "aaaaaaaaaaaaaaaaaaaa", first.token)
+	require.Equal(t, "bbbbbbbbbbbbbbbbbbbb", first.clientToken)
+
+	// The first attempt yields the requestor token of the first session, so new tokens must be generated
+	second, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "dddddddddddddddddddd", second.token)
+	require.Equal(t, "eeeeeeeeeeeeeeeeeeee", second.clientToken)
+	require.Equal(t, second.token, second.result.Token)
+
+	require.Equal(t, 2, s.sessions.count())
+	require.Equal(t, first, s.sessions.get(context.Background(), first.token))
+	require.Equal(t, second, s.sessions.clientGet(context.Background(), second.clientToken))
+}
+
+func TestSessionTokenCollisionGiveUp(t *testing.T) {
+	defer func() { tokenRandReader = rand.Reader }()
+	s := newTestServer()
+
+	tokenRandReader = tokenRandomness(0, 1)
+	_, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+
+	chars := make([]byte, 2*maxTokenAttempts)
+	tokenRandReader = tokenRandomness(chars...) // all tokens equal to the first session's token
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.Error(t, err)
+	require.Equal(t, 1, s.sessions.count())
+}
+
+func TestTokenGenerator(t *testing.T) {
+	s := newTestServer()
+	i := 0
+	s.conf.TokenGenerator = func() string {
+		i++
+		return fmt.Sprintf("token%d", i)
+	}
+
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "token1", ses.token)
+	require.Equal(t, "token2", ses.clientToken)
+	require.Equal(t, "token1", ses.result.Token)
+
+	// Predictable tokens are refused in production mode
+	s.conf.Production = true
+	require.Error(t, s.verifyConfiguration(s.conf))
+}
+
+func TestSessionPairing(t *testing.T) {
+	s := newTestServer()
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.PairingMethod = irma.PairingMethodPin
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	require.Len(t, ses.pairingCode, 4)
+	require.Equal(t, ses.pairingCode, s.GetPairingCode(ses.token))
+
+	// Pairing is only possible after the client has retrieved the session request
+	_, rerr := ses.handlePostPairingCode(context.Background(), &irma.PairingCodeMessage{PairingCode: ses.pairingCode})
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorUnexpectedRequest.Type), rerr.ErrorName)
+
+	ses.setStatus(context.Background(), server.StatusPairing)
+	_, rerr = ses.handlePostPairingCode(context.Background(), &irma.PairingCodeMessage{PairingCode: "wrong"})
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorPairingCodeWrong.Type), rerr.ErrorName)
+	require.Equal(t, server.StatusPairing, ses.status)
+
+	status, rerr := ses.handlePostPairingCode(context.Background(), &irma.PairingCodeMessage{PairingCode: ses.pairingCode})
+	require.Nil(t, rerr)
+	require.Equal(t, server.StatusConnected, status)
+}
+
+func TestSessionPairingFailed(t *testing.T) {
+	s := newTestServer()
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.PairingMethod = irma.PairingMethodPin
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+
+	ses.setStatus(context.Background(), server.StatusPairing)
+	var rerr *irma.RemoteError
+	for i := 0; i < maxPairingAttempts; i++ {
+		_, rerr = ses.handlePostPairingCode(context.Background(), &irma.PairingCodeMessage{PairingCode: "wrong"})
+		require.NotNil(t, rerr)
+	}
+	require.Equal(t, string(server.ErrorPairingFailed.Type), rerr.ErrorName)
+	require.Equal(t, server.StatusCancelled, ses.status)
+}
+
+func TestDisclosureAttempts(t *testing.T) {
+	s := newTestServer()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+
+	s.conf.DisableSchemesUpdate = true
+	require.NoError(t, s.verifyConfiguration(s.conf))
+	require.Equal(t, 3, s.conf.MaxDisclosureAttempts)
+	ses.status = server.StatusConnected
+
+	for i := 2; i > 0; i-- {
+		ses.result.ProofStatus = irma.ProofStatusMissingAttributes
+		ses.result.Disclosed = [][]*irma.DisclosedAttribute{{}}
+		rerr := ses.rejectProofs(context.Background())
+		require.NotNil(t, rerr)
+		require.Equal(t, string(server.ErrorProofsRejected.Type), rerr.ErrorName)
+		require.Contains(t, rerr.Message, fmt.Sprintf("%d attempts left", i))
+		require.Nil(t, ses.result.Disclosed)
+		require.Empty(t, ses.result.ProofStatus)
+	}
+
+	require.Equal(t, server.StatusConnected, ses.status)
+
+	// Rejected proofs in the last attempt fail the session
+	ses.result.ProofStatus = irma.ProofStatusExpired
+	rerr := ses.rejectProofs(context.Background())
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorTooManyAttempts.Type), rerr.ErrorName)
+	require.Equal(t, server.StatusCancelled, ses.status)
+	require.Equal(t, rerr, ses.result.Err)
+
+	// Invalid proofs fail the session immediately
+	ses, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	ses.status = server.StatusConnected
+	ses.result.ProofStatus = irma.ProofStatusInvalid
+	rerr = ses.rejectProofs(context.Background())
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorInvalidProofs.Type), rerr.ErrorName)
+	require.Equal(t, server.StatusCancelled, ses.status)
+	require.Equal(t, 0, ses.disclosureAttempts)
+}
+
+func TestUnrequestedAttributes(t *testing.T) {
+	s := newTestServer()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	ses.status = server.StatusConnected
+
+	email := "test@example.com"
+	ses.result.ProofStatus = irma.ProofStatusValid
+	ses.result.Disclosed = [][]*irma.DisclosedAttribute{{{
+		Identifier: irma.NewAttributeTypeIdentifier("test.test.email.email"),
+		RawValue:   &email,
+		Status:     irma.AttributeProofStatusPresent,
+	}}}
+	require.Nil(t, ses.checkUnrequested(context.Background()))
+	require.Equal(t, server.StatusConnected, ses.status)
+
+	// An extraneous attribute fails the session
+	ses.result.Disclosed = append(ses.result.Disclosed, []*irma.DisclosedAttribute{{
+		Identifier: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+		RawValue:   &email,
+		Status:     irma.AttributeProofStatusExtra,
+	}})
+	rerr := ses.checkUnrequested(context.Background())
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorUnrequested.Type), rerr.ErrorName)
+	require.Equal(t, "irma-demo.MijnOverheid.root.BSN", rerr.Message)
+	require.Equal(t, server.StatusCancelled, ses.status)
+	require.Nil(t, ses.result.Disclosed)
+}
+
+func TestStatusEvents(t *testing.T) {
+	s := newTestServer()
+	s.conf.EnableSSE = true
+	s.conf.MaxDisclosureAttempts = 1
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, server.StatusInitialized, ses.status)
+
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = s.SubscribeServerSentEvents(w, r, ses.token, true)
+	}))
+	defer serv.Close()
+	res, err := (&http.Client{Timeout: 5 * time.Second}).Get(serv.URL)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+
+	// The open event signals that we are subscribed; then the client retrieves the session request
+	// and posts its response, which the server rejects (an empty disclosure misses the requested
+	// attribute, and with a single attempt allowed that cancels the session). A valid response
+	// finishing the session with DONE is tested in TestRequestorStatusEvents in sessiontest.
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() && scanner.Text() != "event: open" {
+	}
+	go func() {
+		headers := http.Header{}
+		headers.Set(irma.MinVersionHeader, "2.5")
+		headers.Set(irma.MaxVersionHeader, "2.5")
+		status, _, _ := s.HandleProtocolMessage("session/"+ses.clientToken, http.MethodGet, headers, nil)
+		if status != http.StatusOK {
+			t.Errorf("GET of session request failed with status %d", status)
+			return
+		}
+		ses.Lock()
+		defer ses.Unlock()
+		_, _ = ses.handlePostDisclosure(context.Background(), &irma.Disclosure{})
+	}()
+
+	var statuses []string
+	for len(statuses) < 3 && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") && line != "data: " {
+			statuses = append(statuses, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	require.Equal(t, []string{`"CONNECTED"`, `"COMMUNICATING"`, `"CANCELLED"`}, statuses)
+}
+
+func TestStatusEventsKeepalive(t *testing.T) {
+	s := newTestServer()
+	s.conf.EnableSSE = true
+	s.conf.SSEKeepaliveInterval = 1
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = s.SubscribeServerSentEvents(w, r, ses.token, true)
+	}))
+	defer serv.Close()
+	res, err := (&http.Client{Timeout: 5 * time.Second}).Get(serv.URL)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+
+	// Pings arrive while the session is idle
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() && scanner.Text() != "event: ping" {
+	}
+	require.Equal(t, "event: ping", scanner.Text())
+
+	// A final status is sent to the listeners, after which the event source is closed
+	ses.Lock()
+	ses.setStatus(context.Background(), server.StatusDone)
+	require.Nil(t, ses.evtSource)
+	require.Nil(t, ses.evtStop)
+	ses.Unlock()
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	require.Contains(t, lines, `data: "DONE"`)
+}
+
+func TestSessionReturnURL(t *testing.T) {
+	s := newTestServer()
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.ReturnURL = "javascript:alert(1)"
+	require.Error(t, request.Validate())
+
+	request.ReturnURL = "https://example.com/done"
+	require.NoError(t, request.Validate())
+	require.NoError(t, s.validateReturnURL(request.ReturnURL))
+	s.conf.AllowedReturnURLs = []string{"https://example.org/"}
+	require.Error(t, s.validateReturnURL(request.ReturnURL))
+	s.conf.AllowedReturnURLs = append(s.conf.AllowedReturnURLs, "https://example.com/")
+	require.NoError(t, s.validateReturnURL(request.ReturnURL))
+
+	// Allowed URLs are matched on their scheme, host and path, not as string prefixes
+	s.conf.AllowedReturnURLs = []string{"https://example.com", "https://example.org/app"}
+	for _, u := range []string{
+		"https://example.com.evil.org/done",
+		"https://example.com@evil.org/done",
+		"https://user@example.com/done",
+		"http://example.com/done",
+		"https://example.org/application",
+		"https://example.org/app/../other",
+		"https://example.org/",
+	} {
+		require.Error(t, s.validateReturnURL(u), u)
+	}
+	for _, u := range []string{"https://example.com", "https://EXAMPLE.com/done", "https://example.org/app", "https://example.org/app/done?x=1"} {
+		require.NoError(t, s.validateReturnURL(u), u)
+	}
+	s.conf.AllowedReturnURLs = []string{"https://example.com/"}
+
+	// The return URL is only included in the status once the session is done
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	status, _ := ses.handleGetFrontendStatus()
+	require.Equal(t, server.StatusInitialized, status.Status)
+	require.Empty(t, status.ReturnURL)
+	ses.setStatus(context.Background(), server.StatusDone)
+	status, _ = ses.handleGetFrontendStatus()
+	require.Equal(t, "https://example.com/done", status.ReturnURL)
+}
+
+func TestIdempotentSession(t *testing.T) {
+	s := newTestServer()
+
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{requestor: "requestor", idempotencyKey: "key"})
+	require.NoError(t, err)
+	require.Equal(t, ses, s.sessions.idempotentGet(context.Background(), "requestor", "key"))
+	qr, token, err := s.StartSessionContext(context.Background(), newTestRequest(), &server.SessionOptions{Requestor: "requestor", IdempotencyKey: "key"})
+	require.NoError(t, err)
+	require.Equal(t, ses.token, token)
+	require.Equal(t, "session/"+ses.clientToken, qr.URL)
+
+	// A concurrently started session with the same key is refused by the store
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{requestor: "requestor", idempotencyKey: "key"})
+	require.Equal(t, errIdempotencyKeyInUse, err)
+	require.Equal(t, 1, s.sessions.count())
+
+	// Keys are scoped per requestor
+	require.Nil(t, s.sessions.idempotentGet(context.Background(), "other", "key"))
+	other, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{requestor: "other", idempotencyKey: "key"})
+	require.NoError(t, err)
+	require.NotEqual(t, ses.token, other.token)
+
+	// Keys are forgotten when their session is deleted
+	ses.setStatus(context.Background(), server.StatusDone)
+	expire(ses)
+	s.sessions.deleteExpired(context.Background())
+	require.Nil(t, s.sessions.idempotentGet(context.Background(), "requestor", "key"))
+}
+
+func TestOnSessionCreate(t *testing.T) {
+	s := newTestServer()
+	var tokens []string
+	s.conf.OnSessionCreate = func(token string, action irma.Action, request irma.SessionRequest) {
+		require.Equal(t, irma.ActionDisclosing, action)
+		require.NotNil(t, request.Base().Nonce)
+		tokens = append(tokens, token)
+	}
+
+	opts := &server.SessionOptions{Requestor: "requestor", IdempotencyKey: "key"}
+	_, token, err := s.StartSessionContext(context.Background(), newTestRequest(), opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{token}, tokens)
+
+	// Not called when no session is created
+	_, _, err = s.StartSessionContext(context.Background(), newTestRequest(), opts)
+	require.NoError(t, err)
+	_, _, err = s.StartSession(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.foo.bar")))
+	require.Error(t, err)
+	require.Equal(t, []string{token}, tokens)
+}
+
+func TestMetadata(t *testing.T) {
+	s := newTestServer()
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.Metadata = map[string]string{"tenant": "example", "locale": "nl_NL"}
+
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{requestor: "requestor"})
+	require.NoError(t, err)
+	require.Equal(t, "example", ses.result.Metadata["tenant"])
+
+	// The metadata is not sent to the IRMA app
+	bts, err := json.Marshal(ses.request)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "example")
+
+	// The metadata is included in the result of cancelled sessions
+	ses.handleDelete(context.Background())
+	require.Equal(t, map[string]string{"tenant": "example", "locale": "nl_NL"}, ses.result.Metadata)
+}
+
+func TestCorrelationID(t *testing.T) {
+	s := newTestServer()
+	request := func() irma.RequestorRequest {
+		r := newTestRequest().(*irma.ServiceProviderRequest)
+		r.CorrelationID = "order-1"
+		return r
+	}
+
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request(), sessionOptions{requestor: "requestor"})
+	require.NoError(t, err)
+	require.Equal(t, "order-1", ses.result.CorrelationID)
+
+	// A second session of the same requestor with the same correlation ID is refused
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, request(), sessionOptions{requestor: "requestor"})
+	require.Error(t, err)
+	rerr, ok := err.(*irma.RemoteError)
+	require.True(t, ok)
+	require.Equal(t, string(server.ErrorDuplicateCorrelationID.Type), rerr.ErrorName)
+	require.Equal(t, 1, s.sessions.count())
+
+	// Correlation IDs are scoped per requestor
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, request(), sessionOptions{requestor: "other"})
+	require.NoError(t, err)
+
+	// The correlation ID is included in the result of cancelled sessions
+	ses.handleDelete(context.Background())
+	require.Equal(t, "order-1", ses.result.CorrelationID)
+
+	// Correlation IDs may be reused once their session is deleted
+	expire(ses)
+	s.sessions.deleteExpired(context.Background())
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, request(), sessionOptions{requestor: "requestor"})
+	require.NoError(t, err)
+}
+
+func TestSessionResultTimes(t *testing.T) {
+	s := newTestServer()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, ses.created, *ses.result.CreatedAt)
+	require.Nil(t, ses.result.ClientConnectedAt)
+	require.Nil(t, ses.result.FinishedAt)
+
+	ses.setStatus(context.Background(), server.StatusConnected)
+	connected := ses.result.ClientConnectedAt
+	require.NotNil(t, connected)
+	require.False(t, connected.Before(*ses.result.CreatedAt))
+	require.Nil(t, ses.result.FinishedAt)
+
+	// Cancelling the session replaces the result, keeping the earlier times
+	ses.handleDelete(context.Background())
+	require.Equal(t, ses.created, *ses.result.CreatedAt)
+	require.Equal(t, connected, ses.result.ClientConnectedAt)
+	require.NotNil(t, ses.result.FinishedAt)
+	require.False(t, ses.result.FinishedAt.Before(*connected))
+}
+
+func TestPublicRequest(t *testing.T) {
+	s := newTestServer()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	ses.request.Base().ProtocolVersion = &irma.ProtocolVersion{Major: 2, Minor: 8}
+	require.NotNil(t, ses.request.Base().Nonce)
+
+	request, rerr := ses.handleGetPublicRequest()
+	require.Nil(t, rerr)
+	disclosure := request.(*irma.DisclosureRequest)
+	require.Equal(t, "irma-demo.RU.studentCard.studentID", disclosure.Disclose[0][0][0].Type.String())
+	require.Nil(t, disclosure.Nonce)
+	require.Nil(t, disclosure.Context)
+	require.Nil(t, disclosure.ProtocolVersion)
+
+	// Fetching the request neither starts the session nor alters the request of the session
+	require.Equal(t, server.StatusInitialized, ses.status)
+	require.NotNil(t, ses.request.Base().Nonce)
+	require.NotNil(t, ses.request.Base().ProtocolVersion)
+}
+
+func TestResultRetention(t *testing.T) {
+	s := newTestServer()
+	s.conf.ResultRetention = 3600
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	ses.setStatus(context.Background(), server.StatusDone)
+
+	// The result outlives the interaction with the client
+	ses.lastActive = time.Now().Add(-2 * maxSessionLifetime)
+	s.sessions.deleteExpired(context.Background())
+	require.NotNil(t, s.sessions.get(context.Background(), ses.token))
+
+	finished := time.Now().Add(-2 * time.Hour)
+	ses.result.FinishedAt = &finished
+	s.sessions.deleteExpired(context.Background())
+	require.Nil(t, s.sessions.get(context.Background(), ses.token))
+}
+
+func TestMaxSessions(t *testing.T) {
+	s := newTestServer()
+	s.conf.MaxSessions = 1
+	s.conf.ResultRetention = 3600
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.IsType(t, &irma.RemoteError{}, err)
+	require.Equal(t, string(server.ErrorTooManySessions.Type), err.(*irma.RemoteError).ErrorName)
+
+	// Finished sessions whose result is retained don't count towards the limit
+	ses.setStatus(context.Background(), server.StatusDone)
+	ses, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 2, s.sessions.count())
+
+	// Neither do sessions that timed out
+	ses.lastActive = time.Now().Add(-2 * maxSessionLifetime)
+	s.sessions.deleteExpired(context.Background())
+	require.Equal(t, server.StatusTimeout, ses.status)
+	_, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+}
+
+func TestScanAndInteractionTimeout(t *testing.T) {
+	s := newTestServer()
+	s.conf.ScanTimeout = 3600
+	s.conf.InteractionTimeout = 60
+
+	// While waiting for the client to connect, the scan timeout applies
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	ses.lastActive = time.Now().Add(-2 * maxSessionLifetime)
+	s.sessions.deleteExpired(context.Background())
+	require.Equal(t, server.StatusInitialized, ses.status)
+
+	// Once the client has connected, the interaction timeout applies
+	for _, status := range []server.Status{server.StatusConnected, server.StatusCommunicating} {
+		ses, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+		require.NoError(t, err)
+		ses.setStatus(context.Background(), status)
+		ses.lastActive = time.Now().Add(-30 * time.Second)
+		s.sessions.deleteExpired(context.Background())
+		require.Equal(t, status, ses.status)
+
+		ses.lastActive = time.Now().Add(-2 * time.Minute)
+		s.sessions.deleteExpired(context.Background())
+		require.Equal(t, server.StatusTimeout, ses.status)
+	}
+
+	// The timeout of the session request takes precedence over the scan timeout
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.ClientTimeout = 10
+	ses, err = s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	ses.lastActive = time.Now().Add(-time.Minute)
+	s.sessions.deleteExpired(context.Background())
+	require.Equal(t, server.StatusTimeout, ses.status)
+}
+
+// TestConcurrentStatusUpdates races the expiry of a session against a requestor cancelling it and
+// fetching its result, which the race detector (go test -race) flags if any of these accesses the
+// session status or result without holding the session lock.
+func TestConcurrentStatusUpdates(t *testing.T) {
+	s := newTestServer()
+	for i := 0; i < 10; i++ {
+		ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+		require.NoError(t, err)
+		ses.Lock()
+		expire(ses)
+		ses.Unlock()
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.sessions.deleteExpired(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			_ = s.CancelSession(ses.token)
+		}()
+		go func() {
+			defer wg.Done()
+			if result := s.GetSessionResult(ses.token); result != nil {
+				_ = result.Status
+			}
+		}()
+		wg.Wait()
+
+		// Whichever came first finished the session, the other left it alone
+		ses.Lock()
+		require.Contains(t, []server.Status{server.StatusTimeout, server.StatusCancelled}, ses.status)
+		require.Equal(t, ses.status, ses.result.Status)
+		require.NotNil(t, ses.result.FinishedAt)
+		ses.Unlock()
+	}
+}
+
+func TestWaitStatus(t *testing.T) {
+	s := newTestServer()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+
+	// The status differs from the specified one, so this returns immediately
+	status, err := s.WaitStatus(ses.token, server.StatusConnected, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusInitialized, status)
+
+	// Without status updates, this returns after the timeout
+	start := time.Now()
+	status, err = s.WaitStatus(ses.token, server.StatusInitialized, 100*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusInitialized, status)
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// A status update wakes the waiter up
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ses.Lock()
+		defer ses.Unlock()
+		ses.setStatus(context.Background(), server.StatusConnected)
+	}()
+	start = time.Now()
+	status, err = s.WaitStatus(ses.token, server.StatusInitialized, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusConnected, status)
+	require.True(t, time.Since(start) < time.Minute)
+
+	// Cancelling the context wakes the waiter up as well
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	status, err = s.WaitStatusContext(ctx, ses.token, server.StatusConnected, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusConnected, status)
+	require.True(t, time.Since(start) < time.Minute)
+
+	_, err = s.WaitStatus("unknown", server.StatusInitialized, time.Minute)
+	require.Error(t, err)
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	s := newTestServer()
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := irma.NewDisclosureRequest(id, id, id) // 3 disjunctions of one attribute each
+	require.NoError(t, s.validateRequestSize(request))
+
+	s.conf.MaxDisjunctions = 2
+	err := s.validateRequestSize(request)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorRequestTooLarge.Type), err.(*irma.RemoteError).ErrorName)
+
+	s.conf.MaxDisjunctions = 3
+	s.conf.MaxAttributes = 2
+	require.Error(t, s.validateRequestSize(request))
+	s.conf.MaxAttributes = 3
+	require.NoError(t, s.validateRequestSize(request))
+
+	// Without configured bounds the defaults apply to session requests
+	s.conf.MaxDisjunctions, s.conf.MaxAttributes = 0, 0
+	s.conf.DisableSchemesUpdate = true
+	require.NoError(t, s.verifyConfiguration(s.conf))
+	ids := make([]irma.AttributeTypeIdentifier, defaultMaxDisjunctions+1)
+	for i := range ids {
+		ids[i] = id
+	}
+	_, err = s.ValidateRequest(irma.NewDisclosureRequest(ids...))
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorRequestTooLarge.Type), err.(*irma.RemoteError).ErrorName)
+	_, err = s.ValidateRequest(irma.NewDisclosureRequest(ids[1:]...))
+	require.NoError(t, err)
+}
+
+func TestSignatureMessageLimits(t *testing.T) {
+	s := newTestServer()
+	require.NoError(t, s.validateSignatureMessage("I owe you\t€10\n"))
+	require.NoError(t, s.validateSignatureMessage("\x00\xff"))
+
+	s.conf.MaxSignatureMessageBytes = 10
+	err := s.validateSignatureMessage("I owe you €10")
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorRequestTooLarge.Type), err.(*irma.RemoteError).ErrorName)
+
+	s.conf.MaxSignatureMessageBytes = 0
+	s.conf.SignatureMessageText = true
+	require.NoError(t, s.validateSignatureMessage("I owe you\t€10\r\n"))
+	require.Error(t, s.validateSignatureMessage("\xff"))
+	require.Error(t, s.validateSignatureMessage("I owe you\x00"))
+}
+
+func TestSessionContext(t *testing.T) {
+	s := newTestServer()
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(1), ses.request.Base().Context)
+
+	s.conf.RandomSessionContext = true
+	ses, err = s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, ses.request.Base().Context.Sign())
+	require.True(t, ses.request.Base().Context.BitLen() <= maxContextBits)
+
+	// Sessions started from the same request object each get their own nonce and context, and the
+	// request object itself is left untouched
+	request := newTestRequest()
+	ses1, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	ses2, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, ses1.request.Base().Context, ses2.request.Base().Context)
+	require.NotEqual(t, ses1.request.Base().Nonce, ses2.request.Base().Nonce)
+	require.Nil(t, request.SessionRequest().Base().Context)
+	require.Nil(t, request.SessionRequest().Base().Nonce)
+
+	// A context specified in the request is kept
+	request = newTestRequest()
+	request.SessionRequest().Base().Context = big.NewInt(42)
+	ses, err = s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(42), ses.request.Base().Context)
+
+	require.NoError(t, validateContext(nil))
+	require.NoError(t, validateContext(big.NewInt(42)))
+	require.Error(t, validateContext(big.NewInt(0)))
+	require.Error(t, validateContext(big.NewInt(-1)))
+	require.Error(t, validateContext(new(big.Int).Lsh(big.NewInt(1), uint(maxContextBits))))
+}
+
+func TestNonceBits(t *testing.T) {
+	s := newTestServer()
+	bits, err := s.nonceBits(newTestRequest().SessionRequest())
+	require.NoError(t, err)
+	require.Equal(t, gabi.DefaultSystemParameters[2048].Lstatzk, bits)
+
+	// The default system parameters of all supported key lengths have the same Lstatzk, so give
+	// the 4096-bit key of the test.test issuer a larger one
+	issuer := irma.NewIssuerIdentifier("test.test")
+	pk, err := s.conf.IrmaConfiguration.PublicKey(issuer, 2)
+	require.NoError(t, err)
+	require.Equal(t, 4096, pk.N.BitLen())
+	params := *pk.Params
+	params.Lstatzk += 32
+	pk.Params = &params
+
+	// Disclosure only involves the latest key of the issuer, which is not that key
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.email.email"))
+	bits, err = s.nonceBits(request)
+	require.NoError(t, err)
+	require.Equal(t, gabi.DefaultSystemParameters[2048].Lstatzk, bits)
+
+	// Issuance involves the key with which the credential is issued
+	isreq := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.email"),
+		KeyCounter:       2,
+		Attributes:       map[string]string{"email": "test@example.com"},
+	}})
+	bits, err = s.nonceBits(isreq)
+	require.NoError(t, err)
+	require.Equal(t, params.Lstatzk, bits)
+
+	ses, err := s.newSession(context.Background(), irma.ActionIssuing, &irma.IdentityProviderRequest{Request: isreq}, sessionOptions{})
+	require.NoError(t, err)
+	require.True(t, ses.request.Base().Nonce.BitLen() <= int(bits))
+
+	// Keys without system parameters are skipped
+	latest, err := s.conf.IrmaConfiguration.PublicKey(issuer, 3)
+	require.NoError(t, err)
+	latest.Params = nil
+	bits, err = s.nonceBits(request)
+	require.NoError(t, err)
+	require.Equal(t, gabi.DefaultSystemParameters[2048].Lstatzk, bits)
+}
+
+func TestCancelSession(t *testing.T) {
+	s := newTestServer()
+	request := newTestRequest().(*irma.ServiceProviderRequest)
+	request.Label = "reference"
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, request, sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "reference", s.GetSessionResult(ses.token).Label)
+
+	require.NoError(t, s.CancelSession(ses.token))
+	require.Equal(t, server.StatusCancelled, ses.status)
+	require.Equal(t, server.StatusCancelled, s.GetSessionResult(ses.token).Status)
+	require.Equal(t, "reference", s.GetSessionResult(ses.token).Label)
+
+	// Finished and unknown sessions cannot be cancelled
+	require.Error(t, s.CancelSession(ses.token))
+	require.Error(t, s.CancelSession("unknown"))
+}
+
+func TestDefaultCredentialValidity(t *testing.T) {
+	s := newTestServer()
+	day := 24 * time.Hour
+	require.WithinDuration(t, time.Now().AddDate(0, 6, 0), s.defaultCredentialValidity(), time.Minute)
+
+	s.conf.DefaultCredentialValidity = 7
+	require.WithinDuration(t, time.Now().Add(7*day), s.defaultCredentialValidity(), time.Minute)
+
+	// The default is limited by the maximum validity
+	s.conf.DefaultCredentialValidity = 0
+	s.conf.MaxCredentialValidity = 30
+	require.WithinDuration(t, time.Now().Add(30*day), s.defaultCredentialValidity(), time.Minute)
+}
+
+func TestSessionTokenChars(t *testing.T) {
+	defer func() { tokenRandReader = rand.Reader }()
+	s := newTestServer()
+	s.conf.SessionTokenChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	require.NoError(t, validateSessionChars(s.conf.SessionTokenChars))
+
+	tokenRandReader = tokenRandomness(26, 36+27) // indices wrap around the alphabet
+	ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "00000000000000000000", ses.token)
+	require.Equal(t, "11111111111111111111", ses.clientToken)
+
+	require.Error(t, validateSessionChars("0123456789abcdef"))                      // too few characters
+	require.Error(t, validateSessionChars("abcdefghijklmnopqrstuvwxyz0123456789a")) // duplicate
+	require.Error(t, validateSessionChars("abcdefghijklmnopqrstuvwxyz0123456789-")) // not allowed in URLs
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newTestServer()
+	var buf bytes.Buffer
+	auditLogger := logrus.New()
+	auditLogger.Out = &buf
+	auditLogger.Formatter = &logrus.JSONFormatter{}
+	s.conf.AuditLogger = auditLogger
+
+	finish := func() map[string]interface{} {
+		buf.Reset()
+		ses, err := s.newSession(context.Background(), irma.ActionDisclosing, newTestRequest(), sessionOptions{requestor: "requestor"})
+		require.NoError(t, err)
+		value := "456"
+		ses.result.Disclosed = [][]*irma.DisclosedAttribute{{{
+			Identifier: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			RawValue:   &value,
+		}}}
+		ses.setStatus(context.Background(), server.StatusConnected)
+		require.Zero(t, buf.Len()) // only finished sessions are logged
+		ses.setStatus(context.Background(), server.StatusDone)
+		ses.setStatus(context.Background(), server.StatusTimeout)
+		require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		require.Equal(t, ses.token, entry["session"])
+		return entry
+	}
+
+	entry := finish()
+	require.Equal(t, "requestor", entry["requestor"])
+	require.Equal(t, "disclosing", entry["action"])
+	require.Equal(t, "DONE", entry["status"])
+	require.Equal(t, []interface{}{"irma-demo.RU.studentCard.studentID"}, entry["disclosed"])
+	require.NotContains(t, entry, "values")
+
+	s.conf.AuditIncludeValues = true
+	entry = finish()
+	require.Equal(t, map[string]interface{}{"irma-demo.RU.studentCard.studentID": "456"}, entry["values"])
+
+	s.conf.RedactedAttributes = []string{"irma-demo.RU.*"}
+	entry = finish()
+	require.Equal(t, map[string]interface{}{"irma-demo.RU.studentCard.studentID": server.RedactedValue}, entry["values"])
+}
+
+func TestRedactedAttributes(t *testing.T) {
+	require.NoError(t, validateRedactedAttributes([]string{"*", "pbdf.*", "pbdf.gemeente.*", "pbdf.gemeente.personalData.*", "pbdf.gemeente.personalData.bsn"}))
+	require.Error(t, validateRedactedAttributes([]string{"pbdf.gemeente.personalData"}))
+	require.Error(t, validateRedactedAttributes([]string{"pbdf.gemeente.personalData.b*"}))
+	require.Error(t, validateRedactedAttributes([]string{"pbdf.*.personalData.bsn"}))
+	require.Error(t, validateRedactedAttributes([]string{"pbdf.gemeente.personalData.bsn.*"}))
+
+	request := &irma.IdentityProviderRequest{Request: irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		Attributes:       map[string]string{"BSN": "123456789"},
+	}})}
+	conf := &server.Configuration{RedactedAttributes: []string{"irma-demo.MijnOverheid.root.BSN"}}
+	purged := purgeRequest(request, conf.Redacts).(*irma.IdentityProviderRequest)
+	require.Empty(t, purged.Request.Credentials[0].Attributes)
+	require.Equal(t, "123456789", request.Request.Credentials[0].Attributes["BSN"])
+	conf.RedactedAttributes = nil
+	purged = purgeRequest(request, conf.Redacts).(*irma.IdentityProviderRequest)
+	require.Equal(t, "123456789", purged.Request.Credentials[0].Attributes["BSN"])
+}
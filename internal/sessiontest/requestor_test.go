@@ -1,14 +1,18 @@
 package sessiontest
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strings"
 
 	"testing"
 
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
@@ -102,6 +106,23 @@ func TestRequestorInvalidRequest(t *testing.T) {
 	require.Error(t, err)
 }
 
+// Check that session requests can be validated without starting a session
+func TestRequestorValidateRequest(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	rrequest, err := irmaServer.ValidateRequest(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	))
+	require.NoError(t, err)
+	require.Equal(t, irma.ActionDisclosing, rrequest.SessionRequest().Action())
+
+	_, err = irmaServer.ValidateRequest(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.foo.bar"),
+	))
+	require.Error(t, err)
+	require.Equal(t, 0, irmaServer.SessionCount())
+}
+
 func TestRequestorDoubleGET(t *testing.T) {
 	StartIrmaServer(t, false)
 	defer StopIrmaServer()
@@ -119,6 +140,89 @@ func TestRequestorDoubleGET(t *testing.T) {
 	require.NoError(t, transport.Get("", &o))
 }
 
+func TestRequestorBatchStatus(t *testing.T) {
+	StartRequestorServer(IrmaServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	var pkg server.SessionPackage
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, transport.Post("session", &pkg, request))
+
+	var statuses map[string]server.Status
+	require.NoError(t, transport.Post("session/status", &statuses, []string{pkg.Token, "unknown"}))
+	require.Equal(t, map[string]server.Status{
+		pkg.Token: server.StatusInitialized,
+		"unknown": server.StatusUnknown,
+	}, statuses)
+}
+
+// Check that server sent event listeners see every status transition of a session, including
+// COMMUNICATING which polling requestors cannot observe
+func TestRequestorStatusEvents(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	IrmaServerConfiguration.EnableSSE = true
+	defer func() { IrmaServerConfiguration.EnableSSE = false }()
+	StartRequestorServer(IrmaServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	var pkg server.SessionPackage
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, transport.Post("session", &pkg, request))
+	var status server.Status
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/status", &status))
+	require.Equal(t, server.StatusInitialized, status)
+
+	res, err := http.Get("http://localhost:48682/session/" + pkg.Token + "/statusevents")
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() && scanner.Text() != "event: open" {
+	}
+
+	// Perform the session, after which the event source is closed as the session has finished
+	clientChan := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, ""})
+	if result := <-clientChan; result != nil {
+		require.NoError(t, result.Err)
+	}
+	var statuses []string
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") && line != "data: " {
+			statuses = append(statuses, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	require.Equal(t, []string{`"CONNECTED"`, `"COMMUNICATING"`, `"DONE"`}, statuses)
+}
+
+func TestRequestorFilter(t *testing.T) {
+	IrmaServerConfiguration.RequestFilter = func(requestor string, request irma.RequestorRequest) error {
+		if request.SessionRequest().Action() == irma.ActionSigning {
+			return errors.New("signing not allowed")
+		}
+		return nil
+	}
+	defer func() { IrmaServerConfiguration.RequestFilter = nil }()
+	StartRequestorServer(IrmaServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	var pkg server.SessionPackage
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	require.NoError(t, transport.Post("session", &pkg, irma.NewDisclosureRequest(id)))
+
+	err := transport.Post("session", &pkg, irma.NewSignatureRequest("message", id))
+	require.Error(t, err)
+	serr, ok := err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, string(server.ErrorRequestRejected.Type), serr.RemoteError.ErrorName)
+	require.Equal(t, "signing not allowed", serr.RemoteError.Message)
+}
+
 func TestRequestorSignatureSession(t *testing.T) {
 	client, _ := parseStorage(t)
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
@@ -145,6 +249,18 @@ func TestRequestorSignatureSession(t *testing.T) {
 	_, status, err := serverResult.Signature.Verify(client.Configuration, nil)
 	require.NoError(t, err)
 	require.Equal(t, irma.ProofStatusValid, status)
+
+	// Check that the signature can be verified without a session
+	result, err := server.VerifySignature(serverResult.Signature, client.Configuration)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "message", result.Signature.Message)
+	require.Equal(t, id, result.Disclosed[0][0].Identifier)
+
+	serverResult.Signature.Message = "other message"
+	_, err = server.VerifySignature(serverResult.Signature, client.Configuration)
+	require.IsType(t, &server.SignatureError{}, err)
+	require.NotEqual(t, irma.ProofStatusValid, err.(*server.SignatureError).Status)
 }
 
 func TestRequestorDisclosureSession(t *testing.T) {
@@ -178,6 +294,41 @@ func TestRequestorIssuanceSession(t *testing.T) {
 	testRequestorIssuance(t, false)
 }
 
+// Check that credentials can be issued in sessions whose context is not 1: the client verifies the
+// proof of the issuer over the context of the session when it receives the credentials
+func TestRequestorIssuanceSessionContext(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Context specified in the session request
+	request := getIssuanceRequest(true)
+	request.Context = big.NewInt(42)
+	result := requestorSessionHelper(t, request, client)
+	require.Nil(t, result.Err)
+	require.Equal(t, server.StatusDone, result.Status)
+
+	// Random context generated by the server
+	IrmaServerConfiguration.RandomSessionContext = true
+	defer func() { IrmaServerConfiguration.RandomSessionContext = false }()
+	StartRequestorServer(IrmaServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	var pkg server.SessionPackage
+	require.NoError(t, transport.Post("session", &pkg, getIssuanceRequest(true)))
+	clientChan := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, ""})
+	if res := <-clientChan; res != nil {
+		require.NoError(t, res.Err)
+	}
+	var serverResult server.SessionResult
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", &serverResult))
+	require.Nil(t, serverResult.Err)
+	require.Equal(t, server.StatusDone, serverResult.Status)
+}
+
 func TestRequestorCombinedSessionMultipleAttributes(t *testing.T) {
 	var ir irma.IssuanceRequest
 	require.NoError(t, irma.UnmarshalValidate([]byte(`{
@@ -279,6 +430,59 @@ func TestConDisCon(t *testing.T) {
 	requestorSessionHelper(t, dr, client)
 }
 
+func TestDisclosedIssuer(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	requestorSessionHelper(t, getMultipleIssuanceRequest(), client)
+
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	studentid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	// TestHandler always prefers the first option, so the order of the disjunction determines
+	// from which issuer the attribute is disclosed
+	tests := []struct {
+		ids              []irma.AttributeTypeIdentifier
+		credtype, issuer string
+	}{
+		{[]irma.AttributeTypeIdentifier{bsn, studentid}, "irma-demo.MijnOverheid.root", "irma-demo.MijnOverheid"},
+		{[]irma.AttributeTypeIdentifier{studentid, bsn}, "irma-demo.RU.studentCard", "irma-demo.RU"},
+	}
+	for _, tst := range tests {
+		request := irma.NewDisclosureRequest()
+		request.Disclose = irma.AttributeConDisCon{
+			irma.AttributeDisCon{
+				irma.AttributeCon{irma.AttributeRequest{Type: tst.ids[0]}},
+				irma.AttributeCon{irma.AttributeRequest{Type: tst.ids[1]}},
+			},
+		}
+		result := requestorSessionHelper(t, request, client)
+		require.Nil(t, result.Err)
+		require.Len(t, result.Disclosed, 1)
+		require.Len(t, result.Disclosed[0], 1)
+
+		attr := result.Disclosed[0][0]
+		require.Equal(t, tst.ids[0], attr.Identifier)
+		require.NotNil(t, attr.CredentialTypeID)
+		require.Equal(t, tst.credtype, attr.CredentialTypeID.String())
+		require.NotNil(t, attr.IssuerID)
+		require.Equal(t, tst.issuer, attr.IssuerID.String())
+		bts, err := json.Marshal(attr)
+		require.NoError(t, err)
+		require.Contains(t, string(bts), `"credentialtype":"`+tst.credtype+`"`)
+		require.Contains(t, string(bts), `"issuer":"`+tst.issuer+`"`)
+	}
+
+	// Results from servers that do not report the credential type and issuer omit them
+	var attr irma.DisclosedAttribute
+	require.NoError(t, json.Unmarshal([]byte(`{"id":"irma-demo.RU.studentCard.studentID","status":"PRESENT"}`), &attr))
+	require.Nil(t, attr.CredentialTypeID)
+	require.Nil(t, attr.IssuerID)
+	bts, err := json.Marshal(attr)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "credentialtype")
+	require.NotContains(t, string(bts), "issuer")
+}
+
 func TestOptionalDisclosure(t *testing.T) {
 	client, _ := parseStorage(t)
 	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
@@ -294,6 +498,9 @@ func TestOptionalDisclosure(t *testing.T) {
 			irma.AttributeCon{irma.AttributeRequest{Type: studentid}},
 		},
 	}
+	universityExpiry := irma.Timestamp(client.Attributes(university.CredentialTypeIdentifier(), 0).Expiry())
+	universityCred := university.CredentialTypeIdentifier()
+	universityIssuer := universityCred.IssuerIdentifier()
 	disclosed1 := [][]*irma.DisclosedAttribute{
 		{
 			{
@@ -302,6 +509,10 @@ func TestOptionalDisclosure(t *testing.T) {
 				Identifier:   irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
 				Status:       irma.AttributeProofStatusPresent,
 				IssuanceTime: irma.Timestamp(client.Attributes(university.CredentialTypeIdentifier(), 0).SigningDate()),
+				Expiry:       &universityExpiry,
+
+				CredentialTypeID: &universityCred,
+				IssuerID:         &universityIssuer,
 			},
 		},
 		{},
@@ -314,15 +525,19 @@ func TestOptionalDisclosure(t *testing.T) {
 	}
 	disclosed2 := [][]*irma.DisclosedAttribute{{}}
 
+	disjunctions1 := []irma.DisjunctionStatus{irma.DisjunctionStatusDisclosed, irma.DisjunctionStatusSkipped}
+	disjunctions2 := []irma.DisjunctionStatus{irma.DisjunctionStatusSkipped}
+
 	tests := []struct {
-		request   irma.SessionRequest
-		attrs     irma.AttributeConDisCon
-		disclosed [][]*irma.DisclosedAttribute
+		request      irma.SessionRequest
+		attrs        irma.AttributeConDisCon
+		disclosed    [][]*irma.DisclosedAttribute
+		disjunctions []irma.DisjunctionStatus
 	}{
-		{irma.NewDisclosureRequest(), attrs1, disclosed1},
-		{irma.NewSignatureRequest("message"), attrs1, disclosed1},
-		{getIssuanceRequest(true), attrs1, disclosed1},
-		{getIssuanceRequest(true), attrs2, disclosed2},
+		{irma.NewDisclosureRequest(), attrs1, disclosed1, disjunctions1},
+		{irma.NewSignatureRequest("message"), attrs1, disclosed1, disjunctions1},
+		{getIssuanceRequest(true), attrs1, disclosed1, disjunctions1},
+		{getIssuanceRequest(true), attrs2, disclosed2, disjunctions2},
 	}
 
 	for _, args := range tests {
@@ -331,5 +546,6 @@ func TestOptionalDisclosure(t *testing.T) {
 		// TestHandler always prefers the first option when given any choice, so it will not disclose the optional attribute
 		result := requestorSessionHelper(t, args.request, client)
 		require.True(t, reflect.DeepEqual(args.disclosed, result.Disclosed))
+		require.Equal(t, args.disjunctions, result.Disjunctions)
 	}
 }
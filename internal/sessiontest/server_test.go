@@ -1,6 +1,7 @@
 package sessiontest
 
 import (
+	"context"
 	"net/http"
 	"path/filepath"
 	"testing"
@@ -44,7 +45,7 @@ func StartRequestorServer(configuration *requestorserver.Configuration) {
 }
 
 func StopRequestorServer() {
-	requestorServer.Stop()
+	_ = requestorServer.Stop(context.Background())
 }
 
 func StartIrmaServer(t *testing.T, updatedIrmaConf bool) {
@@ -133,4 +134,5 @@ var JwtServerConfiguration = &requestorserver.Configuration{
 		},
 	},
 	JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "sk.pem"),
+	JwtIssuer:         "testserver",
 }
@@ -148,6 +148,10 @@ func serverRequest(
 	// Wait until client finishes
 	go poll(server.StatusConnected, transport, statuschan)
 	status = <-statuschan
+	for status == server.StatusCommunicating {
+		go poll(server.StatusCommunicating, transport, statuschan)
+		status = <-statuschan
+	}
 	if status != server.StatusDone {
 		return nil, errors.Errorf("Unexpected status: %s", status)
 	}
@@ -69,7 +69,7 @@ func (h *keyshareEnrollmentHandler) Cancelled() {
 	h.fail(errors.New("Keyshare enrollment session unexpectedly cancelled"))
 }
 func (h *keyshareEnrollmentHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
-	h.fail(errors.New("Keyshare enrollment failed: blocked"))
+	h.fail(keyshareBlockedError(duration))
 }
 func (h *keyshareEnrollmentHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
 	h.fail(errors.New("Keyshare enrollment failed: registration incomplete"))
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
@@ -298,6 +299,26 @@ func TestCredentialInfoListNewAttribute(t *testing.T) {
 	require.Fail(t, "studentCard credential not found")
 }
 
+func TestKeyshareBlockedError(t *testing.T) {
+	// Time-limited block
+	duration := blockedDuration("300")
+	require.Equal(t, 300, duration)
+	serr := keyshareBlockedError(duration)
+	require.Equal(t, irma.ErrorKeyshareBlocked, serr.ErrorType)
+	require.Equal(t, 5*time.Minute, serr.BlockedDuration)
+	require.Contains(t, serr.Error(), "Blocked for: 5m0s")
+
+	// Indefinite block
+	for _, message := range []string{"", "0", "-1", "forever"} {
+		duration = blockedDuration(message)
+		require.Equal(t, -1, duration)
+		serr = keyshareBlockedError(duration)
+		require.Equal(t, irma.ErrorKeyshareBlocked, serr.ErrorType)
+		require.Zero(t, serr.BlockedDuration)
+		require.Contains(t, serr.Error(), "Blocked for: indefinitely")
+	}
+}
+
 // ------
 
 type TestClientHandler struct {
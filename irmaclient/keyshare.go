@@ -239,11 +239,7 @@ func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error)
 			case "USER_NOT_REGISTERED":
 				ks.sessionHandler.KeyshareEnrollmentIncomplete(manager)
 			case "USER_BLOCKED":
-				duration, err := strconv.Atoi(serr.RemoteError.Message)
-				if err != nil { // Not really clear what to do with duration, but should never happen anyway
-					duration = -1
-				}
-				ks.sessionHandler.KeyshareBlocked(manager, duration)
+				ks.sessionHandler.KeyshareBlocked(manager, blockedDuration(serr.RemoteError.Message))
 			default:
 				ks.sessionHandler.KeyshareError(&manager, err)
 			}
@@ -253,6 +249,30 @@ func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error)
 	}
 }
 
+// blockedDuration parses the amount of seconds for which the user is blocked from the message of
+// a USER_BLOCKED error of the keyshare server, returning -1 if the user is blocked indefinitely
+// (or if the message is malformed).
+func blockedDuration(message string) int {
+	duration, err := strconv.Atoi(message)
+	if err != nil || duration <= 0 {
+		return -1
+	}
+	return duration
+}
+
+// keyshareBlockedError returns an ErrorKeyshareBlocked error for a block of the specified amount
+// of seconds by the keyshare server, where a duration that is not positive means indefinitely.
+func keyshareBlockedError(duration int) *irma.SessionError {
+	serr := &irma.SessionError{
+		ErrorType: irma.ErrorKeyshareBlocked,
+		Err:       errors.New("blocked by keyshare server"),
+	}
+	if duration > 0 {
+		serr.BlockedDuration = time.Duration(duration) * time.Second
+	}
+	return serr
+}
+
 // Ask for a pin, repeatedly if necessary, and either continue the keyshare protocol
 // with authorization, or stop the keyshare protocol and inform of failure.
 func (ks *keyshareSession) VerifyPin(attempts int) {
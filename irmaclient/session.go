@@ -208,8 +208,18 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 		return nil
 	}
 
+	// If the server advertised its supported versions, fail early if we have none in common
+	max, err := irma.NegotiateVersion(qr, min, maxVersion)
+	if err != nil {
+		session.fail(err.(*irma.SessionError))
+		return nil
+	}
+	if qr.ProtocolVersion != nil && qr.ProtocolVersion.AboveVersion(min) {
+		min = qr.ProtocolVersion
+	}
+
 	session.transport.SetHeader(irma.MinVersionHeader, min.String())
-	session.transport.SetHeader(irma.MaxVersionHeader, maxVersion.String())
+	session.transport.SetHeader(irma.MaxVersionHeader, max.String())
 	if !strings.HasSuffix(session.ServerURL, "/") {
 		session.ServerURL += "/"
 	}
@@ -634,7 +644,9 @@ func panicToError(e interface{}) *irma.SessionError {
 func (session *session) delete() bool {
 	if !session.done {
 		if session.IsInteractive() {
-			session.transport.Delete()
+			if err := session.transport.Delete(""); err != nil {
+				irma.Logger.Warn("Failed to cancel session at server: ", err.Error())
+			}
 		}
 		session.done = true
 		return true
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"crypto/sha256"
@@ -29,10 +30,10 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	gobig "math/big"
+	mathrand "math/rand"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
-	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -62,8 +63,14 @@ type Configuration struct {
 	initialized   bool
 	assets        string
 	readOnly      bool
-	cronchan      chan bool
-	scheduler     *gocron.Scheduler
+	updateStop    chan bool
+
+	updateLock        sync.Mutex
+	schemeCount       int
+	updating          bool
+	updateErr         error
+	updateFailures    int
+	lastUpdateSuccess time.Time
 }
 
 // ConfigurationFileHash encodes the SHA256 hash of an authenticated
@@ -162,6 +169,8 @@ func (conf *Configuration) clear() {
 // ParseFolder populates the current Configuration by parsing the storage path,
 // listing the containing scheme managers, issuers and credential types.
 func (conf *Configuration) ParseFolder() (err error) {
+	defer conf.updateSchemeCount()
+
 	// Init all maps
 	conf.clear()
 
@@ -251,6 +260,7 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 	// - or equivalently, manager.Valid == true
 	// before using any scheme manager for anything, and handle accordingly
 	conf.SchemeManagers[manager.Identifier()] = manager
+	conf.updateSchemeCount()
 
 	// Ensure we return a SchemeManagerError when any error occurs
 	defer func() {
@@ -462,6 +472,7 @@ func (conf *Configuration) parseIssuerFolders(manager *SchemeManager, path strin
 
 func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error {
 	delete(conf.SchemeManagers, id)
+	conf.updateSchemeCount()
 	delete(conf.DisabledSchemeManagers, id)
 	name := id.String()
 	for iss := range conf.Issuers {
@@ -746,6 +757,7 @@ func (conf *Configuration) RemoveSchemeManager(id SchemeManagerIdentifier, fromS
 		}
 	}
 	delete(conf.SchemeManagers, id)
+	conf.updateSchemeCount()
 
 	if fromStorage || !conf.readOnly {
 		return os.RemoveAll(fmt.Sprintf("%s/%s", conf.Path, id.String()))
@@ -801,6 +813,7 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 		return err
 	}
 	conf.SchemeManagers[manager.Identifier()] = manager
+	conf.updateSchemeCount()
 	if err := conf.UpdateSchemeManager(manager.Identifier(), nil); err != nil {
 		return err
 	}
@@ -1285,7 +1298,23 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	return
 }
 
-func (conf *Configuration) UpdateSchemes() error {
+func (conf *Configuration) UpdateSchemes() (err error) {
+	conf.updateLock.Lock()
+	conf.updating = true
+	conf.updateLock.Unlock()
+	defer func() {
+		conf.updateLock.Lock()
+		conf.updating = false
+		conf.updateErr = err
+		if err != nil {
+			conf.updateFailures++
+		} else {
+			conf.updateFailures = 0
+			conf.lastUpdateSuccess = time.Now()
+		}
+		conf.updateLock.Unlock()
+	}()
+
 	updated := IrmaIdentifierSet{
 		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
 		Issuers:         map[IssuerIdentifier]struct{}{},
@@ -1303,33 +1332,116 @@ func (conf *Configuration) UpdateSchemes() error {
 	return nil
 }
 
+// SchemeUpdateStatus returns whether or not the schemes are currently being updated by
+// UpdateSchemes(), and the error that the last completed update returned, if any.
+func (conf *Configuration) SchemeUpdateStatus() (updating bool, err error) {
+	conf.updateLock.Lock()
+	defer conf.updateLock.Unlock()
+	return conf.updating, conf.updateErr
+}
+
+// SchemeCount returns the number of schemes. Unlike SchemeManagers, it may be used while the
+// schemes are being updated in the background.
+func (conf *Configuration) SchemeCount() int {
+	conf.updateLock.Lock()
+	defer conf.updateLock.Unlock()
+	return conf.schemeCount
+}
+
+// updateSchemeCount records the number of schemes for SchemeCount. It must be called after
+// modifying SchemeManagers, by the goroutine that modified it.
+func (conf *Configuration) updateSchemeCount() {
+	conf.updateLock.Lock()
+	defer conf.updateLock.Unlock()
+	conf.schemeCount = len(conf.SchemeManagers)
+}
+
+// SchemeUpdateHistory returns the number of consecutive failed scheme updates, and the time at
+// which the last successful update completed (the zero time if none did).
+func (conf *Configuration) SchemeUpdateHistory() (failures int, lastSuccess time.Time) {
+	conf.updateLock.Lock()
+	defer conf.updateLock.Unlock()
+	return conf.updateFailures, conf.lastUpdateSuccess
+}
+
+// SchemeUpdateOptions configures the automatic scheme updater.
+type SchemeUpdateOptions struct {
+	// Time between two updates
+	Interval time.Duration
+	// A random delay between 0 and Jitter is added to each update, so that multiple instances
+	// started simultaneously do not all update at the same time
+	Jitter time.Duration
+	// After a failed update the next one is done after Backoff instead of Interval, doubling with
+	// each consecutive failure up to Interval. Failed updates are not retried early if 0.
+	Backoff time.Duration
+}
+
+// delay returns the time to wait before the next update, given the amount of consecutive
+// failed updates.
+func (opts SchemeUpdateOptions) delay(failures int) time.Duration {
+	d := opts.Interval
+	if failures > 0 && opts.Backoff > 0 {
+		d = opts.Backoff
+		for i := 1; i < failures && d < opts.Interval; i++ {
+			d *= 2
+		}
+		if d > opts.Interval {
+			d = opts.Interval
+		}
+	}
+	if opts.Jitter > 0 {
+		d += time.Duration(mathrand.Int63n(int64(opts.Jitter)))
+	}
+	return d
+}
+
 func (conf *Configuration) AutoUpdateSchemes(interval uint) {
-	Logger.Infof("Updating schemes every %d minutes", interval)
-
-	conf.scheduler = gocron.NewScheduler()
-	conf.scheduler.Every(uint64(interval)).Minutes().Do(func() {
-		if err := conf.UpdateSchemes(); err != nil {
-			Logger.Error("Scheme autoupdater failed: ")
-			if e, ok := err.(*errors.Error); ok {
-				Logger.Error(e.ErrorStack())
-			} else {
-				Logger.Errorf("%s %s", reflect.TypeOf(err).String(), err.Error())
+	conf.AutoUpdateSchemesWithOptions(SchemeUpdateOptions{Interval: time.Duration(interval) * time.Minute})
+}
+
+// AutoUpdateSchemesWithOptions periodically updates all schemes in the background, until
+// StopAutoUpdateSchemes is called. The first update is done shortly after calling this.
+func (conf *Configuration) AutoUpdateSchemesWithOptions(opts SchemeUpdateOptions) {
+	Logger.Infof("Updating schemes every %s", opts.Interval)
+
+	stop := make(chan bool)
+	conf.updateStop = stop
+	go func() {
+		delay := 200 * time.Millisecond // Run first update after a small delay
+		if opts.Jitter > 0 {
+			delay += time.Duration(mathrand.Int63n(int64(opts.Jitter)))
+		}
+		for {
+			timer := time.NewTimer(delay)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
 			}
-		}
-	})
 
-	conf.cronchan = conf.scheduler.Start() // Schedule updates (first one in interval minutes from now)
-	go func() {                            // Run first update after a small delay
-		<-time.NewTimer(200 * time.Millisecond).C
-		conf.scheduler.RunAll()
+			if err := conf.UpdateSchemes(); err != nil {
+				Logger.Error("Scheme autoupdater failed: ")
+				if e, ok := err.(*errors.Error); ok {
+					Logger.Error(e.ErrorStack())
+				} else {
+					Logger.Errorf("%s %s", reflect.TypeOf(err).String(), err.Error())
+				}
+			}
+			failures, _ := conf.SchemeUpdateHistory()
+			delay = opts.delay(failures)
+			if failures > 0 {
+				Logger.Warnf("%d consecutive scheme updates failed, retrying in %s", failures, delay)
+			}
+		}
 	}()
-
 }
 
 func (conf *Configuration) StopAutoUpdateSchemes() {
-	if conf.cronchan != nil {
+	if conf.updateStop != nil {
 		Logger.Info("Stopped scheme autoupdater")
-		conf.cronchan <- true
+		conf.updateStop <- true
+		conf.updateStop = nil
 	}
 }
 
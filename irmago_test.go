@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/privacybydesign/gabi/big"
 
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -184,6 +186,11 @@ func TestMetadataCompatibility(t *testing.T) {
 	require.Equal(t, time.Unix(1499904000, 0), attr.SigningDate(), "Unexpected signing date")
 	require.Equal(t, time.Unix(1516233600, 0), attr.Expiry(), "Unexpected expiry date")
 	require.Equal(t, 2, attr.KeyCounter(), "Unexpected key counter")
+
+	disclosed, _, err := parseAttribute(1, attr, nil)
+	require.NoError(t, err)
+	require.Equal(t, Timestamp(time.Unix(1499904000, 0)), disclosed.IssuanceTime)
+	require.Equal(t, Timestamp(time.Unix(1516233600, 0)), *disclosed.Expiry)
 }
 
 func TestTimestamp(t *testing.T) {
@@ -522,3 +529,206 @@ func TestConDisconSingletons(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoteError(t *testing.T) {
+	err := NewRemoteError(404, "SESSION_UNKNOWN", "Unknown or expired session", "")
+	require.True(t, err.IsNotFound())
+	require.False(t, err.IsUnauthorized())
+	require.False(t, err.IsServerError())
+	require.Equal(t, "SESSION_UNKNOWN: Unknown or expired session", err.Error())
+
+	err = NewRemoteError(403, "UNAUTHORIZED", "You are not authorized", "irma-demo.RU.studentCard")
+	require.True(t, err.IsUnauthorized())
+	require.Equal(t, "UNAUTHORIZED (irma-demo.RU.studentCard): You are not authorized", err.Error())
+
+	var e error = NewRemoteError(500, "EXCEPTION", "Encountered unexpected problem", "")
+	require.True(t, e.(*RemoteError).IsServerError())
+}
+
+func TestClientReturnClaimsValidation(t *testing.T) {
+	request := &ServiceProviderRequest{
+		Request: NewDisclosureRequest(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		RequestorBaseRequest: RequestorBaseRequest{
+			ClientReturnClaims: map[string]interface{}{"tenant": "example", "correlation": 42},
+		},
+	}
+	require.NoError(t, request.Validate())
+
+	request.ClientReturnClaims["large"] = strings.Repeat("a", MaxClientReturnClaimsSize)
+	require.Error(t, request.Validate())
+}
+
+func TestLabelValidation(t *testing.T) {
+	request := &ServiceProviderRequest{
+		Request:              NewDisclosureRequest(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		RequestorBaseRequest: RequestorBaseRequest{Label: "call 1234, agent Émile"},
+	}
+	require.NoError(t, request.Validate())
+
+	request.Label = "line\nbreak"
+	require.Error(t, request.Validate())
+	request.Label = strings.Repeat("a", MaxLabelLength+1)
+	require.Error(t, request.Validate())
+}
+
+func TestMetadataValidation(t *testing.T) {
+	request := &ServiceProviderRequest{
+		Request: NewDisclosureRequest(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		RequestorBaseRequest: RequestorBaseRequest{
+			Metadata: map[string]string{"tenant": "example", "locale": "nl_NL"},
+		},
+	}
+	require.NoError(t, request.Validate())
+
+	request.Metadata["large"] = strings.Repeat("a", MaxMetadataSize)
+	require.Error(t, request.Validate())
+	delete(request.Metadata, "large")
+	request.Metadata["locale"] = "nl\x00"
+	require.Error(t, request.Validate())
+	request.Metadata["locale"] = "nl_NL"
+	request.Metadata[""] = "empty"
+	require.Error(t, request.Validate())
+}
+
+func TestProtocolVersionCompare(t *testing.T) {
+	v29, v210 := NewVersion(2, 9), NewVersion(2, 10)
+	require.Equal(t, 1, v210.Compare(v29))
+	require.Equal(t, -1, v29.Compare(v210))
+	require.Equal(t, 0, v29.Compare(NewVersion(2, 9)))
+	require.Equal(t, -1, v210.Compare(NewVersion(3, 0)))
+	require.True(t, v210.AboveVersion(v29))
+	require.True(t, v29.Below(2, 10))
+	require.True(t, v29.Equal(NewVersion(2, 9)))
+	require.False(t, v29.Equal(v210))
+
+	version, err := ParseVersion("2.10")
+	require.NoError(t, err)
+	require.Equal(t, v210, version)
+	for _, invalid := range []string{"", "2", "2.", "2.x", "2.5.1", "-2.5", "2.-5", "+2.5"} {
+		_, err = ParseVersion(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	var unmarshaled ProtocolVersion
+	require.NoError(t, json.Unmarshal([]byte(`"2.10"`), &unmarshaled))
+	require.Equal(t, *v210, unmarshaled)
+}
+
+func TestDisjunctionStatuses(t *testing.T) {
+	id := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	required := AttributeDisCon{AttributeCon{{Type: id}}}
+	optional := AttributeDisCon{AttributeCon{}, AttributeCon{{Type: id}}}
+	cdc := AttributeConDisCon{required, optional, optional, required}
+	require.True(t, optional.Optional())
+	require.False(t, required.Optional())
+
+	attr := &DisclosedAttribute{Identifier: id, Status: AttributeProofStatusPresent}
+	disclosed := [][]*DisclosedAttribute{{attr}, {attr}, {}, nil}
+	require.Equal(t, []DisjunctionStatus{
+		DisjunctionStatusDisclosed, DisjunctionStatusDisclosed, DisjunctionStatusSkipped, DisjunctionStatusMissing,
+	}, cdc.DisjunctionStatuses(disclosed))
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	min, max := NewVersion(2, 4), NewVersion(2, 5)
+
+	version, err := NegotiateVersion(&Qr{}, min, max)
+	require.NoError(t, err)
+	require.Equal(t, max, version)
+	version, err = NegotiateVersion(&Qr{ProtocolVersion: NewVersion(2, 3), ProtocolMaxVersion: NewVersion(2, 4)}, min, max)
+	require.NoError(t, err)
+	require.Equal(t, NewVersion(2, 4), version)
+	version, err = NegotiateVersion(&Qr{ProtocolVersion: NewVersion(2, 5)}, min, max)
+	require.NoError(t, err)
+	require.Equal(t, max, version)
+
+	_, err = NegotiateVersion(&Qr{ProtocolVersion: NewVersion(2, 6), ProtocolMaxVersion: NewVersion(2, 7)}, min, max)
+	require.Error(t, err)
+	require.Equal(t, ErrorProtocolVersionNotSupported, err.(*SessionError).ErrorType)
+	require.Contains(t, err.Error(), "server supports versions 2.6 to 2.7, client supports versions 2.4 to 2.5")
+	_, err = NegotiateVersion(&Qr{ProtocolMaxVersion: NewVersion(2, 3)}, min, max)
+	require.Error(t, err)
+}
+
+func TestParseRequestorJwtBase64URL(t *testing.T) {
+	// Runs of 6 times ~ or ? encode to base64url segments containing - and _ respectively
+	// (and + and / in standard base64), regardless of alignment
+	contents := NewServiceProviderJwt("~~~~~~??????", NewDisclosureRequest(
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	))
+	j, err := jwt.NewWithClaims(jwt.SigningMethodNone, contents).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	parts := strings.Split(j, ".")
+	require.Contains(t, parts[1], "-")
+	require.Contains(t, parts[1], "_")
+
+	parsed, err := ParseRequestorJwt(string(ActionDisclosing), j)
+	require.NoError(t, err)
+	require.Equal(t, "~~~~~~??????", parsed.Requestor())
+
+	// Padded segments are tolerated as well
+	if l := len(parts[1]) % 4; l > 0 {
+		parts[1] += strings.Repeat("=", 4-l)
+	}
+	parsed, err = ParseRequestorJwt(string(ActionDisclosing), strings.Join(parts, "."))
+	require.NoError(t, err)
+	require.Equal(t, "~~~~~~??????", parsed.Requestor())
+}
+
+func TestParseRequestorJwtUnknownAction(t *testing.T) {
+	contents := NewServiceProviderJwt("requestor", NewDisclosureRequest(
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	))
+	j, err := jwt.NewWithClaims(jwt.SigningMethodNone, contents).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+
+	for _, action := range []string{"foo", string(ActionUnknown), ""} {
+		_, err = ParseRequestorJwt(action, j)
+		require.IsType(t, &SessionError{}, err)
+		serr := err.(*SessionError)
+		require.Equal(t, ErrorUnknownAction, serr.ErrorType)
+		require.Equal(t, action, serr.Info)
+	}
+
+	err = (&Qr{URL: "https://example.com/irma/session/abc", Type: Action("foo")}).Validate()
+	require.IsType(t, &SessionError{}, err)
+	require.Equal(t, ErrorUnknownAction, err.(*SessionError).ErrorType)
+}
+
+func TestSchemeUpdateDelay(t *testing.T) {
+	opts := SchemeUpdateOptions{Interval: time.Hour, Backoff: time.Minute}
+	require.Equal(t, time.Hour, opts.delay(0))
+	require.Equal(t, time.Minute, opts.delay(1))
+	require.Equal(t, 2*time.Minute, opts.delay(2))
+	require.Equal(t, 32*time.Minute, opts.delay(6))
+	require.Equal(t, time.Hour, opts.delay(7)) // capped at the interval
+	require.Equal(t, time.Hour, opts.delay(100))
+
+	opts.Backoff = 0
+	require.Equal(t, time.Hour, opts.delay(1))
+
+	opts.Jitter = time.Minute
+	for i := 0; i < 10; i++ {
+		d := opts.delay(0)
+		require.True(t, d >= time.Hour && d < time.Hour+time.Minute)
+	}
+}
+
+func TestDisclosureRequestBuilder(t *testing.T) {
+	email := NewAttributeTypeIdentifier("pbdf.pbdf.email.email")
+	mobile := NewAttributeTypeIdentifier("pbdf.pbdf.mobilenumber.mobilenumber")
+	street := NewAttributeTypeIdentifier("pbdf.gemeente.address.street")
+	city := NewAttributeTypeIdentifier("pbdf.gemeente.address.city")
+
+	request := NewDisclosureRequest(email).
+		AddDisjunction(nil, NewAttributeCon(mobile), NewAttributeCon(street, city)).
+		AddDisjunction(nil, NewAttributeCon(email), NewAttributeCon())
+	require.Equal(t, AttributeConDisCon{
+		AttributeDisCon{AttributeCon{{Type: email}}},
+		AttributeDisCon{AttributeCon{{Type: mobile}}, AttributeCon{{Type: street}, {Type: city}}},
+		AttributeDisCon{AttributeCon{{Type: email}}, AttributeCon{}},
+	}, request.Disclose)
+	require.Len(t, request.Labels, 3)
+	require.True(t, request.Disclose[2].Optional())
+	require.NoError(t, request.Validate())
+}
@@ -3,9 +3,11 @@ package irma
 import (
 	"bytes"
 	"encoding/json"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"fmt"
 
@@ -35,51 +37,107 @@ func NewVersion(major, minor int) *ProtocolVersion {
 	return &ProtocolVersion{major, minor}
 }
 
+// ParseVersion parses a protocol version of the form major.minor, e.g. 2.5.
+func ParseVersion(s string) (*ProtocolVersion, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid protocol version number: not of form x.y")
+	}
+	major, err := strconv.ParseUint(parts[0], 10, 31)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid major protocol version number", 0)
+	}
+	minor, err := strconv.ParseUint(parts[1], 10, 31)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid minor protocol version number", 0)
+	}
+	return NewVersion(int(major), int(minor)), nil
+}
+
 func (v *ProtocolVersion) String() string {
 	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
 }
 
-func (v *ProtocolVersion) UnmarshalJSON(b []byte) (err error) {
+func (v *ProtocolVersion) UnmarshalJSON(b []byte) error {
 	var str string
 	if err := json.Unmarshal(b, &str); err != nil {
 		str = string(b) // If b is not enclosed by quotes, try it directly
 	}
-	parts := strings.Split(str, ".")
-	if len(parts) != 2 {
-		return errors.New("Invalid protocol version number: not of form x.y")
-	}
-	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
-		return
+	parsed, err := ParseVersion(str)
+	if err != nil {
+		return err
 	}
-	v.Minor, err = strconv.Atoi(parts[1])
-	return
+	*v = *parsed
+	return nil
 }
 
 func (v *ProtocolVersion) MarshalJSON() ([]byte, error) {
 	return json.Marshal(v.String())
 }
 
+// Compare returns -1, 0 or 1 if v is respectively below, equal to, or above the other version.
+func (v *ProtocolVersion) Compare(other *ProtocolVersion) int {
+	switch {
+	case v.Major < other.Major:
+		return -1
+	case v.Major > other.Major:
+		return 1
+	case v.Minor < other.Minor:
+		return -1
+	case v.Minor > other.Minor:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Equal returns true if v is equal to the other version.
+func (v *ProtocolVersion) Equal(other *ProtocolVersion) bool {
+	return v.Compare(other) == 0
+}
+
 // Returns true if v is below the given version.
 func (v *ProtocolVersion) Below(major, minor int) bool {
-	if v.Major < major {
-		return true
-	}
-	return v.Major == major && v.Minor < minor
+	return v.BelowVersion(NewVersion(major, minor))
 }
 
 func (v *ProtocolVersion) BelowVersion(other *ProtocolVersion) bool {
-	return v.Below(other.Major, other.Minor)
+	return v.Compare(other) < 0
 }
 
+// Returns true if v is above the given version.
 func (v *ProtocolVersion) Above(major, minor int) bool {
-	if v.Major > major {
-		return true
-	}
-	return v.Major == major && v.Minor > minor
+	return v.AboveVersion(NewVersion(major, minor))
 }
 
 func (v *ProtocolVersion) AboveVersion(other *ProtocolVersion) bool {
-	return v.Above(other.Major, other.Minor)
+	return v.Compare(other) > 0
+}
+
+// NegotiateVersion returns the highest protocol version that is both within [min, max] and within
+// the range of versions supported by the server as advertised in the QR; bounds that the QR does
+// not specify are not restricted. If there is no such version, a *SessionError of type
+// ErrorProtocolVersionNotSupported is returned mentioning both ranges.
+func NegotiateVersion(qr *Qr, min, max *ProtocolVersion) (*ProtocolVersion, error) {
+	minServer, maxServer := qr.ProtocolVersion, qr.ProtocolMaxVersion
+	if minServer == nil {
+		minServer = min
+	}
+	if maxServer == nil {
+		maxServer = max
+	}
+
+	if max.BelowVersion(min) || maxServer.BelowVersion(minServer) || max.BelowVersion(minServer) || maxServer.BelowVersion(min) {
+		return nil, &SessionError{
+			ErrorType: ErrorProtocolVersionNotSupported,
+			Err: errors.Errorf("server supports versions %s to %s, client supports versions %s to %s",
+				minServer, maxServer, min, max),
+		}
+	}
+	if maxServer.BelowVersion(max) {
+		return maxServer, nil
+	}
+	return max, nil
 }
 
 // GetMetadataVersion maps a chosen protocol version to a metadata version that
@@ -104,6 +162,14 @@ type SessionError struct {
 	Info         string
 	RemoteError  *RemoteError
 	RemoteStatus int
+	// In case of ErrorRateLimited, the time the server asked us to wait before trying again, if any
+	RetryAfter time.Duration
+	// In case of ErrorKeyshareBlocked, how long the keyshare server blocks the user; zero if the
+	// user is blocked indefinitely
+	BlockedDuration time.Duration
+	// The body of the request that caused the error, with any JWTs redacted. Only set when the
+	// Debug flag of the HTTPTransport is enabled.
+	RequestBody []byte
 }
 
 // RemoteError is an error message returned by the API server on errors.
@@ -115,6 +181,16 @@ type RemoteError struct {
 	Stacktrace  string `json:"stacktrace,omitempty"`
 }
 
+// NewRemoteError returns a new RemoteError with the specified contents.
+func NewRemoteError(status int, name, description, message string) *RemoteError {
+	return &RemoteError{
+		Status:      status,
+		ErrorName:   name,
+		Description: description,
+		Message:     message,
+	}
+}
+
 type Validator interface {
 	Validate() error
 }
@@ -139,6 +215,22 @@ func (err *RemoteError) Error() string {
 	return fmt.Sprintf("%s%s: %s", err.ErrorName, msg, err.Description)
 }
 
+// IsNotFound returns true if the server responded with 404 Not Found.
+func (err *RemoteError) IsNotFound() bool {
+	return err.Status == http.StatusNotFound
+}
+
+// IsUnauthorized returns true if the server refused the request because the sender was not
+// authenticated or not authorized to perform it (401 or 403).
+func (err *RemoteError) IsUnauthorized() bool {
+	return err.Status == http.StatusUnauthorized || err.Status == http.StatusForbidden
+}
+
+// IsServerError returns true if the server indicated that it itself failed to handle the request (5xx).
+func (err *RemoteError) IsServerError() bool {
+	return err.Status >= 500 && err.Status < 600
+}
+
 // Qr contains the data of an IRMA session QR (as generated by irma_js),
 // suitable for NewSession().
 type Qr struct {
@@ -146,10 +238,19 @@ type Qr struct {
 	URL string `json:"u"`
 	// Session type (disclosing, signing, issuing)
 	Type Action `json:"irmaqr"`
+	// Minimum and maximum protocol version supported by the server, if advertised
+	ProtocolVersion    *ProtocolVersion `json:"v,omitempty"`
+	ProtocolMaxVersion *ProtocolVersion `json:"vmax,omitempty"`
 }
 
 type SchemeManagerRequest Qr
 
+// PairingCodeMessage is sent by the IRMA app to the server to pair with the requestor's frontend,
+// in sessions whose PairingMethod is not PairingMethodNone.
+type PairingCodeMessage struct {
+	PairingCode string `json:"pairingCode"`
+}
+
 // Statuses
 const (
 	StatusConnected     = Status("connected")
@@ -187,10 +288,14 @@ const (
 	ErrorKeyshare = ErrorType("keyshare")
 	// The user is not enrolled at one of the keyshare servers needed for the request
 	ErrorKeyshareUnenrolled = ErrorType("keyshareUnenrolled")
+	// The user is blocked at the keyshare server after too many incorrect PIN attempts
+	ErrorKeyshareBlocked = ErrorType("keyshareBlocked")
 	// API server error
 	ErrorApi = ErrorType("api")
 	// Server returned unexpected or malformed response
 	ErrorServerResponse = ErrorType("serverResponse")
+	// Server refused our request because too many requests were sent to it
+	ErrorRateLimited = ErrorType("rateLimited")
 	// Credential type not present in our Configuration
 	ErrorUnknownIdentifier = ErrorType("unknownIdentifier")
 	// Error during downloading of credential type, issuer, or public keys
@@ -248,10 +353,26 @@ func (e *SessionError) Error() string {
 		buffer.WriteString("\nStatus code: ")
 		buffer.WriteString(strconv.Itoa(e.RemoteStatus))
 	}
+	if e.RetryAfter != 0 {
+		buffer.WriteString("\nRetry after: ")
+		buffer.WriteString(e.RetryAfter.String())
+	}
+	if e.ErrorType == ErrorKeyshareBlocked {
+		buffer.WriteString("\nBlocked for: ")
+		if e.BlockedDuration == 0 {
+			buffer.WriteString("indefinitely")
+		} else {
+			buffer.WriteString(e.BlockedDuration.String())
+		}
+	}
 	if e.RemoteError != nil {
 		buffer.WriteString("\nIRMA server error: ")
 		buffer.WriteString(e.RemoteError.Error())
 	}
+	if len(e.RequestBody) > 0 {
+		buffer.WriteString("\nRequest body: ")
+		buffer.Write(e.RequestBody)
+	}
 
 	return buffer.String()
 }
@@ -290,8 +411,10 @@ func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error)
 		retval = &SignatureRequestorJwt{}
 	case "issue_request", string(ActionIssuing):
 		retval = &IdentityProviderJwt{}
+	case "", string(ActionUnknown):
+		return nil, &SessionError{ErrorType: ErrorUnknownAction, Info: action, Err: errors.New("Session type missing or unknown")}
 	default:
-		return nil, errors.New("Invalid session type")
+		return nil, &SessionError{ErrorType: ErrorUnknownAction, Info: action, Err: errors.Errorf("Invalid session type %s", action)}
 	}
 	if _, _, err := new(jwt.Parser).ParseUnverified(requestorJwt, retval); err != nil {
 		return nil, err
@@ -320,7 +443,7 @@ func (qr *Qr) Validate() (err error) {
 	case ActionSigning: // nop
 	case ActionRedirect: // nop
 	default:
-		return errors.New("Unsupported session type")
+		return &SessionError{ErrorType: ErrorUnknownAction, Info: string(qr.Type), Err: errors.Errorf("Unsupported session type %s", qr.Type)}
 	}
 
 	return nil
@@ -5,8 +5,12 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwesterb/go-atum"
 	"github.com/dgrijalva/jwt-go"
@@ -109,11 +113,49 @@ type ServerJwt struct {
 // RequestorBaseRequest contains fields present in all RequestorRequest types
 // with which the requestor configures an IRMA session.
 type RequestorBaseRequest struct {
-	ResultJwtValidity int    `json:"validity,omitempty"`    // Validity of session result JWT in seconds
-	ClientTimeout     int    `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
-	CallbackURL       string `json:"callbackUrl,omitempty"` // URL to post session result to
+	ResultJwtValidity int           `json:"validity,omitempty"`      // Validity of session result JWT in seconds
+	ClientTimeout     int           `json:"timeout,omitempty"`       // Wait this many seconds for the IRMA app to connect before the session times out
+	CallbackURL       string        `json:"callbackUrl,omitempty"`   // URL to post session result to
+	PairingMethod     PairingMethod `json:"pairingMethod,omitempty"` // Whether the IRMA app must be paired before the session proceeds
+	ReturnURL         string        `json:"returnUrl,omitempty"`     // URL to which the frontend redirects the user after the session
+	Label             string        `json:"label,omitempty"`         // Reference of the requestor to the session, included in the session result
+
+	// Identifier of the session chosen by the requestor, included in the session package and the
+	// session result. It must be unique among the unexpired sessions of the requestor.
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// Opaque claims that are included in the session result JWT under the clientReturnClaims claim
+	ClientReturnClaims map[string]interface{} `json:"clientReturnClaims,omitempty"`
+
+	// Metadata of the requestor for the session, such as a tenant or locale, that is not used in
+	// the session but included in the session result and result callbacks
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+// MaxClientReturnClaimsSize is the maximum size in bytes of the JSON encoding of the
+// ClientReturnClaims of a session request.
+const MaxClientReturnClaimsSize = 1024
+
+// MaxLabelLength is the maximum length in bytes of the Label of a session request.
+const MaxLabelLength = 255
+
+// MaxCorrelationIDLength is the maximum length in bytes of the CorrelationID of a session request.
+const MaxCorrelationIDLength = 255
+
+// MaxMetadataSize is the maximum total size in bytes of the keys and values of the Metadata
+// of a session request.
+const MaxMetadataSize = 1024
+
+// PairingMethod specifies whether the IRMA app must be paired with the requestor's frontend
+// before the session can proceed, by entering a code shown by the frontend. This protects
+// against attackers relaying the session QR to unsuspecting users.
+type PairingMethod string
+
+const (
+	PairingMethodNone PairingMethod = "none" // No pairing (the default)
+	PairingMethodPin  PairingMethod = "pin"  // The user enters a short numeric pairing code in the IRMA app
+)
+
 // RequestorRequest is the message with which requestors start an IRMA session. It contains a
 // SessionRequest instance for the irmaclient along with extra fields in a RequestorBaseRequest.
 type RequestorRequest interface {
@@ -303,6 +345,17 @@ func (dc AttributeDisCon) Validate() error {
 	return nil
 }
 
+// Optional returns true if the disjunction contains an empty conjunction, i.e. if the user may
+// choose not to disclose any attributes for it.
+func (dc AttributeDisCon) Optional() bool {
+	for _, con := range dc {
+		if len(con) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // Satisfy returns true if the attributes specified by proofs and indices satisfies any one of the
 // contained AttributeCon's. If so it also returns a list of the disclosed attribute values.
 func (dc AttributeDisCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttributeIndex, conf *Configuration) (bool, []*DisclosedAttribute, error) {
@@ -378,6 +431,33 @@ func (dr *DisclosureRequest) AddSingle(attr AttributeTypeIdentifier, value *stri
 	dr.Labels[len(dr.Disclose)-1] = label
 }
 
+// AddDisjunction adds a disjunction to the request, for which the user must disclose the
+// attributes of one of the specified conjunctions (see NewAttributeCon). An empty conjunction
+// makes the disjunction optional. It returns the request, so that calls can be chained:
+//   NewDisclosureRequest().
+//     AddDisjunction(nil, NewAttributeCon(email)).
+//     AddDisjunction(nil, NewAttributeCon(mobile), NewAttributeCon(street, city))
+func (dr *DisclosureRequest) AddDisjunction(label TranslatedString, cons ...AttributeCon) *DisclosureRequest {
+	if dr.Labels == nil {
+		dr.Labels = map[int]TranslatedString{}
+	}
+	dr.Disclose = append(dr.Disclose, AttributeDisCon(cons))
+	dr.Labels[len(dr.Disclose)-1] = label
+	return dr
+}
+
+// NewAttributeCon returns an inner conjunction of the specified attributes, all of which
+// must be disclosed together.
+func NewAttributeCon(attrs ...AttributeTypeIdentifier) AttributeCon {
+	con := make(AttributeCon, 0, len(attrs))
+	for _, attr := range attrs {
+		con = append(con, AttributeRequest{Type: attr})
+	}
+	return con
+}
+
+// NewDisclosureRequest returns a disclosure request for the specified attributes, each of which
+// the user must disclose. Use AddDisjunction to add further disjunctions.
 func NewDisclosureRequest(attrs ...AttributeTypeIdentifier) *DisclosureRequest {
 	request := &DisclosureRequest{
 		BaseRequest: BaseRequest{LDContext: LDContextDisclosureRequest},
@@ -776,6 +856,9 @@ func (r *ServiceProviderRequest) Validate() error {
 	if r.Request == nil {
 		return errors.New("Not a ServiceProviderRequest")
 	}
+	if err := r.RequestorBaseRequest.validate(); err != nil {
+		return err
+	}
 	return r.Request.Validate()
 }
 
@@ -783,6 +866,9 @@ func (r *SignatureRequestorRequest) Validate() error {
 	if r.Request == nil {
 		return errors.New("Not a SignatureRequestorRequest")
 	}
+	if err := r.RequestorBaseRequest.validate(); err != nil {
+		return err
+	}
 	return r.Request.Validate()
 }
 
@@ -790,9 +876,66 @@ func (r *IdentityProviderRequest) Validate() error {
 	if r.Request == nil {
 		return errors.New("Not a IdentityProviderRequest")
 	}
+	if err := r.RequestorBaseRequest.validate(); err != nil {
+		return err
+	}
 	return r.Request.Validate()
 }
 
+func (r RequestorBaseRequest) validate() error {
+	switch r.PairingMethod {
+	case "", PairingMethodNone, PairingMethodPin:
+	default:
+		return errors.Errorf("Unsupported pairing method %s", r.PairingMethod)
+	}
+	if r.ReturnURL != "" {
+		u, err := url.Parse(r.ReturnURL)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid return URL", 0)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("Return URL must be an absolute http or https URL")
+		}
+	}
+	if len(r.Label) > MaxLabelLength {
+		return errors.Errorf("Label too long (%d bytes, at most %d allowed)", len(r.Label), MaxLabelLength)
+	}
+	if !utf8.ValidString(r.Label) || strings.IndexFunc(r.Label, unicode.IsControl) >= 0 {
+		return errors.New("Label must be plain text")
+	}
+	if len(r.CorrelationID) > MaxCorrelationIDLength {
+		return errors.Errorf("Correlation ID too long (%d bytes, at most %d allowed)", len(r.CorrelationID), MaxCorrelationIDLength)
+	}
+	if !utf8.ValidString(r.CorrelationID) || strings.IndexFunc(r.CorrelationID, unicode.IsControl) >= 0 {
+		return errors.New("Correlation ID must be plain text")
+	}
+	if len(r.ClientReturnClaims) > 0 {
+		bts, err := json.Marshal(r.ClientReturnClaims)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid client return claims", 0)
+		}
+		if len(bts) > MaxClientReturnClaimsSize {
+			return errors.Errorf("Client return claims too large (%d bytes, at most %d allowed)", len(bts), MaxClientReturnClaimsSize)
+		}
+	}
+	size := 0
+	for key, value := range r.Metadata {
+		if key == "" {
+			return errors.New("Metadata keys must not be empty")
+		}
+		for _, s := range []string{key, value} {
+			if !utf8.ValidString(s) || strings.IndexFunc(s, unicode.IsControl) >= 0 {
+				return errors.New("Metadata must be plain text")
+			}
+		}
+		size += len(key) + len(value)
+	}
+	if size > MaxMetadataSize {
+		return errors.Errorf("Metadata too large (%d bytes, at most %d allowed)", size, MaxMetadataSize)
+	}
+	return nil
+}
+
 func (r *ServiceProviderRequest) SessionRequest() SessionRequest {
 	return r.Request
 }
@@ -32,28 +32,124 @@ type Configuration struct {
 	// If left empty, default value is taken using DefaultSchemesPath().
 	// If an empty folder is specified, default schemes (irma-demo and pbdf) are downloaded into it.
 	SchemesPath string `json:"schemes_path" mapstructure:"schemes_path"`
+	// Paths to multiple folders containing IRMA schemes, as an alternative to SchemesPath (only used if
+	// IrmaConfiguration == nil). The schemes are copied, in order, into a temporary folder from which
+	// IrmaConfiguration is parsed, so that schemes in later paths replace same-named ones in earlier paths.
+	// Scheme updates are written to the temporary folder, leaving the specified folders untouched.
+	SchemesPaths []string `json:"schemes_paths" mapstructure:"schemes_paths"`
 	// If specified, schemes found here are copied into SchemesPath (only used if IrmaConfiguration == nil)
 	SchemesAssetsPath string `json:"schemes_assets_path" mapstructure:"schemes_assets_path"`
 	// Disable scheme updating
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// Delay each scheme update by a random amount of at most this many seconds (default nil means
+	// 60, 0 disables the delay), so that multiple servers started together do not update simultaneously
+	SchemesUpdateJitter *int `json:"schemes_update_jitter" mapstructure:"schemes_update_jitter"`
+	// Retry a failed scheme update after this many seconds, doubling after each consecutive
+	// failure up to SchemesUpdateInterval (default nil means 60, 0 retries only at the next
+	// regular update)
+	SchemesUpdateBackoff *int `json:"schemes_update_backoff" mapstructure:"schemes_update_backoff"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
 	// Issuer private keys
 	IssuerPrivateKeys map[irma.IssuerIdentifier]*gabi.PrivateKey `json:"-"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
-	// Required to be set to true if URL does not begin with https:// in production mode.
-	// In this case, the server would communicate with IRMA apps over plain HTTP. You must otherwise
-	// ensure (using eg a reverse proxy with TLS enabled) that the attributes are protected in transit.
+	// Required to be set to true if URL does not begin with https://, or if the irma server is not
+	// configured with a TLS certificate, in production mode. In this case, the server would
+	// communicate with IRMA apps over plain HTTP. You must otherwise ensure (using eg a reverse
+	// proxy with TLS enabled) that the attributes are protected in transit.
 	DisableTLS bool `json:"no_tls" mapstructure:"no_tls"`
 	// (Optional) email address of server admin, for incidental notifications such as breaking API changes
 	// See https://github.com/privacybydesign/irmago/tree/master/server#specifying-an-email-address
 	// for more information
 	Email string `json:"email" mapstructure:"email"`
-	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
+	// Amount of seconds that the result of a finished session remains available to the requestor,
+	// regardless of the activity of the client (default value 0 means 300). Afterwards the session
+	// is deleted, and requests for it fail with SESSION_UNKNOWN.
+	ResultRetention int `json:"result_retention" mapstructure:"result_retention"`
+	// Amount of seconds that a session waits for the client to connect, e.g. by scanning the QR,
+	// before it times out (default value 0 means 300). Overridden by the timeout of the session request.
+	ScanTimeout int `json:"scan_timeout" mapstructure:"scan_timeout"`
+	// Amount of seconds that a session in which the client has connected may be inactive before it
+	// times out (default value 0 means 300).
+	InteractionTimeout int `json:"interaction_timeout" mapstructure:"interaction_timeout"`
+	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used).
+	// When disabled (the default), no event sources are created and the statusevents endpoints
+	// respond with 404, upon which clients are expected to fall back to polling the status endpoints.
 	EnableSSE bool `json:"enable_sse" mapstructure:"enable_sse"`
+	// If nonzero, send a ping event every this many seconds to server sent event listeners, so that
+	// idle connections are not dropped by e.g. mobile networks
+	SSEKeepaliveInterval int `json:"sse_keepalive" mapstructure:"sse_keepalive"`
+	// Keep Prometheus metrics on sessions (exposed by the irma server at /metrics, authenticated
+	// with its admin token)
+	EnableMetrics bool `json:"enable_metrics" mapstructure:"enable_metrics"`
+	// Session metrics, populated if EnableMetrics is true
+	Metrics *Metrics `json:"-"`
+	// Maximum amount of unfinished sessions at any time; finished sessions whose result is still
+	// retained don't count (default value 0 means unlimited)
+	MaxSessions int `json:"max_sessions" mapstructure:"max_sessions"`
+	// Maximum amount of disjunctions in, and attributes requested by, the disclosure request of
+	// session requests, limiting the work of verifying disclosures (default values 0 mean 100 and 500)
+	MaxDisjunctions int `json:"max_disjunctions" mapstructure:"max_disjunctions"`
+	MaxAttributes   int `json:"max_attributes" mapstructure:"max_attributes"`
+	// Amount of times the IRMA app may submit proofs in disclosure and signature sessions. Proofs
+	// that lack requested attributes or contain expired ones are rejected, keeping the session open
+	// for another attempt; if the proofs of the last attempt are rejected as well, or if proofs are
+	// invalid in any other way, the session fails (default value 0 means 3)
+	MaxDisclosureAttempts int `json:"max_disclosure_attempts" mapstructure:"max_disclosure_attempts"`
+	// Maximum size in bytes of the HTTP request bodies of session requests and of messages of the
+	// IRMA app (default value 0 means 1 MB); increase for large issuance requests
+	MaxRequestBodyBytes int `json:"max_request_body_bytes" mapstructure:"max_request_body_bytes"`
+	// Maximum size in bytes of the message to be signed in signature session requests
+	// (default value 0 means 64 KB)
+	MaxSignatureMessageBytes int `json:"max_signature_message_bytes" mapstructure:"max_signature_message_bytes"`
+	// Require messages to be signed to be text, i.e. valid UTF-8 without control characters other
+	// than tabs and newlines
+	SignatureMessageText bool `json:"signature_message_text" mapstructure:"signature_message_text"`
+	// Use a random context instead of 1 in sessions whose request does not specify one. The context
+	// is hashed into the challenge of the zero-knowledge proofs of the IRMA app, binding the proofs to
+	// it in addition to the nonce. Attribute-based signatures created with a context other than 1
+	// only verify against signature requests containing that context.
+	RandomSessionContext bool `json:"random_session_context" mapstructure:"random_session_context"`
+	// Characters of which session tokens consist (default: lower and upper case letters and digits),
+	// e.g. lower case letters and digits if tokens end up in case-insensitive systems. Must consist
+	// of at least 28 distinct letters, digits or underscores, to keep session tokens unguessable.
+	SessionTokenChars string `json:"session_token_chars" mapstructure:"session_token_chars"`
+	// Maximum validity in days of issued credentials; issuance requests for credentials valid for
+	// longer are refused (default value 0 means unlimited)
+	MaxCredentialValidity int `json:"max_credential_validity" mapstructure:"max_credential_validity"`
+	// Validity in days of issued credentials whose validity the issuance request does not specify
+	// (default value 0 means 6 months, or MaxCredentialValidity if that is shorter)
+	DefaultCredentialValidity int `json:"default_credential_validity" mapstructure:"default_credential_validity"`
+	// If specified, the returnUrl of session requests must have the same scheme and host as one of
+	// these URLs, and a path within its path (e.g. https://example.com/app/ allows
+	// https://example.com/app/done), preventing the server from being used as an open redirect
+	AllowedReturnURLs []string `json:"allowed_return_urls" mapstructure:"allowed_return_urls"`
+	// If specified, sessions are saved in this directory, such that they survive a restart of the server
+	SessionStoragePath string `json:"session_storage_path" mapstructure:"session_storage_path"`
+	// If specified, called when a new session is created, for example to keep an audit trail.
+	// It is called synchronously (but without holding any locks) by the function starting the
+	// session, so it should return quickly.
+	OnSessionCreate func(token string, action irma.Action, request irma.SessionRequest) `json:"-"`
+	// If specified, called when a session finishes successfully. If it returns a request, a
+	// follow-up session is started on behalf of the same requestor (e.g. issuance after
+	// disclosure), whose QR and token are included in the result of the finished session.
+	NextSessionHandler func(result *SessionResult) (irma.RequestorRequest, error) `json:"-"`
+	// If specified, called with each session request before its session is started, allowing
+	// business rules to be enforced that cannot be expressed in the requestor permissions. If it
+	// returns an error, the session is not started and the error is returned to the requestor: as
+	// is if it is an *irma.RemoteError, otherwise as ErrorRequestRejected. The filter runs after
+	// the requestor has been authenticated and authorized and the request has been validated,
+	// but before the session is stored. The requestor name is "anonymous" if the requestor was
+	// not authenticated. It is also invoked for follow-up sessions of NextSessionHandler.
+	RequestFilter func(requestor string, request irma.RequestorRequest) error `json:"-"`
+	// If specified, used instead of the random generator to generate session tokens, so that
+	// tests can use predictable tokens. FOR TESTING ONLY: predictable tokens allow anyone to
+	// take over sessions, so this must never be set in production (and is refused in production
+	// mode). Generated tokens must be unique and usable in URL paths and filenames.
+	TokenGenerator func() string `json:"-"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -63,14 +159,56 @@ type Configuration struct {
 	LogJSON bool `json:"log_json" mapstructure:"log_json"`
 	// Custom logger instance. If specified, Verbose, Quiet and LogJSON are ignored.
 	Logger *logrus.Logger `json:"-"`
+	// If specified, an audit entry is logged here for each session when it finishes, containing
+	// its token, requestor, action, status and the types (but not values) of disclosed attributes
+	AuditLogger logrus.FieldLogger `json:"-"`
+	// Include the values of disclosed attributes in the audit log entries (default false)
+	AuditIncludeValues bool `json:"audit_include_values" mapstructure:"audit_include_values"`
+	// Attribute types whose values are too sensitive to be passed around in plaintext, such as
+	// citizen service numbers, or patterns of the form scheme.*, scheme.issuer.* etc. Their values
+	// are replaced by "[redacted]" in the log (including the audit log) and in session results
+	// sent as plain JSON, i.e. those from the /result endpoint and in result callbacks without a
+	// JWT private key. Plain JSON results are routinely handled by frontends and proxies and end
+	// up in their logs; the values are only included in signed result JWTs, which are meant for
+	// the backend of the requestor. Note that at TRACE level HTTP messages are logged unredacted.
+	RedactedAttributes []string `json:"redacted_attributes" mapstructure:"redacted_attributes"`
 
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
 }
 
+// SessionOptions contains the optional parameters for starting a session.
+type SessionOptions struct {
+	// Name of the (authenticated) requestor on whose behalf the session is started, which is
+	// included in the logs of the session. Empty denotes an anonymous requestor.
+	Requestor string
+	// If the requestor previously started a session with this idempotency key that has not yet
+	// been deleted, no new session is started; instead the QR and token of the existing session
+	// are returned. This makes it safe for requestors to retry starting a session. Empty disables
+	// this behaviour.
+	IdempotencyKey string
+}
+
 type SessionPackage struct {
-	SessionPtr *irma.Qr `json:"sessionPtr"`
-	Token      string   `json:"token"`
+	SessionPtr  *irma.Qr `json:"sessionPtr"`
+	Token       string   `json:"token"`
+	PairingCode string   `json:"pairingCode,omitempty"` // To be shown to the user, if pairing is enabled for the session
+
+	// Correlation ID as specified by the requestor in the session request
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// Other encodings of SessionPtr, if asked for by the requestor: the contents of the QR as JSON
+	// string, a URL opening the session in the IRMA app, and a data URI of a PNG image of the QR
+	QrJSON  string `json:"qrJson,omitempty"`
+	QrURL   string `json:"qrUrl,omitempty"`
+	QrImage string `json:"qrImage,omitempty"`
+}
+
+// FrontendStatus is the session status as returned to the frontend of the requestor, along with
+// the URL to which the frontend should redirect the user once the session is done, if any.
+type FrontendStatus struct {
+	Status    Status `json:"status"`
+	ReturnURL string `json:"returnUrl,omitempty"`
 }
 
 // SessionResult contains session information such as the session status, type, possible errors,
@@ -84,18 +222,65 @@ type SessionResult struct {
 	Signature   *irma.SignedMessage          `json:"signature,omitempty"`
 	Err         *irma.RemoteError            `json:"error,omitempty"`
 
+	// For each disjunction of the disclosure request, whether attributes were disclosed for it, or
+	// whether it was optional and the user chose not to disclose attributes for it
+	Disjunctions []irma.DisjunctionStatus `json:"disjunctions,omitempty"`
+
+	// Set if a follow-up session was started after this one by Configuration.NextSessionHandler
+	NextSession *irma.Qr `json:"nextSession,omitempty"`
+	NextToken   string   `json:"nextToken,omitempty"`
+	// Set if this session was started as follow-up of the session with this token
+	PrevToken string `json:"prevToken,omitempty"`
+	// Label of the session as specified by the requestor in the session request. It is not
+	// included in the status endpoints, which return the bare status.
+	Label string `json:"label,omitempty"`
+	// Correlation ID as specified by the requestor in the session request
+	CorrelationID string `json:"correlationId,omitempty"`
+	// Metadata as specified by the requestor in the session request
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// When the session was started, when the IRMA app first connected to it, and when it finished
+	CreatedAt         *time.Time `json:"createdAt,omitempty"`
+	ClientConnectedAt *time.Time `json:"clientConnectedAt,omitempty"`
+	FinishedAt        *time.Time `json:"finishedAt,omitempty"`
+
 	LegacySession bool `json:"-"` // true if request was started with legacy (i.e. pre-condiscon) session request
 }
 
-// Status is the status of an IRMA session.
+// SessionInfo contains information about an IRMA session kept by the server, for monitoring purposes.
+type SessionInfo struct {
+	Token      string      `json:"token"`
+	Requestor  string      `json:"requestor"`
+	Label      string      `json:"label,omitempty"`
+	Type       irma.Action `json:"type"`
+	Status     Status      `json:"status"`
+	Created    time.Time   `json:"created"`
+	LastActive time.Time   `json:"lastActive"`
+}
+
+// Status is the status of an IRMA session. Sessions start in StatusInitialized, and move to
+// StatusConnected (via StatusPairing if a pairing code is required) when the client retrieves the
+// session request. When the client posts its response the session moves to StatusCommunicating
+// while the server verifies it, and from there to StatusDone, or StatusCancelled if the response
+// is invalid. If the client may retry after its proofs were rejected (see MaxDisclosureAttempts),
+// the session returns to StatusConnected instead. The session is cancelled when the client or
+// requestor cancels it or when an error occurs, and moves to StatusTimeout if it expires before
+// finishing. StatusDone, StatusCancelled and StatusTimeout are final.
+//
+// As the session is locked while the server verifies the response, StatusCommunicating is only
+// observable through server sent events: requestors polling the status (also when long-polling)
+// see the session move from StatusConnected directly to the next status.
 type Status string
 
 const (
-	StatusInitialized Status = "INITIALIZED" // The session has been started and is waiting for the client
-	StatusConnected   Status = "CONNECTED"   // The client has retrieved the session request, we wait for its response
-	StatusCancelled   Status = "CANCELLED"   // The session is cancelled, possibly due to an error
-	StatusDone        Status = "DONE"        // The session has completed successfully
-	StatusTimeout     Status = "TIMEOUT"     // Session timed out
+	StatusInitialized   Status = "INITIALIZED"   // The session has been started and is waiting for the client
+	StatusPairing       Status = "PAIRING"       // The client has retrieved the session request, we wait for it to submit the pairing code
+	StatusConnected     Status = "CONNECTED"     // The client has retrieved the session request, we wait for its response
+	StatusCommunicating Status = "COMMUNICATING" // The client has sent its response, which the server is verifying
+	StatusCancelled     Status = "CANCELLED"     // The session is cancelled, possibly due to an error
+	StatusDone          Status = "DONE"          // The session has completed successfully
+	StatusTimeout       Status = "TIMEOUT"       // Session timed out
+	StatusUnknown       Status = "UNKNOWN"       // The session is unknown or expired (only used by the batch status endpoint)
 )
 
 // Remove this when dropping support for legacy pre-condiscon session requests
@@ -143,6 +328,19 @@ func (conf *Configuration) HavePrivateKeys() (bool, error) {
 	return false, nil
 }
 
+// ReadBody reads the body of the HTTP request, which may be at most max bytes large. If it is
+// larger, an error of type ErrorBodyTooLarge is returned.
+func ReadBody(w http.ResponseWriter, r *http.Request, max int) ([]byte, *irma.RemoteError) {
+	bts, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(max)))
+	if err == nil {
+		return bts, nil
+	}
+	if len(bts) >= max {
+		return nil, RemoteError(ErrorBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", max))
+	}
+	return nil, RemoteError(ErrorInvalidRequest, err.Error())
+}
+
 func (status Status) Finished() bool {
 	return status == StatusDone || status == StatusCancelled || status == StatusTimeout
 }
@@ -160,13 +358,9 @@ func RemoteError(err Error, message string) *irma.RemoteError {
 		stack = string(debug.Stack())
 		Logger.Warn(stack)
 	}
-	return &irma.RemoteError{
-		Status:      err.Status,
-		Description: err.Description,
-		ErrorName:   string(err.Type),
-		Message:     message,
-		Stacktrace:  stack,
-	}
+	rerr := irma.NewRemoteError(err.Status, string(err.Type), err.Description, message)
+	rerr.Stacktrace = stack
+	return rerr
 }
 
 // JsonResponse JSON-marshals the specified object or error
@@ -240,6 +434,39 @@ func ParseSessionRequest(request interface{}) (irma.RequestorRequest, error) {
 	}
 }
 
+// SignatureError is returned by VerifySignature if an attribute-based signature is not valid.
+type SignatureError struct {
+	Status irma.ProofStatus
+}
+
+func (e *SignatureError) Error() string {
+	return "attribute-based signature not valid: " + string(e.Status)
+}
+
+// VerifySignature verifies an attribute-based signature, e.g. one stored after an earlier signing
+// session, against the specified IRMA configuration, without the need for a session. If the
+// signature is valid, it returns a session result containing the signature (and thus the signed
+// message) and the disclosed attributes. If the signature is invalid or contains attributes that
+// were expired at signing time, it returns the result along with a *SignatureError containing the
+// proof status. Other errors indicate that the signature could not be verified at all.
+func VerifySignature(sig *irma.SignedMessage, conf *irma.Configuration) (*SessionResult, error) {
+	disclosed, status, err := sig.Verify(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &SessionResult{
+		Type:        irma.ActionSigning,
+		Status:      StatusDone,
+		ProofStatus: status,
+		Disclosed:   disclosed,
+		Signature:   sig,
+	}
+	if status != irma.ProofStatusValid {
+		return result, &SignatureError{Status: status}
+	}
+	return result, nil
+}
+
 func wrapSessionRequest(request irma.SessionRequest) (irma.RequestorRequest, error) {
 	switch r := request.(type) {
 	case *irma.DisclosureRequest:
@@ -6,6 +6,9 @@ import (
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +76,41 @@ func TestParseSessionRequest(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func TestReadBody(t *testing.T) {
+	bts, rerr := server.ReadBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789")), 10)
+	require.Nil(t, rerr)
+	require.Equal(t, "0123456789", string(bts))
+
+	_, rerr = server.ReadBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789a")), 10)
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorBodyTooLarge.Type), rerr.ErrorName)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rerr.Status)
+}
+
+func TestRedactResult(t *testing.T) {
+	value := func(v string) *string { return &v }
+	result := &server.SessionResult{
+		Disclosed: [][]*irma.DisclosedAttribute{{
+			{Identifier: irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.bsn"), RawValue: value("123456789"), Value: irma.TranslatedString{"": "123456789", "en": "123456789"}},
+			{Identifier: irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email"), RawValue: value("a@example.com"), Value: irma.TranslatedString{"": "a@example.com"}},
+		}},
+		Signature: &irma.SignedMessage{Message: "message"},
+	}
+
+	conf := &server.Configuration{}
+	require.Equal(t, result, conf.RedactResult(result))
+	conf.RedactedAttributes = []string{"pbdf.pbdf.mobilenumber.*"}
+	require.Equal(t, result, conf.RedactResult(result))
+
+	conf.RedactedAttributes = []string{"pbdf.gemeente.*"}
+	redacted := conf.RedactResult(result)
+	require.Equal(t, server.RedactedValue, *redacted.Disclosed[0][0].RawValue)
+	require.Equal(t, irma.TranslatedString{"": server.RedactedValue, "en": server.RedactedValue}, redacted.Disclosed[0][0].Value)
+	require.Equal(t, "a@example.com", *redacted.Disclosed[0][1].RawValue)
+	require.Nil(t, redacted.Signature)
+
+	// The original result is left intact
+	require.Equal(t, "123456789", *result.Disclosed[0][0].RawValue)
+	require.NotNil(t, result.Signature)
+}
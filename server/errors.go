@@ -30,7 +30,21 @@ var (
 	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"}
 	ErrorUnknown              Error = Error{Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"}
 
-	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
-	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
-	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorUnsupported      Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
+	ErrorInvalidRequest   Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
+	ErrorProtocolVersion  Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorTooManySessions  Error = Error{Type: "TOO_MANY_SESSIONS", Status: 503, Description: "Too many sessions, try again later"}
+	ErrorPairingCodeWrong Error = Error{Type: "PAIRING_CODE_WRONG", Status: 403, Description: "Incorrect pairing code"}
+	ErrorPairingFailed    Error = Error{Type: "PAIRING_FAILED", Status: 403, Description: "Too many incorrect pairing codes"}
+	ErrorRequestTooLarge  Error = Error{Type: "REQUEST_TOO_LARGE", Status: 400, Description: "Session request contains too many disjunctions or attributes"}
+	ErrorInvalidJWT       Error = Error{Type: "INVALID_JWT", Status: 400, Description: "JWT signed with an unacceptable algorithm"}
+	ErrorBodyTooLarge     Error = Error{Type: "BODY_TOO_LARGE", Status: 413, Description: "HTTP request body too large"}
+	ErrorRateLimited      Error = Error{Type: "RATE_LIMITED", Status: 429, Description: "Too many requests, try again later"}
+	ErrorSSEDisabled      Error = Error{Type: "SSE_DISABLED", Status: 404, Description: "Server sent events are disabled, poll the status endpoint instead"}
+	ErrorRequestRejected  Error = Error{Type: "REQUEST_REJECTED", Status: 403, Description: "Session request rejected by the server"}
+	ErrorProofsRejected   Error = Error{Type: "PROOFS_REJECTED", Status: 400, Description: "Proofs not valid, try again"}
+	ErrorTooManyAttempts  Error = Error{Type: "TOO_MANY_ATTEMPTS", Status: 400, Description: "Proofs not valid and no attempts left"}
+	ErrorUnrequested      Error = Error{Type: "UNREQUESTED_ATTRIBUTES", Status: 400, Description: "Disclosed attributes that were not requested"}
+
+	ErrorDuplicateCorrelationID Error = Error{Type: "DUPLICATE_CORRELATION_ID", Status: 409, Description: "A session with this correlation ID already exists"}
 )
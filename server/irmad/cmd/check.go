@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/server/requestorserver"
@@ -20,21 +22,33 @@ Specify -v to see the configuration.`,
 		if err := configure(command); err != nil {
 			die(errors.WrapPrefix(err, "Failed to read configuration from file, args, or env vars", 0))
 		}
-
-		// Hack: temporarily disable scheme updating to prevent verifyConfiguration() from immediately updating schemes
-		enabled := conf.DisableSchemesUpdate
-		conf.DisableSchemesUpdate = true
-
-		if _, err := requestorserver.New(conf); err != nil {
+		if err := checkConfiguration(conf); err != nil {
 			die(errors.WrapPrefix(err, "Invalid configuration", 0))
 		}
 
-		conf.DisableSchemesUpdate = enabled // restore previous value before printing configuration
 		bts, _ := json.MarshalIndent(conf, "", "   ")
 		conf.Logger.Debug("Configuration: ", string(bts), "\n")
 	},
 }
 
+// checkConfiguration checks that the configuration is valid by constructing a server from it,
+// which also loads the schemes. Ports are not bound, and the schemes are not updated.
+func checkConfiguration(conf *requestorserver.Configuration) error {
+	// Hack: temporarily disable scheme updating to prevent verifyConfiguration() from immediately updating schemes
+	disabled := conf.DisableSchemesUpdate
+	conf.DisableSchemesUpdate = true
+	defer func() { conf.DisableSchemesUpdate = disabled }()
+
+	serv, err := requestorserver.New(conf)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = serv.Stop(ctx)
+	return nil
+}
+
 func init() {
 	RootCommand.AddCommand(CheckCommand)
 
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/spf13/cobra"
+)
+
+var CheckConfigCommand = &cobra.Command{
+	Use:   "check-config",
+	Short: "Check server configuration and schemes, and print a summary",
+	Long: `check-config reads the server configuration like the main command does, from a
+configuration file, command line flags, or environmental variables, validates it,
+and loads the IRMA schemes, without starting the server. If all is well, a summary
+of the configuration is printed. On any error it exits with a nonzero exit code,
+making it suitable for use in e.g. CI pipelines before deploying.`,
+	Run: func(command *cobra.Command, args []string) {
+		if err := configure(command); err != nil {
+			die(errors.WrapPrefix(err, "Failed to read configuration from file, args, or env vars", 0))
+		}
+		if err := checkConfiguration(conf); err != nil {
+			die(errors.WrapPrefix(err, "Invalid configuration", 0))
+		}
+		printConfigSummary(os.Stdout, conf)
+	},
+}
+
+// printConfigSummary writes a summary of the (checked) configuration to w.
+func printConfigSummary(w io.Writer, conf *requestorserver.Configuration) {
+	onOff := func(b bool) string {
+		if b {
+			return "enabled"
+		}
+		return "disabled"
+	}
+
+	fmt.Fprintln(w, "Configuration OK")
+	fmt.Fprintln(w, "  Production mode:         ", onOff(conf.Production))
+	fmt.Fprintln(w, "  Requestor authentication:", onOff(!conf.DisableRequestorAuthentication))
+	fmt.Fprintln(w, "  Requestors:              ", len(conf.Requestors))
+	fmt.Fprintln(w, "  TLS:                     ", onOff(conf.TlsCertificate != "" || conf.TlsCertificateFile != ""))
+	if conf.ClientPort != 0 {
+		fmt.Fprintln(w, "  Client TLS:              ", onOff(conf.ClientTlsCertificate != "" || conf.ClientTlsCertificateFile != ""))
+	}
+	fmt.Fprintln(w, "  Result JWTs:             ", onOff(conf.JwtPrivateKey != "" || conf.JwtPrivateKeyFile != ""))
+	fmt.Fprintln(w, "  Static sessions:         ", len(conf.StaticSessions))
+	fmt.Fprintln(w, "  Request templates:       ", len(conf.RequestTemplates))
+	fmt.Fprintln(w, "  Scheme updating:         ", onOff(!conf.DisableSchemesUpdate))
+	fmt.Fprintln(w, "  Server sent events:      ", onOff(conf.EnableSSE))
+	fmt.Fprintln(w, "  Metrics:                 ", onOff(conf.EnableMetrics))
+
+	if len(conf.SchemesPaths) > 1 {
+		fmt.Fprintln(w, "Schemes (merged from "+strings.Join(conf.SchemesPaths, ", ")+"):")
+	} else {
+		fmt.Fprintln(w, "Schemes (at "+conf.SchemesPath+"):")
+	}
+	var ids []string
+	for id := range conf.IrmaConfiguration.SchemeManagers {
+		ids = append(ids, id.String())
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		sm := conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier(id)]
+		fmt.Fprintf(w, "  %s: version %d, timestamp %s, status %s\n", id, sm.XMLVersion, sm.Timestamp.String(), sm.Status)
+	}
+}
+
+func init() {
+	RootCommand.AddCommand(CheckConfigCommand)
+
+	if err := setFlags(CheckConfigCommand, productionMode()); err != nil {
+		die(errors.WrapPrefix(err, "Failed to attach flags to "+CheckConfigCommand.Name()+" command", 0))
+	}
+}
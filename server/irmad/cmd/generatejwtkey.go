@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/spf13/cobra"
+)
+
+var GenerateJWTKeyCommand = &cobra.Command{
+	Use:   "generate-jwt-key",
+	Short: "Generate a keypair for JWTs",
+	Long: `generate-jwt-key generates a keypair for JWTs, writes the private and public key
+in PEM format to jwt_privkey.pem and jwt_pubkey.pem in the output directory, and
+prints how to refer to them in the configuration. The keypair can be used by the
+server to sign session results, or by a requestor to authenticate its session
+requests. Existing files are never overwritten, and the configuration is not
+modified.`,
+	Args: cobra.NoArgs,
+	Run: func(command *cobra.Command, args []string) {
+		flags := command.Flags()
+		typ, _ := flags.GetString("type")
+		bits, _ := flags.GetInt("bits")
+		dir, _ := flags.GetString("out")
+
+		// Only RSA keys are accepted by the server, both as JWT private key and as requestor key
+		if typ != "rsa" {
+			die(errors.Errorf("Unsupported key type %s, the server only supports RSA keys", typ))
+		}
+		if bits < 2048 {
+			logger.Warnf("Keys of %d bits are rejected by the server unless --min-jwt-key-bits is lowered", bits)
+		}
+
+		privpath, pubpath, err := generateJWTKey(bits, dir)
+		if err != nil {
+			die(errors.WrapPrefix(err, "Failed to generate JWT keypair", 0))
+		}
+
+		fmt.Printf(`Wrote private key to %s and public key to %s.
+
+For the server to sign session results with this keypair, add to the configuration:
+
+  jwt_privkey_file: %s
+
+Alternatively, for a requestor to authenticate with this keypair, give it the private key and add:
+
+  requestors:
+    myapp:
+      auth_method: publickey
+      key_file: %s
+`, privpath, pubpath, privpath, pubpath)
+	},
+}
+
+// generateJWTKey generates an RSA keypair of the specified size, and writes it in PEM format to
+// jwt_privkey.pem and jwt_pubkey.pem in the specified directory, returning the absolute paths.
+func generateJWTKey(bits int, dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	sk, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", "", err
+	}
+	pk, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	privpath, pubpath := filepath.Join(dir, "jwt_privkey.pem"), filepath.Join(dir, "jwt_pubkey.pem")
+	for _, path := range []string{privpath, pubpath} {
+		if _, err = os.Stat(path); err == nil {
+			return "", "", errors.Errorf("%s already exists, will not overwrite", path)
+		}
+	}
+	err = writePEM(privpath, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sk)}, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	if err = writePEM(pubpath, &pem.Block{Type: "PUBLIC KEY", Bytes: pk}, 0644); err != nil {
+		return "", "", err
+	}
+	return privpath, pubpath, nil
+}
+
+func writePEM(path string, block *pem.Block, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err = pem.Encode(f, block); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func init() {
+	RootCommand.AddCommand(GenerateJWTKeyCommand)
+
+	flags := GenerateJWTKeyCommand.Flags()
+	flags.String("type", "rsa", "key type (only rsa is supported)")
+	flags.Int("bits", 2048, "key size in bits")
+	flags.String("out", ".", "directory to write the key files to")
+}
@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/mitchellh/mapstructure"
@@ -24,6 +28,11 @@ var conf *requestorserver.Configuration
 var RootCommand = &cobra.Command{
 	Use:   "irmad",
 	Short: "IRMA server for verifying and issuing attributes",
+	Long: `irmad is an IRMA server for verifying and issuing attributes.
+
+On SIGHUP the configuration is read again, after which the requestors and
+permissions are reloaded and the IRMA schemes are updated, without dropping
+existing sessions. Changes to other options require a restart.`,
 	Run: func(command *cobra.Command, args []string) {
 		if err := configure(command); err != nil {
 			die(errors.WrapPrefix(err, "Failed to read configuration", 0))
@@ -36,6 +45,8 @@ var RootCommand = &cobra.Command{
 		stopped := make(chan struct{})
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
 
 		go func() {
 			if err := serv.Start(conf); err != nil {
@@ -49,10 +60,21 @@ var RootCommand = &cobra.Command{
 			select {
 			case <-interrupt:
 				conf.Logger.Debug("Caught interrupt")
-				serv.Stop() // causes serv.Start() above to return
+				timeout := time.Duration(viper.GetInt("shutdown-timeout")) * time.Second
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				if err := serv.Stop(ctx); err != nil { // causes serv.Start() above to return
+					_ = server.LogWarning(errors.WrapPrefix(err, "Failed to finish in-flight requests before shutdown", 0))
+				}
+				cancel()
 				conf.Logger.Debug("Sent stop signal to server")
+			case <-hangup:
+				conf.Logger.Info("Caught SIGHUP, reloading configuration")
+				if err := reload(command, serv); err != nil {
+					_ = server.LogError(errors.WrapPrefix(err, "Failed to reload configuration, continuing with previous configuration", 0))
+				}
 			case <-stopped:
 				conf.Logger.Info("Exiting")
+				signal.Stop(hangup)
 				close(stopped)
 				close(interrupt)
 				return
@@ -100,39 +122,79 @@ func setFlags(cmd *cobra.Command, production bool) error {
 
 	schemespath := server.DefaultSchemesPath()
 
-	flags.StringP("config", "c", "", "path to configuration file")
-	flags.StringP("schemes-path", "s", schemespath, "path to irma_configuration")
+	flags.StringP("config", "c", "", "path to configuration file (.json, .yaml or .toml)")
+	flags.StringP("schemes-path", "s", schemespath, "path to irma_configuration (comma-separated list of paths to merge, later ones taking precedence)")
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
 	flags.Bool("disable-schemes-update", false, "disable IRMA scheme updating")
+	flags.Int("schemes-update-jitter", 60, "delay each scheme update by a random amount of at most x seconds (0 to disable)")
+	flags.Int("schemes-update-backoff", 60, "retry a failed scheme update after x seconds, doubling after each consecutive failure (0 to disable)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
+	flags.String("health-path", "/health", "Host a health check endpoint at this path")
+	flags.StringSlice("cors-allow-origins", nil, "list of origins from which browsers may access the requestor endpoints (default *)")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects, \":port\" being replaced by --port value")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Int("sse-keepalive", 0, "if nonzero, send keepalive pings to server sent event listeners every x seconds")
+	flags.Bool("metrics", false, "Enable Prometheus metrics on sessions at /metrics, authenticated with --admin-token")
+	flags.Int("result-retention", 300, "keep the results of finished sessions available to requestors for this many seconds")
+	flags.Int("scan-timeout", 300, "time out sessions after this many seconds if the IRMA app does not connect")
+	flags.Int("interaction-timeout", 300, "time out sessions after this many seconds of inactivity once the IRMA app has connected")
+	flags.String("session-storage-path", "", "if specified, save sessions in this directory so that they survive a restart")
+	flags.StringSlice("allowed-return-urls", nil, "if specified, the returnUrl of session requests must start with one of these prefixes")
+	flags.Int("max-disjunctions", 100, "maximum amount of disjunctions in session requests")
+	flags.Int("max-attributes", 500, "maximum amount of attributes requested in session requests")
+	flags.Int("max-disclosure-attempts", 3, "amount of times the IRMA app may submit proofs lacking attributes or containing expired ones before the session fails")
+	flags.Int("max-signature-message-bytes", 1<<16, "maximum size in bytes of messages to be signed")
+	flags.Bool("signature-message-text", false, "require messages to be signed to be text (UTF-8 without control characters)")
+	flags.Bool("random-session-context", false, "use a random context instead of 1 in sessions whose request specifies none")
+	flags.Int("max-request-body-bytes", 1<<20, "maximum size in bytes of request bodies of session requests and IRMA app messages")
+	flags.Int("max-header-bytes", 1<<20, "maximum size in bytes of request headers")
+	flags.Int("max-credential-validity", 0, "maximum validity in days of issued credentials (0 for unlimited)")
+	flags.Int("default-credential-validity", 0, "validity in days of issued credentials if not specified in the request (default 6 months)")
+	flags.Bool("compression", false, "gzip responses to clients that accept it")
+	flags.Int("compression-min-bytes", 1024, "minimum size in bytes of responses to gzip")
+	flags.Int("session-create-rate-limit", 0, "maximum amount of sessions per minute that a single IP may start (0 to disable)")
+	flags.Int("session-create-burst", 0, "amount of sessions a single IP may start at once before the rate limit applies (default --session-create-rate-limit)")
+	flags.StringSlice("trusted-proxies", nil, "IPs or CIDR ranges of reverse proxies whose X-Forwarded-For header is trusted")
+	flags.Bool("derive-url-from-request", false, "use the host of the request starting a session in its QR instead of that of --url, if in --allowed-hosts")
+	flags.StringSlice("allowed-hosts", nil, "hosts (optionally with port) that may be used in session QRs with --derive-url-from-request")
+	flags.String("session-token-chars", "", "characters of which session tokens consist, at least 28 distinct letters, digits or underscores (default letters and digits)")
+	flags.Int("max-sessions", 0, "maximum amount of unfinished sessions, new sessions are refused beyond this (0 for unlimited)")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
 	flags.Int("client-port", 0, "if specified, start a separate server for the IRMA app at this port")
 	flags.String("client-listen-addr", "", "address at which server for IRMA app listens")
+	flags.String("debug-addr", "", "if specified (e.g. localhost:6060), serve pprof profiling data and session counts at this address, which must not be publicly reachable")
 	flags.Lookup("port").Header = `Server address and port to listen on`
 
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors (and reject all authenticated requests)")
-	flags.String("requestors", "", "requestor configuration (in JSON)")
+	flags.String("requestors", "", "requestor configuration (in JSON; in configuration files, in the format of that file; see also IRMASERVER_REQUESTORS_<n>_NAME)")
 	flags.StringSlice("disclose-perms", nil, "list of attributes that all requestors may verify (default *)")
 	flags.StringSlice("sign-perms", nil, "list of attributes that all requestors may request in signatures (default *)")
+	flags.StringSlice("disclose-values", nil, "list of attribute=value constraints on the values that all requestors may request (value may contain * wildcards)")
 	issHelp := "list of attributes that all requestors may issue"
 	if !production {
 		issHelp += " (default *)"
 	}
 	flags.StringSlice("issue-perms", nil, issHelp)
 	flags.String("static-sessions", "", "preconfigured static sessions (in JSON)")
+	flags.String("request-templates", "", "session request templates with which requestors can start sessions (in JSON)")
+	flags.String("admin-token", "", "token with which to authenticate to the admin endpoints /admin/sessions and /metrics (leave empty to disable)")
 	flags.Lookup("no-auth").Header = `Requestor authentication and default requestor permissions`
 
 	flags.StringP("jwt-issuer", "j", "irmaserver", "JWT issuer")
 	flags.String("jwt-privkey", "", "JWT private key")
 	flags.String("jwt-privkey-file", "", "path to JWT private key")
+	flags.StringSlice("jwt-privkey-files", nil, "paths to further JWT private keys whose public keys are published for key rotation")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
+	flags.Int("request-clock-skew", 15, "tolerated clock difference in seconds with requestors for the iat of session request JWTs, extending --max-request-age (0 to tolerate none)")
+	flags.Int("read-timeout", 10, "max time in seconds for reading the headers of a request, and for reading its body")
+	flags.Int("write-timeout", 120, "max time in seconds for responding to a request (server sent events and long-polling are exempt)")
+	flags.Int("idle-timeout", 120, "max time in seconds to keep idle keep-alive connections open")
+	flags.Int("min-jwt-key-bits", 2048, "minimum size in bits of the JWT private key and of requestor RSA public keys")
 	flags.Lookup("jwt-issuer").Header = `JWT configuration`
 
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -143,7 +205,7 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("client-tls-cert-file", "", "path to TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-privkey", "", "TLS private key for IRMA app server")
 	flags.String("client-tls-privkey-file", "", "path to TLS private key for IRMA app server")
-	flags.Bool("no-tls", false, "Disable TLS")
+	flags.Bool("no-tls", false, "Disable TLS (required in production mode without TLS certificate, e.g. if a reverse proxy provides TLS)")
 	flags.Lookup("tls-cert").Header = "TLS configuration (leave empty to disable TLS)"
 
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
@@ -153,7 +215,11 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.String("audit-log", "", "Append an audit entry in JSON format to this file for each finished session")
+	flags.Bool("audit-include-values", false, "Include disclosed attribute values in the audit log")
+	flags.StringSlice("redacted-attributes", nil, "attribute types (or patterns such as scheme.issuer.*) whose values are redacted in logs and in results not sent as signed JWT")
 	flags.Bool("production", false, "Production mode")
+	flags.Int("shutdown-timeout", 10, "on interrupt, wait at most this many seconds for in-flight requests to finish")
 	flags.Lookup("verbose").Header = `Other options`
 
 	return nil
@@ -169,7 +235,8 @@ func configure(cmd *cobra.Command) error {
 		return err
 	}
 
-	// Locate and read configuration file
+	// Locate and read configuration file. Viper determines the format from the file extension,
+	// so irmaserver.json, irmaserver.yaml (or .yml) and irmaserver.toml are all recognized.
 	confpath := viper.GetString("config")
 	if confpath != "" {
 		dir, file := filepath.Dir(confpath), filepath.Base(confpath)
@@ -205,47 +272,99 @@ func configure(cmd *cobra.Command) error {
 		if _, notfound := err.(viper.ConfigFileNotFoundError); notfound {
 			logger.Info("No configuration file found")
 		} else {
-			die(errors.WrapPrefix(err, "Failed to unmarshal configuration file at "+viper.ConfigFileUsed(), 0))
+			return errors.WrapPrefix(err, "Failed to unmarshal configuration file at "+viper.ConfigFileUsed(), 0)
 		}
 	} else {
 		logger.Info("Config file: ", viper.ConfigFileUsed())
 	}
 
+	// Multiple comma-separated schemes paths are merged into one IRMA configuration
+	schemesPath, schemesPaths := viper.GetString("schemes-path"), []string(nil)
+	if strings.Contains(schemesPath, ",") {
+		schemesPath, schemesPaths = "", strings.Split(schemesPath, ",")
+	}
+
+	schemesUpdateJitter, schemesUpdateBackoff := viper.GetInt("schemes-update-jitter"), viper.GetInt("schemes-update-backoff")
+	requestClockSkew := viper.GetInt("request-clock-skew")
+
 	// Read configuration from flags and/or environmental variables
 	conf = &requestorserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           viper.GetString("schemes-path"),
-			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
-			SchemesUpdateInterval: viper.GetInt("schemes-update"),
-			DisableSchemesUpdate:  viper.GetBool("disable-schemes-update") || viper.GetInt("schemes-update") == 0,
-			IssuerPrivateKeysPath: viper.GetString("privkeys"),
-			URL:                   viper.GetString("url"),
-			DisableTLS:            viper.GetBool("no-tls"),
-			Email:                 viper.GetString("email"),
-			EnableSSE:             viper.GetBool("sse"),
-			Verbose:               viper.GetInt("verbose"),
-			Quiet:                 viper.GetBool("quiet"),
-			LogJSON:               viper.GetBool("log-json"),
-			Logger:                logger,
-			Production:            viper.GetBool("production"),
+			SchemesPath:               schemesPath,
+			SchemesPaths:              schemesPaths,
+			SchemesAssetsPath:         viper.GetString("schemes-assets-path"),
+			SchemesUpdateInterval:     viper.GetInt("schemes-update"),
+			SchemesUpdateJitter:       &schemesUpdateJitter,
+			SchemesUpdateBackoff:      &schemesUpdateBackoff,
+			DisableSchemesUpdate:      viper.GetBool("disable-schemes-update") || viper.GetInt("schemes-update") == 0,
+			IssuerPrivateKeysPath:     viper.GetString("privkeys"),
+			URL:                       viper.GetString("url"),
+			DisableTLS:                viper.GetBool("no-tls"),
+			Email:                     viper.GetString("email"),
+			EnableSSE:                 viper.GetBool("sse"),
+			SSEKeepaliveInterval:      viper.GetInt("sse-keepalive"),
+			EnableMetrics:             viper.GetBool("metrics"),
+			MaxSessions:               viper.GetInt("max-sessions"),
+			MaxDisjunctions:           viper.GetInt("max-disjunctions"),
+			MaxAttributes:             viper.GetInt("max-attributes"),
+			MaxDisclosureAttempts:     viper.GetInt("max-disclosure-attempts"),
+			MaxSignatureMessageBytes:  viper.GetInt("max-signature-message-bytes"),
+			SignatureMessageText:      viper.GetBool("signature-message-text"),
+			RandomSessionContext:      viper.GetBool("random-session-context"),
+			MaxRequestBodyBytes:       viper.GetInt("max-request-body-bytes"),
+			SessionTokenChars:         viper.GetString("session-token-chars"),
+			MaxCredentialValidity:     viper.GetInt("max-credential-validity"),
+			DefaultCredentialValidity: viper.GetInt("default-credential-validity"),
+			SessionStoragePath:        viper.GetString("session-storage-path"),
+			ResultRetention:           viper.GetInt("result-retention"),
+			ScanTimeout:               viper.GetInt("scan-timeout"),
+			InteractionTimeout:        viper.GetInt("interaction-timeout"),
+			AllowedReturnURLs:         viper.GetStringSlice("allowed-return-urls"),
+			Verbose:                   viper.GetInt("verbose"),
+			Quiet:                     viper.GetBool("quiet"),
+			LogJSON:                   viper.GetBool("log-json"),
+			Logger:                    logger,
+			AuditIncludeValues:        viper.GetBool("audit-include-values"),
+			RedactedAttributes:        viper.GetStringSlice("redacted-attributes"),
+			Production:                viper.GetBool("production"),
 		},
 		Permissions: requestorserver.Permissions{
 			Disclosing: handlePermission("disclose-perms"),
 			Signing:    handlePermission("sign-perms"),
 			Issuing:    handlePermission("issue-perms"),
+
+			DisclosureValues: viper.GetStringSlice("disclose-values"),
 		},
 		ListenAddress:                  viper.GetString("listen-addr"),
 		Port:                           viper.GetInt("port"),
 		ClientListenAddress:            viper.GetString("client-listen-addr"),
+		DebugAddress:                   viper.GetString("debug-addr"),
 		ClientPort:                     viper.GetInt("client-port"),
 		DisableRequestorAuthentication: viper.GetBool("no-auth"),
 		Requestors:                     make(map[string]requestorserver.Requestor),
 		JwtIssuer:                      viper.GetString("jwt-issuer"),
 		JwtPrivateKey:                  viper.GetString("jwt-privkey"),
 		JwtPrivateKeyFile:              viper.GetString("jwt-privkey-file"),
+		JwtPrivateKeyFiles:             viper.GetStringSlice("jwt-privkey-files"),
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
+		RequestClockSkew:               &requestClockSkew,
+		ReadTimeout:                    viper.GetInt("read-timeout"),
+		WriteTimeout:                   viper.GetInt("write-timeout"),
+		IdleTimeout:                    viper.GetInt("idle-timeout"),
+		MaxHeaderBytes:                 viper.GetInt("max-header-bytes"),
+		EnableCompression:              viper.GetBool("compression"),
+		CompressionMinBytes:            viper.GetInt("compression-min-bytes"),
+		SessionCreateRateLimit:         viper.GetInt("session-create-rate-limit"),
+		SessionCreateBurst:             viper.GetInt("session-create-burst"),
+		TrustedProxies:                 viper.GetStringSlice("trusted-proxies"),
+		DeriveURLFromRequest:           viper.GetBool("derive-url-from-request"),
+		AllowedHosts:                   viper.GetStringSlice("allowed-hosts"),
+		MinJwtKeyBits:                  viper.GetInt("min-jwt-key-bits"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
+		HealthCheckPath:                viper.GetString("health-path"),
+		CorsAllowedOrigins:             viper.GetStringSlice("cors-allow-origins"),
+		AdminToken:                     viper.GetString("admin-token"),
 
 		TlsCertificate:           viper.GetString("tls-cert"),
 		TlsCertificateFile:       viper.GetString("tls-cert-file"),
@@ -257,6 +376,17 @@ func configure(cmd *cobra.Command) error {
 		ClientTlsPrivateKeyFile:  viper.GetString("client-tls-privkey-file"),
 	}
 
+	if path := viper.GetString("audit-log"); path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to open audit log", 0)
+		}
+		auditLogger := logrus.New()
+		auditLogger.Out = file
+		auditLogger.Formatter = &logrus.JSONFormatter{}
+		conf.AuditLogger = auditLogger
+	}
+
 	if conf.Production {
 		if !viper.GetBool("no-email") && conf.Email == "" {
 			return errors.New("In production mode it is required to specify either an email address with the --email flag, or explicitly opting out with --no-email. See help or README for more info.")
@@ -266,28 +396,35 @@ func configure(cmd *cobra.Command) error {
 		}
 	}
 
-	// Handle requestors
-	var requestors map[string]interface{}
-	if val, flagOrEnv := viper.Get("requestors").(string); !flagOrEnv || val != "" {
-		if requestors, err = cast.ToStringMapE(viper.Get("requestors")); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
-		}
+	if err = handleMapOrString("requestors", &conf.Requestors); err != nil {
+		return err
 	}
-	if len(requestors) > 0 {
-		if err := mapstructure.Decode(requestors, &conf.Requestors); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
-		}
+	if err = addEnvRequestors(os.Environ(), conf.Requestors); err != nil {
+		return err
 	}
-
 	if err = handleMapOrString("static-sessions", &conf.StaticSessions); err != nil {
 		return err
 	}
+	if err = handleMapOrString("request-templates", &conf.RequestTemplates); err != nil {
+		return err
+	}
 
 	logger.Debug("Done configuring")
 
 	return nil
 }
 
+// reload reads the configuration again and applies it to the running server.
+// See requestorserver.Server.Reload() for which options are reloaded.
+func reload(cmd *cobra.Command, serv *requestorserver.Server) error {
+	current := conf
+	defer func() { conf = current }() // the server keeps running with its current configuration
+	if err := configure(cmd); err != nil {
+		return err
+	}
+	return serv.Reload(conf)
+}
+
 func handleMapOrString(key string, dest interface{}) error {
 	var m map[string]interface{}
 	var err error
@@ -299,12 +436,105 @@ func handleMapOrString(key string, dest interface{}) error {
 	if len(m) == 0 {
 		return nil
 	}
-	if err := mapstructure.Decode(m, dest); err != nil {
+	if err := mapstructure.Decode(stringKeys(m), dest); err != nil {
 		return errors.WrapPrefix(err, "Failed to unmarshal "+key+" from config file", 0)
 	}
 	return nil
 }
 
+// stringKeys recursively converts all map[interface{}]interface{} within val, as produced by
+// viper when parsing YAML configuration files, to map[string]interface{}, as produced for JSON
+// and TOML configuration files. This way nested structures decode identically regardless of the
+// configuration file format, and remain marshalable to JSON.
+func stringKeys(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[cast.ToString(key)] = stringKeys(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = stringKeys(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = stringKeys(value)
+		}
+		return s
+	default:
+		return val
+	}
+}
+
+const envRequestorsPrefix = "IRMASERVER_REQUESTORS_"
+
+// addEnvRequestors adds the requestors specified in numbered environment variables to the map,
+// allowing requestors to be configured without a configuration file or JSON. For example:
+//
+//	IRMASERVER_REQUESTORS_0_NAME=myapp
+//	IRMASERVER_REQUESTORS_0_AUTH_METHOD=token
+//	IRMASERVER_REQUESTORS_0_KEY=eGE2PSomOT84amVVdTU
+//	IRMASERVER_REQUESTORS_0_DISCLOSE_PERMS=irma-demo.MijnOverheid.ageLower.*,pbdf.pbdf.email.*
+//
+// The variables after the number are named after the requestor options in configuration files,
+// and options taking a list are comma-separated.
+func addEnvRequestors(environ []string, requestors map[string]requestorserver.Requestor) error {
+	options := map[int]map[string]interface{}{}
+	for _, env := range environ {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], envRequestorsPrefix) {
+			continue
+		}
+		key := strings.SplitN(strings.TrimPrefix(parts[0], envRequestorsPrefix), "_", 2)
+		i, err := strconv.Atoi(key[0])
+		if err != nil || i < 0 || len(key) != 2 {
+			return errors.Errorf("Invalid requestor environment variable %s, expected %s<n>_<option>", parts[0], envRequestorsPrefix)
+		}
+		if options[i] == nil {
+			options[i] = map[string]interface{}{}
+		}
+		options[i][strings.ToLower(key[1])] = parts[1]
+	}
+
+	indices := make([]int, 0, len(options))
+	for i := range options {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	for _, i := range indices {
+		name, _ := options[i]["name"].(string)
+		if name == "" {
+			return errors.Errorf("%s%d_NAME not specified", envRequestorsPrefix, i)
+		}
+		if _, exists := requestors[name]; exists {
+			return errors.Errorf("Requestor %s specified more than once", name)
+		}
+		delete(options[i], "name")
+
+		var requestor requestorserver.Requestor
+		// Environment variables are strings, so we let them be parsed into e.g. numbers and booleans
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			DecodeHook:       mapstructure.StringToSliceHookFunc(","),
+			ErrorUnused:      true,
+			WeaklyTypedInput: true,
+			Result:           &requestor,
+		})
+		if err != nil {
+			return err
+		}
+		if err = decoder.Decode(options[i]); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal requestor "+name+" from env vars", 0)
+		}
+		requestors[name] = requestor
+	}
+	return nil
+}
+
 func handlePermission(typ string) []string {
 	if !viper.IsSet(typ) && (!viper.GetBool("production") || typ != "issue-perms") {
 		return []string{"*"}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+var configFiles = map[string]string{
+	"yaml": `
+requestors:
+  myapp:
+    auth_method: token
+    key: eGE2PSomOT84amVVdTU
+    disclose_perms: [ "irma-demo.MijnOverheid.ageLower.*" ]
+  otherapp:
+    auth_method: publickey
+    key_file: /path/to/otherapp.pem
+    issue_perms:
+      - irma-demo.MijnOverheid.root
+`,
+	"toml": `
+[requestors.myapp]
+auth_method = "token"
+key = "eGE2PSomOT84amVVdTU"
+disclose_perms = [ "irma-demo.MijnOverheid.ageLower.*" ]
+
+[requestors.otherapp]
+auth_method = "publickey"
+key_file = "/path/to/otherapp.pem"
+issue_perms = [ "irma-demo.MijnOverheid.root" ]
+`,
+	"json": `{
+	"requestors": {
+		"myapp": {
+			"auth_method": "token",
+			"key": "eGE2PSomOT84amVVdTU",
+			"disclose_perms": [ "irma-demo.MijnOverheid.ageLower.*" ]
+		},
+		"otherapp": {
+			"auth_method": "publickey",
+			"key_file": "/path/to/otherapp.pem",
+			"issue_perms": [ "irma-demo.MijnOverheid.root" ]
+		}
+	}
+}`,
+}
+
+func TestConfigFileRequestors(t *testing.T) {
+	for ext, contents := range configFiles {
+		t.Run(ext, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "irmad")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "irmaserver."+ext)
+			require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+			viper.Reset()
+			cmd := &cobra.Command{}
+			require.NoError(t, setFlags(cmd, false))
+			require.NoError(t, cmd.Flags().Set("config", path))
+			require.NoError(t, configure(cmd))
+
+			require.Equal(t, path, viper.ConfigFileUsed())
+			require.Len(t, conf.Requestors, 2)
+			require.Equal(t, requestorserver.Requestor{
+				Permissions: requestorserver.Permissions{
+					Disclosing: []string{"irma-demo.MijnOverheid.ageLower.*"},
+				},
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "eGE2PSomOT84amVVdTU",
+			}, conf.Requestors["myapp"])
+			require.Equal(t, requestorserver.Requestor{
+				Permissions: requestorserver.Permissions{
+					Issuing: []string{"irma-demo.MijnOverheid.root"},
+				},
+				AuthenticationMethod:  requestorserver.AuthenticationMethodPublicKey,
+				AuthenticationKeyFile: "/path/to/otherapp.pem",
+			}, conf.Requestors["otherapp"])
+		})
+	}
+}
+
+func TestEnvRequestors(t *testing.T) {
+	env := map[string]string{
+		"IRMASERVER_REQUESTORS_0_NAME":           "myapp",
+		"IRMASERVER_REQUESTORS_0_AUTH_METHOD":    "token",
+		"IRMASERVER_REQUESTORS_0_KEY":            "eGE2PSomOT84amVVdTU",
+		"IRMASERVER_REQUESTORS_0_DISCLOSE_PERMS": "irma-demo.MijnOverheid.ageLower.*,pbdf.pbdf.email.*",
+		"IRMASERVER_REQUESTORS_1_NAME":           "otherapp",
+		"IRMASERVER_REQUESTORS_1_AUTH_METHOD":    "publickey",
+		"IRMASERVER_REQUESTORS_1_KEY_FILE":       "/path/to/otherapp.pem",
+		"IRMASERVER_REQUESTORS_1_ISSUE_PERMS":    "irma-demo.MijnOverheid.root",
+	}
+	for key, value := range env {
+		require.NoError(t, os.Setenv(key, value))
+		defer os.Unsetenv(key)
+	}
+
+	viper.Reset()
+	cmd := &cobra.Command{}
+	require.NoError(t, setFlags(cmd, false))
+	require.NoError(t, configure(cmd))
+
+	require.Equal(t, map[string]requestorserver.Requestor{
+		"myapp": {
+			Permissions: requestorserver.Permissions{
+				Disclosing: []string{"irma-demo.MijnOverheid.ageLower.*", "pbdf.pbdf.email.*"},
+			},
+			AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+			AuthenticationKey:    "eGE2PSomOT84amVVdTU",
+		},
+		"otherapp": {
+			Permissions: requestorserver.Permissions{
+				Issuing: []string{"irma-demo.MijnOverheid.root"},
+			},
+			AuthenticationMethod:  requestorserver.AuthenticationMethodPublicKey,
+			AuthenticationKeyFile: "/path/to/otherapp.pem",
+		},
+	}, conf.Requestors)
+}
+
+func TestEnvRequestorsTyped(t *testing.T) {
+	requestors := map[string]requestorserver.Requestor{}
+	require.NoError(t, addEnvRequestors([]string{
+		"IRMASERVER_REQUESTORS_0_NAME=myapp",
+		"IRMASERVER_REQUESTORS_0_AUTH_METHOD=token",
+		"IRMASERVER_REQUESTORS_0_KEY=eGE2PSomOT84amVVdTU",
+		"IRMASERVER_REQUESTORS_0_DEDUPE_WINDOW=10",
+		"IRMASERVER_REQUESTORS_0_CAN_ISSUE=false",
+	}, requestors))
+
+	requestor := requestors["myapp"]
+	require.Equal(t, 10, requestor.DedupeWindow)
+	require.NotNil(t, requestor.CanIssue)
+	require.False(t, *requestor.CanIssue)
+	require.Nil(t, requestor.CanDisclose)
+}
+
+func TestEnvRequestorsInvalid(t *testing.T) {
+	for _, environ := range [][]string{
+		{"IRMASERVER_REQUESTORS_0_AUTH_METHOD=token"},
+		{"IRMASERVER_REQUESTORS_0_NAME=myapp", "IRMASERVER_REQUESTORS_0_UNKNOWN=value"},
+		{"IRMASERVER_REQUESTORS_X_NAME=myapp"},
+		{"IRMASERVER_REQUESTORS_0_NAME=myapp", "IRMASERVER_REQUESTORS_1_NAME=myapp"},
+		{"IRMASERVER_REQUESTORS_0_NAME=myapp", "IRMASERVER_REQUESTORS_0_DEDUPE_WINDOW=ten"},
+	} {
+		require.Error(t, addEnvRequestors(environ, map[string]requestorserver.Requestor{}), "environment %v", environ)
+	}
+}
+
+func TestGenerateJWTKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irmad")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	privpath, pubpath, err := generateJWTKey(2048, dir)
+	require.NoError(t, err)
+
+	bts, err := ioutil.ReadFile(privpath)
+	require.NoError(t, err)
+	block, _ := pem.Decode(bts)
+	require.NotNil(t, block)
+	sk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, 2048, sk.N.BitLen())
+
+	bts, err = ioutil.ReadFile(pubpath)
+	require.NoError(t, err)
+	block, _ = pem.Decode(bts)
+	require.NotNil(t, block)
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, &sk.PublicKey, pk)
+
+	// Existing keys are not overwritten
+	_, _, err = generateJWTKey(2048, dir)
+	require.Error(t, err)
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	irmaconf, err := irma.NewConfigurationReadOnly(filepath.Join("..", "..", "..", "testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+	conf := &requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			IrmaConfiguration: irmaconf,
+			Logger:            server.NewLogger(0, true, false),
+		},
+		DisableRequestorAuthentication: true,
+		Port:                           8088,
+	}
+
+	// Scheme updating is disabled only while checking
+	require.NoError(t, checkConfiguration(conf))
+	require.False(t, conf.DisableSchemesUpdate)
+
+	var summary bytes.Buffer
+	printConfigSummary(&summary, conf)
+	require.Regexp(t, "Requestor authentication: +disabled", summary.String())
+	require.Regexp(t, "Scheme updating: +enabled", summary.String())
+	require.Contains(t, summary.String(), "  irma-demo: version")
+
+	conf.Port = 0
+	require.Error(t, checkConfiguration(conf))
+	require.False(t, conf.DisableSchemesUpdate)
+}
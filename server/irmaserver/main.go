@@ -5,8 +5,9 @@
 package irmaserver
 
 import (
-	"io/ioutil"
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
@@ -17,6 +18,7 @@ import (
 // Server is an irmaserver instance.
 type Server struct {
 	*servercore.Server
+	conf     *server.Configuration
 	handlers map[string]SessionHandler
 }
 
@@ -41,6 +43,7 @@ func New(conf *server.Configuration) (*Server, error) {
 	}
 	return &Server{
 		Server:   s,
+		conf:     conf,
 		handlers: make(map[string]SessionHandler),
 	}, nil
 }
@@ -62,7 +65,17 @@ func StartSession(request interface{}, handler SessionHandler) (*irma.Qr, string
 	return s.StartSession(request, handler)
 }
 func (s *Server) StartSession(request interface{}, handler SessionHandler) (*irma.Qr, string, error) {
-	qr, token, err := s.Server.StartSession(request)
+	return s.StartSessionContext(context.Background(), request, nil, handler)
+}
+
+// StartSessionContext is like StartSession, using the specified options (e.g. the requestor on
+// whose behalf the session is started) if not nil, and passing ctx (e.g. that of the HTTP request
+// of the requestor) to the session store.
+func StartSessionContext(ctx context.Context, request interface{}, opts *server.SessionOptions, handler SessionHandler) (*irma.Qr, string, error) {
+	return s.StartSessionContext(ctx, request, opts, handler)
+}
+func (s *Server) StartSessionContext(ctx context.Context, request interface{}, opts *server.SessionOptions, handler SessionHandler) (*irma.Qr, string, error) {
+	qr, token, err := s.Server.StartSessionContext(ctx, request, opts)
 	if err != nil {
 		return nil, "", err
 	}
@@ -72,6 +85,25 @@ func (s *Server) StartSession(request interface{}, handler SessionHandler) (*irm
 	return qr, token, nil
 }
 
+// StartDisclosureSession starts a disclosure session in which the user must disclose each of the
+// specified attributes, running the handler on completion, if specified. For more complex
+// requests, see irma.NewDisclosureRequest() and irma.DisclosureRequest.AddDisjunction().
+func StartDisclosureSession(handler SessionHandler, attrs ...irma.AttributeTypeIdentifier) (*irma.Qr, string, error) {
+	return s.StartDisclosureSession(handler, attrs...)
+}
+func (s *Server) StartDisclosureSession(handler SessionHandler, attrs ...irma.AttributeTypeIdentifier) (*irma.Qr, string, error) {
+	return s.StartSession(irma.NewDisclosureRequest(attrs...), handler)
+}
+
+// ValidateRequest parses and validates the session request like StartSession does, returning
+// the parsed request, without starting a session.
+func ValidateRequest(request interface{}) (irma.RequestorRequest, error) {
+	return s.ValidateRequest(request)
+}
+func (s *Server) ValidateRequest(request interface{}) (irma.RequestorRequest, error) {
+	return s.Server.ValidateRequest(request)
+}
+
 // GetSessionResult retrieves the result of the specified IRMA session.
 func GetSessionResult(token string) *server.SessionResult {
 	return s.GetSessionResult(token)
@@ -88,7 +120,42 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	return s.Server.GetRequest(token)
 }
 
-// CancelSession cancels the specified IRMA session.
+// GetPairingCode retrieves the code that the user must enter in the IRMA app before the specified
+// IRMA session proceeds, if pairing is enabled for the session.
+func GetPairingCode(token string) string {
+	return s.GetPairingCode(token)
+}
+func (s *Server) GetPairingCode(token string) string {
+	return s.Server.GetPairingCode(token)
+}
+
+// WaitStatus blocks until the status of the specified IRMA session differs from the specified
+// status, or until the timeout has passed, and then returns the current status of the session.
+func WaitStatus(token string, status server.Status, timeout time.Duration) (server.Status, error) {
+	return s.WaitStatus(token, status, timeout)
+}
+func (s *Server) WaitStatus(token string, status server.Status, timeout time.Duration) (server.Status, error) {
+	return s.Server.WaitStatus(token, status, timeout)
+}
+
+// SessionCount returns the amount of IRMA sessions currently known to the server.
+func SessionCount() int {
+	return s.SessionCount()
+}
+func (s *Server) SessionCount() int {
+	return s.Server.SessionCount()
+}
+
+// Sessions returns information about all IRMA sessions currently known to the server.
+func Sessions() []server.SessionInfo {
+	return s.Sessions()
+}
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.Server.Sessions()
+}
+
+// CancelSession cancels the specified IRMA session. It returns an error if the session is
+// unknown or already finished.
 func CancelSession(token string) error {
 	return s.CancelSession(token)
 }
@@ -120,25 +187,28 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 		var message []byte
 		var err error
 		if r.Method == http.MethodPost {
-			if message, err = ioutil.ReadAll(r.Body); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			var rerr *irma.RemoteError
+			if message, rerr = server.ReadBody(w, r, s.conf.MaxRequestBodyBytes); rerr != nil {
+				server.WriteResponse(w, nil, rerr)
 				return
 			}
 		}
 
 		token, noun, err := servercore.ParsePath(r.URL.Path)
 		if err == nil && noun == "statusevents" { // if err != nil we let it be handled by HandleProtocolMessage below
+			if !s.conf.EnableSSE {
+				server.WriteError(w, server.ErrorSSEDisabled, "")
+				return
+			}
 			if err = s.SubscribeServerSentEvents(w, r, token, false); err != nil {
-				server.WriteResponse(w, nil, &irma.RemoteError{
-					Status:      server.ErrorUnsupported.Status,
-					ErrorName:   string(server.ErrorUnsupported.Type),
-					Description: server.ErrorUnsupported.Description,
-				})
+				server.WriteResponse(w, nil, irma.NewRemoteError(
+					server.ErrorUnsupported.Status, string(server.ErrorUnsupported.Type), server.ErrorUnsupported.Description, "",
+				))
 			}
 			return
 		}
 
-		status, response, result := s.HandleProtocolMessage(r.URL.Path, r.Method, r.Header, message)
+		status, response, result := s.HandleProtocolMessageContext(r.Context(), r.URL.Path, r.Method, r.Header, message)
 		w.WriteHeader(status)
 		_, err = w.Write(response)
 		if err != nil {
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/privacybydesign/irmago"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is a prometheus.Collector that keeps track of the IRMA sessions of a server: the amount
+// of currently active sessions, and the amount of sessions that have been created and finished
+// (per status), all labeled by session type.
+type Metrics struct {
+	active   *prometheus.GaugeVec
+	created  *prometheus.CounterVec
+	finished *prometheus.CounterVec
+}
+
+// NewMetrics returns a new Metrics instance.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "irma",
+			Subsystem: "server",
+			Name:      "sessions_active",
+			Help:      "Amount of sessions currently in the session store.",
+		}, []string{"action"}),
+		created: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "irma",
+			Subsystem: "server",
+			Name:      "sessions_created_total",
+			Help:      "Amount of sessions started.",
+		}, []string{"action"}),
+		finished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "irma",
+			Subsystem: "server",
+			Name:      "sessions_finished_total",
+			Help:      "Amount of sessions finished, by final status.",
+		}, []string{"action", "status"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.active.Describe(ch)
+	m.created.Describe(ch)
+	m.finished.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.active.Collect(ch)
+	m.created.Collect(ch)
+	m.finished.Collect(ch)
+}
+
+// SessionCreated registers a new session of the specified type.
+func (m *Metrics) SessionCreated(action irma.Action) {
+	m.active.WithLabelValues(string(action)).Inc()
+	m.created.WithLabelValues(string(action)).Inc()
+}
+
+// SessionFinished registers that a session of the specified type reached the specified final status.
+func (m *Metrics) SessionFinished(action irma.Action, status Status) {
+	m.finished.WithLabelValues(string(action), string(status)).Inc()
+}
+
+// SessionDeleted registers that a session of the specified type was removed from the session store.
+func (m *Metrics) SessionDeleted(action irma.Action) {
+	m.active.WithLabelValues(string(action)).Dec()
+}
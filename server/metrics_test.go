@@ -0,0 +1,40 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := server.NewMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+
+	metrics.SessionCreated(irma.ActionDisclosing)
+	metrics.SessionCreated(irma.ActionDisclosing)
+	metrics.SessionCreated(irma.ActionIssuing)
+	metrics.SessionFinished(irma.ActionDisclosing, server.StatusDone)
+	metrics.SessionFinished(irma.ActionIssuing, server.StatusCancelled)
+	metrics.SessionDeleted(irma.ActionDisclosing)
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	for _, line := range []string{
+		`irma_server_sessions_active{action="disclosing"} 1`,
+		`irma_server_sessions_active{action="issuing"} 1`,
+		`irma_server_sessions_created_total{action="disclosing"} 2`,
+		`irma_server_sessions_created_total{action="issuing"} 1`,
+		`irma_server_sessions_finished_total{action="disclosing",status="DONE"} 1`,
+		`irma_server_sessions_finished_total{action="issuing",status="CANCELLED"} 1`,
+	} {
+		require.Contains(t, w.Body.String(), line+"\n")
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/privacybydesign/irmago"
+)
+
+// RedactedValue replaces the values of attributes matched by Configuration.RedactedAttributes.
+const RedactedValue = "[redacted]"
+
+// MatchesAttribute returns whether the attribute type is matched by any of the patterns, each of
+// which is either the attribute type itself, or a wildcard pattern of the form *, scheme.*,
+// scheme.issuer.*, or scheme.issuer.credential.*.
+func MatchesAttribute(attr irma.AttributeTypeIdentifier, patterns []string) bool {
+	cred := attr.CredentialTypeIdentifier()
+	for _, pattern := range patterns {
+		if pattern == "*" ||
+			pattern == attr.Root()+".*" ||
+			pattern == cred.IssuerIdentifier().String()+".*" ||
+			pattern == cred.String()+".*" ||
+			pattern == attr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacts returns whether the values of attributes of the specified type must be redacted.
+func (conf *Configuration) Redacts(attr irma.AttributeTypeIdentifier) bool {
+	return MatchesAttribute(attr, conf.RedactedAttributes)
+}
+
+// RedactResult returns a copy of the session result in which the values of disclosed attributes
+// matched by RedactedAttributes are replaced by RedactedValue. As the attribute-based signature of
+// signature sessions contains the attribute values, it is removed from the copy if any attribute
+// was redacted. If no attribute needs to be redacted, the result itself is returned.
+func (conf *Configuration) RedactResult(result *SessionResult) *SessionResult {
+	redact := false
+	for _, attrs := range result.Disclosed {
+		for _, attr := range attrs {
+			redact = redact || conf.Redacts(attr.Identifier)
+		}
+	}
+	if !redact {
+		return result
+	}
+
+	cpy := *result
+	cpy.Signature = nil
+	cpy.Disclosed = make([][]*irma.DisclosedAttribute, len(result.Disclosed))
+	for i, attrs := range result.Disclosed {
+		cpy.Disclosed[i] = make([]*irma.DisclosedAttribute, len(attrs))
+		for j, attr := range attrs {
+			cpy.Disclosed[i][j] = redactAttribute(attr, conf.Redacts(attr.Identifier))
+		}
+	}
+	return &cpy
+}
+
+func redactAttribute(attr *irma.DisclosedAttribute, redact bool) *irma.DisclosedAttribute {
+	if !redact || attr.RawValue == nil {
+		return attr
+	}
+	cpy := *attr
+	value := RedactedValue
+	cpy.RawValue = &value
+	cpy.Value = make(irma.TranslatedString, len(attr.Value))
+	for lang := range attr.Value {
+		cpy.Value[lang] = RedactedValue
+	}
+	return &cpy
+}
@@ -1,6 +1,9 @@
 package requestorserver
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -30,6 +33,16 @@ type Authenticator interface {
 	) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError)
 }
 
+// RequestAuthenticator authenticates requestors in a custom way, e.g. using mutual TLS or HTTP
+// headers set by a reverse proxy. If set as the Authenticator of the Configuration, it replaces
+// the built-in authentication methods: session requests must then be posted as JSON, and are
+// passed to Authenticate after parsing.
+type RequestAuthenticator interface {
+	// Authenticate returns the name of the requestor that sent the HTTP request, which is used
+	// in permission checks and logging, or an error if the requestor could not be authenticated.
+	Authenticate(r *http.Request, request irma.RequestorRequest) (requestor string, err error)
+}
+
 type AuthenticationMethod string
 
 // Currently supported requestor authentication methods
@@ -41,19 +54,29 @@ const (
 )
 
 type HmacAuthenticator struct {
-	hmackeys      map[string]interface{}
+	hmackeys      map[string][]jwtKey
+	algorithms    map[string][]string
 	maxRequestAge int
+	clockSkew     int
 }
 type PublicKeyAuthenticator struct {
-	publickeys    map[string]interface{}
+	publickeys    map[string][]jwtKey
+	algorithms    map[string][]string
 	maxRequestAge int
+	clockSkew     int
+	minKeyBits    int
 }
 type PresharedKeyAuthenticator struct {
 	presharedkeys map[string]string
 }
 type NilAuthenticator struct{}
 
-var authenticators map[AuthenticationMethod]Authenticator
+// JWT signature algorithms supported by the JWT-based authenticators. The first one is accepted
+// by default; requestors may be configured to accept others.
+var (
+	hmacAlgorithms = []string{jwt.SigningMethodHS256.Name, jwt.SigningMethodHS384.Name, jwt.SigningMethodHS512.Name}
+	rsaAlgorithms  = []string{jwt.SigningMethodRS256.Name, jwt.SigningMethodRS384.Name, jwt.SigningMethodRS512.Name}
+)
 
 func (NilAuthenticator) Authenticate(
 	headers http.Header, body []byte,
@@ -75,44 +98,54 @@ func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 func (hauth *HmacAuthenticator) Authenticate(
 	headers http.Header, body []byte,
 ) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, hmacAlgorithms, hauth.algorithms, hauth.hmackeys, hauth.maxRequestAge, hauth.clockSkew)
 }
 
 func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
+	keys, err := requestor.keys(name)
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		return err
 	}
-
-	// We accept any of the base64 encodings
-	bts, err = fs.Base64Decode(bts)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to base64 decode hmac key of requestor "+name, 0)
+	if hauth.algorithms[name], err = requestor.jwtAlgorithms(name, hmacAlgorithms); err != nil {
+		return err
 	}
 
-	hauth.hmackeys[name] = bts
+	for _, bts := range keys {
+		// We accept any of the base64 encodings
+		bts, err = fs.Base64Decode(bts)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to base64 decode hmac key of requestor "+name, 0)
+		}
+		hauth.hmackeys[name] = append(hauth.hmackeys[name], jwtKey{id: hmacKeyThumbprint(bts), key: bts})
+	}
 	return nil
-
 }
 
 func (pkauth *PublicKeyAuthenticator) Authenticate(
 	headers http.Header, body []byte,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, rsaAlgorithms, pkauth.algorithms, pkauth.publickeys, pkauth.maxRequestAge, pkauth.clockSkew)
 }
 
 func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
+	keys, err := requestor.keys(name)
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		return err
 	}
-
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(bts)
-	if err != nil {
+	if pkauth.algorithms[name], err = requestor.jwtAlgorithms(name, rsaAlgorithms); err != nil {
 		return err
 	}
-	pkauth.publickeys[name] = pk
 
+	for _, bts := range keys {
+		pk, err := jwt.ParseRSAPublicKeyFromPEM(bts)
+		if err != nil {
+			return err
+		}
+		if err = checkRSAKeySize("Public key of requestor "+name, pk, pkauth.minKeyBits); err != nil {
+			return err
+		}
+		pkauth.publickeys[name] = append(pkauth.publickeys[name], jwtKey{id: jwkThumbprint(pk), key: pk})
+	}
 	return nil
 }
 
@@ -135,39 +168,85 @@ func (pskauth *PresharedKeyAuthenticator) Authenticate(
 }
 
 func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
+	keys, err := requestor.keys(name)
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		return err
+	}
+	for _, bts := range keys {
+		pskauth.presharedkeys[string(bts)] = name
 	}
-	pskauth.presharedkeys[string(bts)] = name
 	return nil
 }
 
 // Helper functions
 
-// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
-func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (interface{}, error) {
-	return func(token *jwt.Token) (interface{}, error) {
-		var ok bool
-		kid, ok := token.Header["kid"]
-		if !ok {
-			kid = token.Claims.(*jwt.StandardClaims).Issuer
-		}
-		requestor, ok := kid.(string)
-		if !ok {
-			return nil, errors.New("requestor name was not a string")
+// jwtKey is a key of a requestor against which its JWTs are verified. As the "kid" header of
+// requestor JWTs contains the requestor name, the id of the key (its JWK thumbprint) is only
+// used to refer to it in error messages.
+type jwtKey struct {
+	id  string
+	key interface{}
+}
+
+// jwtVerify verifies the JWT against the keys of its requestor, which is determined using the
+// "kid" header or else the issuer, and returns the requestor. As a requestor may have multiple
+// keys during key rotation, the keys are tried in order until one of them matches.
+func jwtVerify(parser *jwt.Parser, j string, claims *jwt.StandardClaims, keys map[string][]jwtKey) (string, error) {
+	token, _, err := parser.ParseUnverified(j, claims)
+	if err != nil {
+		return "", err
+	}
+	kid, ok := token.Header["kid"]
+	if !ok {
+		kid = claims.Issuer
+	}
+	requestor, ok := kid.(string)
+	if !ok {
+		return "", errors.New("requestor name was not a string")
+	}
+	requestorKeys, ok := keys[requestor]
+	if !ok {
+		return "", errors.Errorf("Unknown requestor: %s", requestor)
+	}
+
+	ids := make([]string, 0, len(requestorKeys))
+	for _, key := range requestorKeys {
+		k := key.key
+		if _, err = parser.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) { return k, nil }); err == nil {
+			return requestor, nil
 		}
-		token.Claims.(*jwt.StandardClaims).Issuer = requestor
-		if pk, ok := publickeys[requestor]; ok {
-			return pk, nil
+		ids = append(ids, key.id)
+	}
+	return "", errors.Errorf("JWT of requestor %s could not be verified against any of its keys (tried kids %s): %s",
+		requestor, strings.Join(ids, ", "), err.Error())
+}
+
+// jwtAlgorithms returns the JWT signature algorithms accepted from the requestor, which must be
+// among the supported algorithms of its authentication method.
+func (r Requestor) jwtAlgorithms(name string, supported []string) ([]string, error) {
+	if len(r.AllowedAlgorithms) == 0 {
+		return supported[:1], nil
+	}
+	for _, alg := range r.AllowedAlgorithms {
+		if !contains(supported, alg) {
+			return nil, errors.Errorf("Requestor %s has unsupported JWT algorithm %s (supported algorithms: %s)",
+				name, alg, strings.Join(supported, ", "))
 		}
-		return nil, errors.Errorf("Unknown requestor: %s", requestor)
 	}
+	return r.AllowedAlgorithms, nil
+}
+
+// hmacKeyThumbprint computes the JWK thumbprint (RFC 7638) of the HMAC key.
+func hmacKeyThumbprint(key []byte) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf(`{"k":"%s","kty":"oct"}`, base64.RawURLEncoding.EncodeToString(key))))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
 
 // jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
+// The time-based claims of the JWT are checked allowing for a clock difference of clockSkew seconds
+// with the requestor.
 func jwtAuthenticate(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlgs []string, allowedAlgs map[string][]string, keys map[string][]jwtKey, maxRequestAge, clockSkew int,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	// Read JWT and check its type
 	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "text/plain") {
@@ -179,10 +258,14 @@ func jwtAuthenticate(
 	// inspecting the JWT header here, before the signature is verified (which is done below). I suppose
 	// it would be more idiomatic to have the KeyFunc which is fed to jwt.ParseWithClaims() perform this
 	// task, but then the KeyFunc would need access to all public keys here instead of the ones belonging
-	// to the signature algorithm we are expecting (specified by signatureAlg). Security-wise it makes no
+	// to the signature algorithms we are expecting (specified by signatureAlgs). Security-wise it makes no
 	// difference: either way the alg header is examined before the signature is verified.
 	alg, err := jwtSignatureAlg(requestorJwt)
-	if err != nil || alg != signatureAlg {
+	if err == nil && alg == jwt.SigningMethodNone.Alg() {
+		// Unsigned JWTs are never acceptable, so we reject them here explicitly
+		return true, nil, "", server.RemoteError(server.ErrorInvalidJWT, "unsigned JWT (alg none) not accepted")
+	}
+	if err != nil || !contains(signatureAlgs, alg) {
 		// If err != nil, ie. we failed to determine the JWT signature algorithm, we assume that the
 		// request is not meant for this authenticator. So we don't return err
 		return false, nil, "", nil
@@ -191,24 +274,39 @@ func jwtAuthenticate(
 	// Verify JWT signature. We do not yet store the JWT contents here, because we need to know the session type first
 	// before we can construct a struct instance of the appropriate type into which to unmarshal the JWT contents.
 	claims := &jwt.StandardClaims{}
-	_, err = jwt.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
+	parser := new(jwt.Parser)
+	parser.SkipClaimsValidation = true // We verify the time-based claims on our own below so we can add leeway
+	requestor, err := jwtVerify(parser, requestorJwt, claims, keys)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		// The error may contain requestor names and key ids, which we only log and do not return to
+		// the unauthenticated caller
+		_ = server.LogWarning(err)
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, "JWT could not be verified")
+	}
+	if !contains(allowedAlgs[requestor], alg) {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidJWT,
+			fmt.Sprintf("JWT algorithm %s not accepted from requestor %s", alg, requestor))
 	}
-	if !claims.VerifyIssuedAt(time.Now().Unix(), true) {
+	now, skew := time.Now(), time.Duration(clockSkew)*time.Second
+	if !claims.VerifyExpiresAt(now.Add(-skew).Unix(), false) {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt expired")
+	}
+	if !claims.VerifyIssuedAt(now.Add(skew).Unix(), true) || !claims.VerifyNotBefore(now.Add(skew).Unix(), false) {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt not yet valid")
 	}
-	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
+	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge)*time.Second + skew).Before(now) {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
 
 	// Read JWT contents
 	parsedJwt, err := irma.ParseRequestorJwt(claims.Subject, requestorJwt)
+	if serr, ok := err.(*irma.SessionError); ok && serr.ErrorType == irma.ErrorUnknownAction {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, "unknown session type "+serr.Info)
+	}
 	if err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 
-	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
 	return true, parsedJwt.RequestorRequest(), requestor, nil
 }
 
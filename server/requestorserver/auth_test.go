@@ -0,0 +1,167 @@
+package requestorserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJwtClockSkew(t *testing.T) {
+	key := []byte("secret")
+	auth := &HmacAuthenticator{
+		hmackeys:      map[string][]jwtKey{"requestor": {{id: hmacKeyThumbprint(key), key: key}}},
+		algorithms:    map[string][]string{"requestor": {jwt.SigningMethodHS256.Name}},
+		maxRequestAge: 300,
+		clockSkew:     15,
+	}
+	headers := http.Header{"Content-Type": []string{"text/plain"}}
+	requestJwt := func(iat time.Time) []byte {
+		contents := irma.NewServiceProviderJwt("requestor", irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		))
+		contents.IssuedAt = irma.Timestamp(iat)
+		j, err := jwt.NewWithClaims(jwt.SigningMethodHS256, contents).SignedString(key)
+		require.NoError(t, err)
+		return []byte(j)
+	}
+
+	applies, _, requestor, rerr := auth.Authenticate(headers, requestJwt(time.Now().Add(10*time.Second)))
+	require.True(t, applies)
+	require.Nil(t, rerr)
+	require.Equal(t, "requestor", requestor)
+	_, _, _, rerr = auth.Authenticate(headers, requestJwt(time.Now().Add(20*time.Second)))
+	require.NotNil(t, rerr)
+	require.Equal(t, "jwt not yet valid", rerr.Message)
+
+	_, _, _, rerr = auth.Authenticate(headers, requestJwt(time.Now().Add(-310*time.Second)))
+	require.Nil(t, rerr)
+	_, _, _, rerr = auth.Authenticate(headers, requestJwt(time.Now().Add(-320*time.Second)))
+	require.NotNil(t, rerr)
+	require.Equal(t, "jwt too old", rerr.Message)
+}
+
+func TestJwtKeyRotation(t *testing.T) {
+	auth := &HmacAuthenticator{hmackeys: map[string][]jwtKey{}, algorithms: map[string][]string{}, maxRequestAge: 300}
+	newKey, oldKey := []byte("new secret"), []byte("old secret")
+	require.NoError(t, auth.Initialize("requestor", Requestor{
+		AuthenticationKey:  base64.StdEncoding.EncodeToString(newKey),
+		AuthenticationKeys: []string{base64.StdEncoding.EncodeToString(oldKey)},
+	}))
+	require.Len(t, auth.hmackeys["requestor"], 2)
+
+	headers := http.Header{"Content-Type": []string{"text/plain"}}
+	requestJwt := func(key []byte) []byte {
+		contents := irma.NewServiceProviderJwt("requestor", irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		))
+		j, err := jwt.NewWithClaims(jwt.SigningMethodHS256, contents).SignedString(key)
+		require.NoError(t, err)
+		return []byte(j)
+	}
+
+	// JWTs signed with any of the keys are accepted
+	for _, key := range [][]byte{newKey, oldKey} {
+		_, _, requestor, rerr := auth.Authenticate(headers, requestJwt(key))
+		require.Nil(t, rerr)
+		require.Equal(t, "requestor", requestor)
+	}
+
+	// The key ids are logged, but not returned to the caller
+	_, _, _, rerr := auth.Authenticate(headers, requestJwt([]byte("other secret")))
+	require.NotNil(t, rerr)
+	require.Equal(t, "JWT could not be verified", rerr.Message)
+	require.NotContains(t, rerr.Message, hmacKeyThumbprint(newKey))
+	_, err := jwtVerify(new(jwt.Parser), string(requestJwt([]byte("other secret"))), &jwt.StandardClaims{}, auth.hmackeys)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), hmacKeyThumbprint(newKey)+", "+hmacKeyThumbprint(oldKey))
+}
+
+func TestJwtAlgorithms(t *testing.T) {
+	key := []byte("secret")
+	auth := &HmacAuthenticator{hmackeys: map[string][]jwtKey{}, algorithms: map[string][]string{}, maxRequestAge: 300}
+	require.NoError(t, auth.Initialize("requestor", Requestor{AuthenticationKey: base64.StdEncoding.EncodeToString(key)}))
+	require.Equal(t, []string{jwt.SigningMethodHS256.Name}, auth.algorithms["requestor"])
+
+	headers := http.Header{"Content-Type": []string{"text/plain"}}
+	contents := irma.NewServiceProviderJwt("requestor", irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	))
+
+	// An unsigned JWT with otherwise valid contents is rejected
+	j, err := jwt.NewWithClaims(jwt.SigningMethodNone, contents).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	applies, _, _, rerr := auth.Authenticate(headers, []byte(j))
+	require.True(t, applies)
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorInvalidJWT.Type), rerr.ErrorName)
+
+	// Algorithms other than HS256 are only accepted when configured
+	j, err = jwt.NewWithClaims(jwt.SigningMethodHS512, contents).SignedString(key)
+	require.NoError(t, err)
+	_, _, _, rerr = auth.Authenticate(headers, []byte(j))
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorInvalidJWT.Type), rerr.ErrorName)
+	auth.algorithms["requestor"] = []string{jwt.SigningMethodHS512.Name}
+	_, _, _, rerr = auth.Authenticate(headers, []byte(j))
+	require.Nil(t, rerr)
+
+	// Algorithms of another authentication method cannot be configured
+	require.Error(t, auth.Initialize("other", Requestor{
+		AuthenticationKey: base64.StdEncoding.EncodeToString(key),
+		AllowedAlgorithms: []string{jwt.SigningMethodRS256.Name},
+	}))
+}
+
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request, request irma.RequestorRequest) (string, error) {
+	if requestor := r.Header.Get("X-Requestor"); requestor != "" {
+		return requestor, nil
+	}
+	return "", errors.New("X-Requestor header missing")
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	s := &Server{conf: &Configuration{
+		Configuration: &server.Configuration{Logger: logrus.New(), MaxRequestBodyBytes: 1 << 20},
+		Requestors: map[string]Requestor{
+			"requestor": {Permissions: Permissions{Disclosing: []string{"irma-demo.*"}}},
+		},
+		Authenticator: headerAuthenticator{},
+	}}
+	body, err := json.Marshal(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	post := func(requestor string) (string, bool, int) {
+		r := httptest.NewRequest(http.MethodPost, "/session", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if requestor != "" {
+			r.Header.Set("X-Requestor", requestor)
+		}
+		w := httptest.NewRecorder()
+		_, name, ok := s.authorizedRequest(w, r)
+		return name, ok, w.Code
+	}
+
+	requestor, ok, _ := post("requestor")
+	require.True(t, ok)
+	require.Equal(t, "requestor", requestor)
+
+	// The requestor name returned by the authenticator is used in permission checks
+	_, ok, code := post("other")
+	require.False(t, ok)
+	require.Equal(t, server.ErrorUnauthorized.Status, code)
+	_, ok, code = post("")
+	require.False(t, ok)
+	require.Equal(t, server.ErrorUnauthorized.Status, code)
+}
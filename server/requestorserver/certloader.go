@@ -0,0 +1,101 @@
+package requestorserver
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/sirupsen/logrus"
+)
+
+// certificateLoader provides the TLS certificate to the TLS server, rereading the certificate
+// and private key whenever the modification time of their files changes, so that rotated
+// certificates (e.g. mounted secrets) are picked up without restarting the server.
+type certificateLoader struct {
+	sync.Mutex
+	cert, certfile string
+	key, keyfile   string
+	logger         *logrus.Logger
+
+	certificate  *tls.Certificate
+	certModified time.Time
+	keyModified  time.Time
+	lastWarning  time.Time
+}
+
+func newCertificateLoader(cert, certfile, key, keyfile string, logger *logrus.Logger) (*certificateLoader, error) {
+	l := &certificateLoader{cert: cert, certfile: certfile, key: key, keyfile: keyfile, logger: logger}
+	certModified, keyModified, err := l.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err = l.load(certModified, keyModified); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate. If the certificate or private key file
+// changed since they were last read they are reread; if that fails, e.g. because only one of
+// them has been replaced yet, the previous certificate is used.
+func (l *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	certModified, keyModified, err := l.modified()
+	if err == nil && certModified.Equal(l.certModified) && keyModified.Equal(l.keyModified) {
+		return l.certificate, nil
+	}
+	if err == nil {
+		err = l.load(certModified, keyModified)
+	}
+	if err != nil && time.Since(l.lastWarning) > time.Minute {
+		// Don't flood the logs, as this happens on each TLS handshake until fixed
+		l.lastWarning = time.Now()
+		l.logger.Warn("Failed to reload TLS certificate, using previous certificate: ", err.Error())
+	}
+	return l.certificate, nil
+}
+
+// modified returns the modification times of the certificate and private key files, or zero
+// times for those given inline.
+func (l *certificateLoader) modified() (cert, key time.Time, err error) {
+	if cert, err = modTime(l.certfile); err != nil {
+		return
+	}
+	key, err = modTime(l.keyfile)
+	return
+}
+
+func modTime(path string) (time.Time, error) {
+	if path == "" {
+		return time.Time{}, nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// load reads and parses the certificate and private key. The caller must hold the lock once the
+// loader is in use.
+func (l *certificateLoader) load(certModified, keyModified time.Time) error {
+	certbts, err := fs.ReadKey(l.cert, l.certfile)
+	if err != nil {
+		return err
+	}
+	keybts, err := fs.ReadKey(l.key, l.keyfile)
+	if err != nil {
+		return err
+	}
+	cer, err := tls.X509KeyPair(certbts, keybts)
+	if err != nil {
+		return err
+	}
+	l.certificate = &cer
+	l.certModified, l.keyModified = certModified, keyModified
+	return nil
+}
@@ -0,0 +1,120 @@
+package requestorserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+type clientIPKey struct{}
+
+// ClientIP returns the IP address of the client that sent the request. Within the handlers of the
+// server this takes the configured trusted proxies into account; elsewhere, or if no proxies are
+// trusted, it is the IP address from r.RemoteAddr.
+func ClientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// clientIPHandler is middleware that determines the IP address of the client of each request,
+// for use by ClientIP.
+func (s *Server) clientIPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, s.conf.clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP determines the IP address of the client that sent the request. If the request comes
+// from a trusted proxy, the X-Forwarded-For header is walked from right to left, skipping trusted
+// proxies, and the first untrusted address is returned.
+func (conf *Configuration) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if ip == nil || !conf.trustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fwdip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fwdip == nil {
+			break // don't trust anything to the left of a malformed entry
+		}
+		ip = fwdip
+		if !conf.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// requestHost returns the host to use in session QRs for the specified request, or the empty
+// string if the host of the configured URL should be used.
+func (conf *Configuration) requestHost(r *http.Request) string {
+	if !conf.DeriveURLFromRequest {
+		return ""
+	}
+	host := r.Host
+	if ip := remoteIP(r); ip != nil && conf.trustedProxy(ip) && r.Header.Get("X-Forwarded-Host") != "" {
+		// Proxies append to the header, so the last entry was added by the proxy closest to us
+		forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-Host"], ","), ",")
+		host = strings.TrimSpace(forwarded[len(forwarded)-1])
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range conf.AllowedHosts {
+		if strings.EqualFold(allowed, host) || strings.EqualFold(allowed, hostname) {
+			return host
+		}
+	}
+	conf.Logger.WithField("host", host).Warn("Session requested at host not in allowed_hosts, using configured URL")
+	return ""
+}
+
+func (conf *Configuration) trustedProxy(ip net.IP) bool {
+	for _, network := range conf.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// parseTrustedProxies parses the trusted proxies, which are either CIDR ranges or single IPs.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid trusted proxy "+proxy, 0)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
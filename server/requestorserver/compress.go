@@ -0,0 +1,143 @@
+package requestorserver
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressHandler is middleware that gzips responses of at least CompressionMinBytes bytes if
+// compression is enabled and the client accepts it, except for server sent event streams.
+func (s *Server) compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.conf.EnableCompression || strings.HasSuffix(r.URL.Path, "/statusevents") || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, min: s.conf.CompressionMinBytes}
+		next.ServeHTTP(cw, r)
+		_ = cw.close()
+	})
+}
+
+// compressWriter buffers the response until it is at least min bytes large, after which it
+// writes the response gzipped. Smaller responses are written uncompressed when closed, as are
+// responses that the handler already encoded itself (i.e. that have a Content-Encoding header),
+// and responses that the handler flushes before min bytes are written.
+type compressWriter struct {
+	http.ResponseWriter
+	min    int
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	raw    bool // whether the response is being written uncompressed
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	if cw.raw {
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) < cw.min {
+		return len(b), nil
+	}
+
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" {
+		if err := cw.writeRaw(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if header.Get("Content-Type") == "" {
+		// Sniff the content type from the uncompressed instead of from the compressed response
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	cw.ResponseWriter.WriteHeader(cw.statusCode())
+
+	cw.gz = gzip.NewWriter(cw.ResponseWriter)
+	buf := cw.buf
+	cw.buf = nil
+	if _, err := cw.gz.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush sends the response written so far to the client. If the response is not yet being
+// compressed, it is written uncompressed.
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		_ = cw.gz.Flush()
+	} else if !cw.raw {
+		_ = cw.writeRaw()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeRaw writes the header and the buffered response uncompressed, after which the rest of
+// the response is also written uncompressed.
+func (cw *compressWriter) writeRaw() error {
+	cw.raw = true
+	cw.ResponseWriter.WriteHeader(cw.statusCode())
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) close() error {
+	if cw.gz != nil {
+		return cw.gz.Close()
+	}
+	if cw.raw {
+		return nil
+	}
+	if len(cw.buf) > 0 {
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+	}
+	cw.ResponseWriter.WriteHeader(cw.statusCode())
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	return err
+}
+
+func (cw *compressWriter) statusCode() int {
+	if cw.status == 0 {
+		return http.StatusOK
+	}
+	return cw.status
+}
+
+// acceptsGzip returns whether the Accept-Encoding header of the request allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
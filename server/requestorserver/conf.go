@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
@@ -26,6 +27,8 @@ type Configuration struct {
 	// can submit session requests. If true, the request is first authenticated against the
 	// server configuration before the server accepts it.
 	DisableRequestorAuthentication bool `json:"no_auth" mapstructure:"no_auth"`
+	// Custom requestor authentication, replacing the built-in authentication methods if set
+	Authenticator RequestAuthenticator `json:"-" mapstructure:"-"`
 
 	// Address to listen at
 	ListenAddress string `json:"listen_addr" mapstructure:"listen_addr"`
@@ -47,6 +50,11 @@ type Configuration struct {
 	ClientTlsPrivateKey      string `json:"client_tls_privkey" mapstructure:"client_tls_privkey"`
 	ClientTlsPrivateKeyFile  string `json:"client_tls_privkey_file" mapstructure:"client_tls_privkey_file"`
 
+	// If specified (e.g. localhost:6060), serve profiling data (net/http/pprof) and session counts
+	// (expvar) at this address. This exposes internals of the server, so the address must not be
+	// publicly reachable.
+	DebugAddress string `json:"debug_addr" mapstructure:"debug_addr"`
+
 	// Requestor-specific permission and authentication configuration
 	RequestorsString string               `json:"-" mapstructure:"requestors"`
 	Requestors       map[string]Requestor `json:"requestors"`
@@ -57,9 +65,20 @@ type Configuration struct {
 	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Further private keys for key rotation. These are not used for signing, but their public keys are
+	// published at /jwks.json along with that of the private key above.
+	JwtPrivateKeys     []string `json:"jwt_privkeys" mapstructure:"jwt_privkeys"`
+	JwtPrivateKeyFiles []string `json:"jwt_privkey_files" mapstructure:"jwt_privkey_files"`
 
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
+	// Tolerated difference in seconds between the clocks of the server and of requestors (default nil
+	// means 15, 0 tolerates no difference). A session request JWT may have an iat up to this many
+	// seconds in the future, and may be at most MaxRequestAge plus this many seconds old.
+	RequestClockSkew *int `json:"request_clock_skew" mapstructure:"request_clock_skew"`
+
+	// Minimum size in bits of the JWT private key and of the RSA public keys of requestors (default 2048)
+	MinJwtKeyBits int `json:"min_jwt_key_bits" mapstructure:"min_jwt_key_bits"`
 
 	// Host files under this path as static files (leave empty to disable)
 	StaticPath string `json:"static_path" mapstructure:"static_path"`
@@ -68,8 +87,59 @@ type Configuration struct {
 
 	StaticSessions map[string]interface{} `json:"static_sessions"`
 
-	staticSessions map[string]irma.RequestorRequest
-	jwtPrivateKey  *rsa.PrivateKey
+	// Session request templates with which requestors can start sessions by name
+	RequestTemplates map[string]RequestTemplate `json:"request_templates"`
+
+	// Origins from which browsers may access the requestor endpoints (default, or if empty: *)
+	CorsAllowedOrigins []string `json:"cors_allow_origins" mapstructure:"cors_allow_origins"`
+
+	// Token with which the admin endpoints (/admin/sessions, and /metrics if EnableMetrics is set)
+	// are authenticated, using the Authorization HTTP header, optionally as a bearer token. If
+	// empty, the admin endpoints are disabled.
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+
+	// Path at which a health check endpoint is hosted (default /health)
+	HealthCheckPath string `json:"health_path" mapstructure:"health_path"`
+
+	// Maximum time in seconds for reading the headers of a request, and for reading its body
+	// (default 10). Server sent event requests are exempt.
+	ReadTimeout int `json:"read_timeout" mapstructure:"read_timeout"`
+	// Maximum time in seconds after which the response to a request is replaced by a 503 error
+	// (default 120). Server sent event streams and long-polling status requests are exempt.
+	WriteTimeout int `json:"write_timeout" mapstructure:"write_timeout"`
+	// Maximum time in seconds to wait for the next request on a keep-alive connection (default 120)
+	IdleTimeout int `json:"idle_timeout" mapstructure:"idle_timeout"`
+	// Maximum size in bytes of the headers of a request (default 0 means 1 MB)
+	MaxHeaderBytes int `json:"max_header_bytes" mapstructure:"max_header_bytes"`
+
+	// Gzip responses of at least CompressionMinBytes bytes (default 1024) to clients that accept it.
+	// Server sent event streams are never compressed.
+	EnableCompression   bool `json:"enable_compression" mapstructure:"enable_compression"`
+	CompressionMinBytes int  `json:"compression_min_bytes" mapstructure:"compression_min_bytes"`
+
+	// Maximum amount of sessions per minute that a single IP may start (0 to disable)
+	SessionCreateRateLimit int `json:"session_create_rate_limit" mapstructure:"session_create_rate_limit"`
+	// Amount of sessions that a single IP may start at once before the rate limit applies
+	// (default: equal to session_create_rate_limit)
+	SessionCreateBurst int `json:"session_create_burst" mapstructure:"session_create_burst"`
+	// IPs or CIDR ranges of reverse proxies, whose X-Forwarded-For header is used to determine the IP
+	// of clients. If empty, X-Forwarded-For is ignored.
+	TrustedProxies []string `json:"trusted_proxies" mapstructure:"trusted_proxies"`
+
+	// If true, the host in the URL in session QRs is taken from the request that started the
+	// session (its Host header, or X-Forwarded-Host if sent by a trusted proxy), for servers
+	// reachable under multiple hostnames. Hosts not in AllowedHosts get the configured URL.
+	DeriveURLFromRequest bool `json:"derive_url_from_request" mapstructure:"derive_url_from_request"`
+	// Hosts, optionally including a port, that may be used in session QRs if
+	// derive_url_from_request is enabled
+	AllowedHosts []string `json:"allowed_hosts" mapstructure:"allowed_hosts"`
+
+	staticSessions   map[string]irma.RequestorRequest
+	requestTemplates map[string]*requestTemplate
+	jwtPrivateKey    *rsa.PrivateKey
+	jwtKeyID         string
+	jwtPublicKeys    []jwk
+	trustedProxies   []*net.IPNet
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
@@ -77,6 +147,13 @@ type Permissions struct {
 	Disclosing []string `json:"disclose_perms" mapstructure:"disclose_perms"`
 	Signing    []string `json:"sign_perms" mapstructure:"sign_perms"`
 	Issuing    []string `json:"issue_perms" mapstructure:"issue_perms"`
+
+	// Constraints of the form attribute=value on the values that may be requested for the
+	// specified attributes, in all session types; the value may contain * wildcards. If one or
+	// more constraints are present for an attribute, it may only be requested with a value
+	// matching one of them. The constraints of a requestor are combined with the global ones, so
+	// for an attribute constrained by both, values matching either are allowed.
+	DisclosureValues []string `json:"disclose_values" mapstructure:"disclose_values"`
 }
 
 // Requestor contains all configuration (disclosure or verification permissions and authentication)
@@ -87,6 +164,71 @@ type Requestor struct {
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+
+	// JWT signature algorithms accepted from the requestor (default HS256 or RS256, depending on
+	// the authentication method)
+	AllowedAlgorithms []string `json:"allowed_algs" mapstructure:"allowed_algs"`
+
+	// Further keys of the requestor for key rotation, which are accepted as well as the key above
+	AuthenticationKeys     []string `json:"keys" mapstructure:"keys"`
+	AuthenticationKeyFiles []string `json:"key_files" mapstructure:"key_files"`
+
+	// Whether the requestor may start disclosure, signature and issuance sessions at all (default
+	// true). These are checked before the attribute permissions, so that for example a requestor
+	// with can_issue set to false cannot issue even if the global issuing permissions allow it.
+	CanDisclose *bool `json:"can_disclose" mapstructure:"can_disclose"`
+	CanSign     *bool `json:"can_sign" mapstructure:"can_sign"`
+	CanIssue    *bool `json:"can_issue" mapstructure:"can_issue"`
+
+	// If positive, an identical session request from this requestor within this many seconds of
+	// the previous one returns the session started by the previous one, as long as no client
+	// has connected to it yet, instead of starting a new session (default 0: disabled).
+	DedupeWindow int `json:"dedupe_window" mapstructure:"dedupe_window"`
+
+	// Custom validation of the session requests of this requestor, applied after the permissions
+	// (use RequestFilter of the server configuration to validate the requests of all requestors)
+	Validator RequestValidator `json:"-" mapstructure:"-"`
+}
+
+// keys returns the contents of all authentication keys of the requestor.
+func (r Requestor) keys(name string) ([][]byte, error) {
+	var keys [][]byte
+	// The key or key_file may be omitted if the requestor has other keys
+	if r.AuthenticationKey != "" || r.AuthenticationKeyFile != "" ||
+		(len(r.AuthenticationKeys) == 0 && len(r.AuthenticationKeyFiles) == 0) {
+		bts, err := fs.ReadKey(r.AuthenticationKey, r.AuthenticationKeyFile)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		}
+		keys = append(keys, bts)
+	}
+	for _, key := range r.AuthenticationKeys {
+		keys = append(keys, []byte(key))
+	}
+	for _, file := range r.AuthenticationKeyFiles {
+		bts, err := fs.ReadKey("", file)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		}
+		keys = append(keys, bts)
+	}
+	return keys, nil
+}
+
+// CanStart returns whether or not the specified requestor may start sessions of the specified
+// type, regardless of the attributes or credentials involved.
+func (conf *Configuration) CanStart(requestor string, action irma.Action) bool {
+	var allowed *bool
+	r := conf.Requestors[requestor]
+	switch action {
+	case irma.ActionDisclosing:
+		allowed = r.CanDisclose
+	case irma.ActionSigning:
+		allowed = r.CanSign
+	case irma.ActionIssuing:
+		allowed = r.CanIssue
+	}
+	return allowed == nil || *allowed
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -130,16 +272,18 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 		return false, ""
 	}
 
+	// Copy the constraints, so that we do not write into the backing array of the requestor's slice
+	constraints := make([]string, 0, len(conf.Requestors[requestor].DisclosureValues)+len(conf.DisclosureValues))
+	constraints = append(constraints, conf.Requestors[requestor].DisclosureValues...)
+	constraints = append(constraints, conf.DisclosureValues...)
 	err := disjunctions.Iterate(func(attr *irma.AttributeRequest) error {
-		if contains(permissions, "*") ||
-			contains(permissions, attr.Type.Root()+".*") ||
-			contains(permissions, attr.Type.CredentialTypeIdentifier().IssuerIdentifier().String()+".*") ||
-			contains(permissions, attr.Type.CredentialTypeIdentifier().String()+".*") ||
-			contains(permissions, attr.Type.String()) {
-			return nil
-		} else {
+		if !MatchesPermission(attr.Type, permissions) {
 			return errors.New(attr.Type.String())
 		}
+		if !valueAllowed(constraints, attr) {
+			return errors.New(attr.Type.String() + ": requested value not allowed")
+		}
+		return nil
 	})
 	if err != nil {
 		return false, err.Error()
@@ -147,13 +291,90 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 	return true, ""
 }
 
+// MatchesPermission returns whether the attribute type is matched by any of the permissions,
+// each of which is either the attribute type itself, or a wildcard pattern of the form *,
+// scheme.*, scheme.issuer.*, or scheme.issuer.credential.*.
+func MatchesPermission(attr irma.AttributeTypeIdentifier, perms []string) bool {
+	return server.MatchesAttribute(attr, perms)
+}
+
+// valueAllowed returns whether the value requested for the attribute, if any, matches the value
+// constraints for its attribute type, if any.
+func valueAllowed(constraints []string, attr *irma.AttributeRequest) bool {
+	constrained := false
+	for _, constraint := range constraints {
+		parts := strings.SplitN(constraint, "=", 2)
+		if len(parts) != 2 || parts[0] != attr.Type.String() {
+			continue
+		}
+		constrained = true
+		if attr.Value != nil && matchWildcard(parts[1], *attr.Value) {
+			return true
+		}
+	}
+	return !constrained
+}
+
+// matchWildcard returns whether value matches pattern, in which * matches any sequence of characters.
+func matchWildcard(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+const (
+	defaultRequestClockSkew = 15 // seconds
+	defaultReadTimeout      = 10
+	defaultWriteTimeout     = 120
+	defaultIdleTimeout      = 120
+
+	defaultCompressionMinBytes = 1024
+)
+
 func (conf *Configuration) initialize() error {
+	if conf.MinJwtKeyBits == 0 {
+		conf.MinJwtKeyBits = defaultMinJwtKeyBits
+	}
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = defaultReadTimeout
+	}
+	if conf.WriteTimeout == 0 {
+		conf.WriteTimeout = defaultWriteTimeout
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = defaultIdleTimeout
+	}
+	if conf.CompressionMinBytes == 0 {
+		conf.CompressionMinBytes = defaultCompressionMinBytes
+	}
+	if conf.SessionCreateBurst == 0 {
+		conf.SessionCreateBurst = conf.SessionCreateRateLimit
+	}
+	proxies, err := parseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	conf.trustedProxies = proxies
 	if err := conf.readPrivateKey(); err != nil {
 		return err
 	}
 
-	if conf.DisableRequestorAuthentication {
-		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
+	if conf.Authenticator != nil {
+		conf.Logger.Info("Using custom requestor authentication")
+	} else if conf.DisableRequestorAuthentication {
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys, err := conf.HavePrivateKeys()
 		if err != nil {
@@ -166,41 +387,6 @@ func (conf *Configuration) initialize() error {
 				return errors.New("If issuing is enabled in production mode, requestor authentication must be enabled, or client_listen_addr and client_port must be used")
 			}
 		}
-	} else {
-		if len(conf.Requestors) == 0 {
-			return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
-		}
-		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
-		}
-
-		// Initialize authenticators
-		for name, requestor := range conf.Requestors {
-			authenticator, ok := authenticators[requestor.AuthenticationMethod]
-			if !ok {
-				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
-					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
-			}
-			if err := authenticator.Initialize(name, requestor); err != nil {
-				return err
-			}
-		}
-	}
-
-	if conf.Port <= 0 || conf.Port > 65535 {
-		return errors.Errorf("Port must be between 1 and 65535 (was %d)", conf.Port)
-	}
-
-	if conf.ClientPort != 0 && conf.ClientPort == conf.Port {
-		return errors.New("If client_port is given it must be different from port")
-	}
-	if conf.ClientPort < 0 || conf.ClientPort > 65535 {
-		return errors.Errorf("client_port must be between 0 and 65535 (was %d)", conf.ClientPort)
-	}
-	if conf.ClientListenAddress != "" && conf.ClientPort == 0 {
-		return errors.New("client_listen_addr must be combined with a nonzero client_port")
 	}
 
 	tlsConf, err := conf.tlsConfig()
@@ -228,6 +414,13 @@ func (conf *Configuration) initialize() error {
 		}
 	}
 
+	if conf.HealthCheckPath == "" {
+		conf.HealthCheckPath = "/health"
+	}
+	if conf.HealthCheckPath[0] != '/' {
+		return errors.New("health_path must start with a slash, was " + conf.HealthCheckPath)
+	}
+
 	if conf.URL != "" {
 		if !strings.HasSuffix(conf.URL, "/") {
 			conf.URL = conf.URL + "/"
@@ -277,9 +470,191 @@ func (conf *Configuration) initialize() error {
 		conf.staticSessions[name] = rrequest
 	}
 
+	return conf.parseRequestTemplates()
+}
+
+// requestClockSkew returns RequestClockSkew, or its default if it is not set.
+func (conf *Configuration) requestClockSkew() int {
+	if conf.RequestClockSkew == nil {
+		return defaultRequestClockSkew
+	}
+	return *conf.RequestClockSkew
+}
+
+// authenticators returns the authenticators with which session requests are authenticated: none
+// if a custom authenticator is configured, the NilAuthenticator if requestor authentication is
+// disabled, and otherwise those of the configured requestors.
+func (conf *Configuration) authenticators() (map[AuthenticationMethod]Authenticator, error) {
+	switch {
+	case conf.Authenticator != nil:
+		return nil, nil
+	case conf.DisableRequestorAuthentication:
+		return map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}, nil
+	default:
+		return conf.newAuthenticators()
+	}
+}
+
+// newAuthenticators constructs and initializes authenticators for all configured requestors.
+func (conf *Configuration) newAuthenticators() (map[AuthenticationMethod]Authenticator, error) {
+	if len(conf.Requestors) == 0 {
+		return nil, errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
+	}
+	auths := map[AuthenticationMethod]Authenticator{
+		AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string][]jwtKey{}, algorithms: map[string][]string{}, maxRequestAge: conf.MaxRequestAge, clockSkew: conf.requestClockSkew()},
+		AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string][]jwtKey{}, algorithms: map[string][]string{}, maxRequestAge: conf.MaxRequestAge, clockSkew: conf.requestClockSkew(), minKeyBits: conf.MinJwtKeyBits},
+		AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
+	}
+
+	// Initialize authenticators
+	for name, requestor := range conf.Requestors {
+		authenticator, ok := auths[requestor.AuthenticationMethod]
+		if !ok {
+			return nil, errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
+				name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
+		}
+		if err := authenticator.Initialize(name, requestor); err != nil {
+			return nil, err
+		}
+	}
+	return auths, nil
+}
+
+// Validate checks the configuration for invalid values and for options that depend on each other
+// but are not (all) specified. All problems encountered are listed in the returned error.
+func (conf *Configuration) Validate() error {
+	if conf.Configuration == nil {
+		return errors.New("No server configuration specified")
+	}
+
+	var errs []string
+	if conf.SchemesUpdateInterval < 0 {
+		errs = append(errs, fmt.Sprintf("schemes_update must not be negative (was %d)", conf.SchemesUpdateInterval))
+	}
+	for name, requestor := range conf.Requestors {
+		if requestor.DedupeWindow < 0 {
+			errs = append(errs, fmt.Sprintf("dedupe_window of requestor %s must not be negative (was %d)", name, requestor.DedupeWindow))
+		}
+	}
+	if (conf.SchemesUpdateJitter != nil && *conf.SchemesUpdateJitter < 0) ||
+		(conf.SchemesUpdateBackoff != nil && *conf.SchemesUpdateBackoff < 0) {
+		errs = append(errs, "schemes_update_jitter and schemes_update_backoff must not be negative")
+	}
+	if conf.MinJwtKeyBits < 0 {
+		errs = append(errs, fmt.Sprintf("min_jwt_key_bits must not be negative (was %d)", conf.MinJwtKeyBits))
+	}
+	if conf.RequestClockSkew != nil && *conf.RequestClockSkew < 0 {
+		errs = append(errs, fmt.Sprintf("request_clock_skew must not be negative (was %d)", *conf.RequestClockSkew))
+	}
+	if conf.MaxDisjunctions < 0 || conf.MaxAttributes < 0 {
+		errs = append(errs, "max_disjunctions and max_attributes must not be negative")
+	}
+	if conf.MaxCredentialValidity < 0 || conf.DefaultCredentialValidity < 0 {
+		errs = append(errs, "max_credential_validity and default_credential_validity must not be negative")
+	}
+	if conf.MaxCredentialValidity > 0 && conf.DefaultCredentialValidity > conf.MaxCredentialValidity {
+		errs = append(errs, "default_credential_validity must not exceed max_credential_validity")
+	}
+	if conf.MaxSignatureMessageBytes < 0 {
+		errs = append(errs, fmt.Sprintf("max_signature_message_bytes must not be negative (was %d)", conf.MaxSignatureMessageBytes))
+	}
+	if conf.MaxSessions < 0 {
+		errs = append(errs, fmt.Sprintf("max_sessions must not be negative (was %d)", conf.MaxSessions))
+	}
+	if conf.MaxRequestBodyBytes < 0 || conf.MaxHeaderBytes < 0 {
+		errs = append(errs, "max_request_body_bytes and max_header_bytes must not be negative")
+	}
+	if conf.ReadTimeout < 0 || conf.WriteTimeout < 0 || conf.IdleTimeout < 0 {
+		errs = append(errs, "read_timeout, write_timeout and idle_timeout must not be negative")
+	}
+	if conf.CompressionMinBytes < 0 {
+		errs = append(errs, fmt.Sprintf("compression_min_bytes must not be negative (was %d)", conf.CompressionMinBytes))
+	}
+	if conf.SessionCreateRateLimit < 0 || conf.SessionCreateBurst < 0 {
+		errs = append(errs, "session_create_rate_limit and session_create_burst must not be negative")
+	}
+	if conf.SSEKeepaliveInterval < 0 {
+		errs = append(errs, fmt.Sprintf("sse_keepalive must not be negative (was %d)", conf.SSEKeepaliveInterval))
+	}
+	if conf.EnableMetrics && conf.AdminToken == "" {
+		errs = append(errs, "enable_metrics requires admin_token, with which the /metrics endpoint is authenticated")
+	}
+	if conf.Authenticator != nil && conf.DisableRequestorAuthentication {
+		errs = append(errs, "A custom authenticator cannot be combined with no_auth")
+	}
+	if conf.Production && conf.URL == "" {
+		errs = append(errs, "url must be specified in production mode, so that the IRMA app can reach the server")
+	}
+	if conf.Production && !conf.DisableTLS && !conf.clientTlsConfigured() {
+		errs = append(errs, "TLS must be configured in production mode (using tls_cert and tls_privkey, or client_tls_cert and "+
+			"client_tls_privkey if client_port is used), unless no_tls is enabled because e.g. a reverse proxy provides TLS")
+	}
+
+	if conf.Port <= 0 || conf.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port must be between 1 and 65535 (was %d)", conf.Port))
+	}
+	if conf.ClientPort < 0 || conf.ClientPort > 65535 {
+		errs = append(errs, fmt.Sprintf("client_port must be between 0 and 65535 (was %d)", conf.ClientPort))
+	}
+	if conf.ClientPort != 0 && conf.ClientPort == conf.Port {
+		errs = append(errs, "If client_port is given it must be different from port")
+	}
+	if conf.ClientListenAddress != "" && conf.ClientPort == 0 {
+		errs = append(errs, "client_listen_addr must be combined with a nonzero client_port")
+	}
+	if conf.DeriveURLFromRequest && (conf.URL == "" || len(conf.AllowedHosts) == 0) {
+		errs = append(errs, "derive_url_from_request requires url and allowed_hosts")
+	}
+	if conf.DebugAddress != "" {
+		if _, _, err := net.SplitHostPort(conf.DebugAddress); err != nil {
+			errs = append(errs, fmt.Sprintf("debug_addr must be of the form host:port (was %s)", conf.DebugAddress))
+		}
+	}
+
+	errs = append(errs, validateKeyPair("tls",
+		conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)...)
+	errs = append(errs, validateKeyPair("client_tls",
+		conf.ClientTlsCertificate, conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKey, conf.ClientTlsPrivateKeyFile)...)
+	if conf.ClientPort == 0 && (conf.ClientTlsCertificate != "" || conf.ClientTlsCertificateFile != "") {
+		errs = append(errs, "client_tls_cert or client_tls_cert_file must be combined with a nonzero client_port")
+	}
+
+	if conf.JwtPrivateKey != "" && conf.JwtPrivateKeyFile != "" {
+		errs = append(errs, "At most one of jwt_privkey and jwt_privkey_file may be specified")
+	}
+	if (conf.JwtPrivateKey != "" || conf.JwtPrivateKeyFile != "") && conf.JwtIssuer == "" {
+		errs = append(errs, "jwt_issuer must be specified when jwt_privkey or jwt_privkey_file is given")
+	}
+	if (len(conf.JwtPrivateKeys) != 0 || len(conf.JwtPrivateKeyFiles) != 0) && conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
+		errs = append(errs, "jwt_privkeys and jwt_privkey_files must be combined with jwt_privkey or jwt_privkey_file")
+	}
+
+	if len(errs) != 0 {
+		return errors.New("Errors encountered in configuration:\n" + strings.Join(errs, "\n"))
+	}
 	return nil
 }
 
+// validateKeyPair checks that either both or none of a certificate and its private key are
+// specified, each at most once (i.e. not both directly and as a file).
+func validateKeyPair(prefix, cert, certfile, key, keyfile string) []string {
+	var errs []string
+	if cert != "" && certfile != "" {
+		errs = append(errs, fmt.Sprintf("At most one of %s_cert and %s_cert_file may be specified", prefix, prefix))
+	}
+	if key != "" && keyfile != "" {
+		errs = append(errs, fmt.Sprintf("At most one of %s_privkey and %s_privkey_file may be specified", prefix, prefix))
+	}
+	haveCert, haveKey := cert != "" || certfile != "", key != "" || keyfile != ""
+	if haveCert && !haveKey {
+		errs = append(errs, fmt.Sprintf("%s_cert or %s_cert_file given without %s_privkey or %s_privkey_file", prefix, prefix, prefix, prefix))
+	}
+	if haveKey && !haveCert {
+		errs = append(errs, fmt.Sprintf("%s_privkey or %s_privkey_file given without %s_cert or %s_cert_file", prefix, prefix, prefix, prefix))
+	}
+	return errs
+}
+
 func (conf *Configuration) validatePermissions() error {
 	if conf.DisableRequestorAuthentication && len(conf.Requestors) != 0 {
 		return errors.New("Requestors must not be configured when requestor authentication is disabled")
@@ -307,6 +682,10 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 	for typ, typeperms := range perms {
 		for _, permission := range typeperms {
 			parts := strings.Split(permission, ".")
+			if malformedPermission(parts) {
+				errs = append(errs, fmt.Sprintf("%s %s permission '%s' is malformed: * may only occur as the last part", requestor, typ, permission))
+				continue
+			}
 			if parts[len(parts)-1] == "*" {
 				if len(parts) > permissionlength[typ] {
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s' should have at most %d parts", requestor, typ, permission, permissionlength[typ]))
@@ -346,9 +725,31 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 		}
 	}
 
+	for _, constraint := range requestorperms.DisclosureValues {
+		parts := strings.SplitN(constraint, "=", 2)
+		if len(parts) != 2 {
+			errs = append(errs, fmt.Sprintf("%s value constraint '%s' should be of the form attribute=value", requestor, constraint))
+			continue
+		}
+		if conf.IrmaConfiguration.AttributeTypes[irma.NewAttributeTypeIdentifier(parts[0])] == nil {
+			errs = append(errs, fmt.Sprintf("%s value constraint '%s': unknown attribute type", requestor, constraint))
+		}
+	}
+
 	return errs
 }
 
+// malformedPermission returns whether the parts of a permission contain an empty part, or a
+// wildcard anywhere other than as the entire last part.
+func malformedPermission(parts []string) bool {
+	for i, part := range parts {
+		if part == "" || (strings.Contains(part, "*") && (part != "*" || i != len(parts)-1)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (conf *Configuration) clientTlsConfig() (*tls.Config, error) {
 	return conf.readTlsConf(conf.ClientTlsCertificate, conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKey, conf.ClientTlsPrivateKeyFile)
 }
@@ -362,21 +763,13 @@ func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tl
 		return nil, nil
 	}
 
-	var certbts, keybts []byte
-	var err error
-	if certbts, err = fs.ReadKey(cert, certfile); err != nil {
-		return nil, err
-	}
-	if keybts, err = fs.ReadKey(key, keyfile); err != nil {
-		return nil, err
-	}
-
-	cer, err := tls.X509KeyPair(certbts, keybts)
+	// Certificates given inline are static, but those read from files are reloaded when the
+	// files change
+	loader, err := newCertificateLoader(cert, certfile, key, keyfile, conf.Logger)
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
-		Certificates:             []tls.Certificate{cer},
+	tlsConf := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		PreferServerCipherSuites: true,
@@ -388,7 +781,13 @@ func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tl
 			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		},
-	}, nil
+	}
+	if certfile == "" && keyfile == "" {
+		tlsConf.Certificates = []tls.Certificate{*loader.certificate}
+	} else {
+		tlsConf.GetCertificate = loader.getCertificate
+	}
+	return tlsConf, nil
 }
 
 func (conf *Configuration) readPrivateKey() error {
@@ -402,8 +801,58 @@ func (conf *Configuration) readPrivateKey() error {
 	}
 
 	conf.jwtPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
+	if err != nil {
+		return err
+	}
+	if err = checkRSAKeySize("JWT private key", &conf.jwtPrivateKey.PublicKey, conf.MinJwtKeyBits); err != nil {
+		conf.jwtPrivateKey = nil
+		return err
+	}
+	conf.jwtKeyID = jwkThumbprint(&conf.jwtPrivateKey.PublicKey)
+	conf.jwtPublicKeys = []jwk{rsaJwk(&conf.jwtPrivateKey.PublicKey, conf.jwtKeyID)}
+
+	// Of the further keys used in key rotation we only need the public keys
+	rotated := make([][]byte, 0, len(conf.JwtPrivateKeys)+len(conf.JwtPrivateKeyFiles))
+	for _, key := range conf.JwtPrivateKeys {
+		rotated = append(rotated, []byte(key))
+	}
+	for _, file := range conf.JwtPrivateKeyFiles {
+		bts, err := fs.ReadKey("", file)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read private key", 0)
+		}
+		rotated = append(rotated, bts)
+	}
+	for _, bts := range rotated {
+		sk, err := jwt.ParseRSAPrivateKeyFromPEM(bts)
+		if err != nil {
+			return err
+		}
+		if err = checkRSAKeySize("JWT private key", &sk.PublicKey, conf.MinJwtKeyBits); err != nil {
+			return err
+		}
+		conf.jwtPublicKeys = append(conf.jwtPublicKeys, rsaJwk(&sk.PublicKey, jwkThumbprint(&sk.PublicKey)))
+	}
 	conf.Logger.Info("Private key parsed, JWT endpoints enabled")
-	return err
+	return nil
+}
+
+const defaultMinJwtKeyBits = 2048
+
+// checkRSAKeySize returns an error naming the key if its modulus is smaller than min bits.
+func checkRSAKeySize(name string, key *rsa.PublicKey, min int) error {
+	if size := key.N.BitLen(); size < min {
+		return errors.Errorf("%s is a %d-bit RSA key, but at least %d bits are required (see min_jwt_key_bits)", name, size, min)
+	}
+	return nil
+}
+
+// clientTlsConfigured returns whether TLS is configured for the server to which the IRMA app connects.
+func (conf *Configuration) clientTlsConfigured() bool {
+	if conf.ClientPort != 0 {
+		return conf.ClientTlsCertificate != "" || conf.ClientTlsCertificateFile != ""
+	}
+	return conf.TlsCertificate != "" || conf.TlsCertificateFile != ""
 }
 
 func (conf *Configuration) separateClientServer() bool {
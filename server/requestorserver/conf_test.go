@@ -0,0 +1,413 @@
+package requestorserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinJwtKeyBits(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	skPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sk)})
+	pkBts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	pkPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkBts})
+
+	conf := &Configuration{
+		Configuration: &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		JwtPrivateKey: string(skPem),
+		MinJwtKeyBits: defaultMinJwtKeyBits,
+	}
+	err = conf.readPrivateKey()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "JWT private key is a 1024-bit RSA key")
+	require.Nil(t, conf.jwtPrivateKey)
+
+	auth := &PublicKeyAuthenticator{publickeys: map[string][]jwtKey{}, algorithms: map[string][]string{}, minKeyBits: defaultMinJwtKeyBits}
+	err = auth.Initialize("requestor", Requestor{AuthenticationKey: string(pkPem)})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Public key of requestor requestor is a 1024-bit RSA key")
+
+	// Smaller keys are accepted when explicitly configured
+	conf.MinJwtKeyBits = 1024
+	require.NoError(t, conf.readPrivateKey())
+	auth.minKeyBits = 1024
+	require.NoError(t, auth.Initialize("requestor", Requestor{AuthenticationKey: string(pkPem)}))
+}
+
+func TestRequestClockSkew(t *testing.T) {
+	conf := &Configuration{
+		Configuration: &server.Configuration{},
+		Requestors:    map[string]Requestor{"requestor": {AuthenticationMethod: AuthenticationMethodToken, AuthenticationKey: "token"}},
+	}
+	auths, err := conf.newAuthenticators()
+	require.NoError(t, err)
+	require.Equal(t, defaultRequestClockSkew, auths[AuthenticationMethodHmac].(*HmacAuthenticator).clockSkew)
+
+	// Clock skew can be disabled
+	zero := 0
+	conf.RequestClockSkew = &zero
+	auths, err = conf.newAuthenticators()
+	require.NoError(t, err)
+	require.Equal(t, 0, auths[AuthenticationMethodHmac].(*HmacAuthenticator).clockSkew)
+	require.Equal(t, 0, auths[AuthenticationMethodPublicKey].(*PublicKeyAuthenticator).clockSkew)
+}
+
+func TestDisclosureValueConstraints(t *testing.T) {
+	conf := &Configuration{
+		Permissions: Permissions{Disclosing: []string{"*"}},
+		Requestors: map[string]Requestor{
+			"requestor": {Permissions: Permissions{
+				DisclosureValues: []string{"pbdf.pbdf.email.domain=example.com", "pbdf.pbdf.email.domain=*.example.com"},
+			}},
+		},
+	}
+	email := irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.domain")
+	request := func(value *string) irma.AttributeConDisCon {
+		return irma.AttributeConDisCon{irma.AttributeDisCon{irma.AttributeCon{{Type: email, Value: value}}}}
+	}
+	value := func(v string) *string { return &v }
+
+	allowed, _ := conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, request(value("example.com")))
+	require.True(t, allowed)
+	allowed, _ = conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, request(value("mail.example.com")))
+	require.True(t, allowed)
+	allowed, reason := conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, request(value("example.org")))
+	require.False(t, allowed)
+	require.Equal(t, "pbdf.pbdf.email.domain: requested value not allowed", reason)
+	allowed, _ = conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, request(nil))
+	require.False(t, allowed)
+
+	// Other requestors are not constrained
+	conf.Requestors["other"] = Requestor{}
+	allowed, _ = conf.CanVerifyOrSign("other", irma.ActionDisclosing, request(value("example.org")))
+	require.True(t, allowed)
+
+	// Global constraints are combined with those of the requestor, widening them
+	conf.DisclosureValues = []string{"pbdf.pbdf.email.domain=example.org"}
+	allowed, _ = conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, request(value("example.org")))
+	require.True(t, allowed)
+	allowed, _ = conf.CanVerifyOrSign("other", irma.ActionDisclosing, request(value("example.com")))
+	require.False(t, allowed)
+
+	// Combining them does not modify the constraints of the requestor
+	constraints := []string{"pbdf.pbdf.email.domain=example.com", "unused"}
+	conf.Requestors["requestor"] = Requestor{Permissions: Permissions{DisclosureValues: constraints[:1]}}
+	allowed, _ = conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, request(value("example.com")))
+	require.True(t, allowed)
+	require.Equal(t, "unused", constraints[1])
+}
+
+func TestSessionTypePermissions(t *testing.T) {
+	no := false
+	conf := &Configuration{
+		Permissions: Permissions{Disclosing: []string{"*"}, Signing: []string{"*"}, Issuing: []string{"*"}},
+		Requestors: map[string]Requestor{
+			"verifier": {CanSign: &no, CanIssue: &no},
+			"issuer":   {CanDisclose: &no},
+		},
+	}
+
+	require.True(t, conf.CanStart("verifier", irma.ActionDisclosing))
+	require.False(t, conf.CanStart("verifier", irma.ActionSigning))
+	require.False(t, conf.CanStart("verifier", irma.ActionIssuing))
+	require.False(t, conf.CanStart("issuer", irma.ActionDisclosing))
+	require.True(t, conf.CanStart("issuer", irma.ActionSigning))
+	require.True(t, conf.CanStart("issuer", irma.ActionIssuing))
+
+	// Unset toggles allow all session types
+	require.True(t, conf.CanStart("other", irma.ActionDisclosing))
+	require.True(t, conf.CanStart("other", irma.ActionSigning))
+	require.True(t, conf.CanStart("other", irma.ActionIssuing))
+}
+
+// mandatoryAttributeValidator is an example RequestValidator, which requires session requests to
+// disclose a specific attribute.
+type mandatoryAttributeValidator struct {
+	attr irma.AttributeTypeIdentifier
+}
+
+func (v mandatoryAttributeValidator) Validate(requestor string, request irma.RequestorRequest) error {
+	found := false
+	_ = request.SessionRequest().Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+		found = found || attr.Type == v.attr
+		return nil
+	})
+	if !found {
+		return errors.Errorf("requests of %s must disclose %s", requestor, v.attr)
+	}
+	return nil
+}
+
+func TestRequestValidator(t *testing.T) {
+	email := irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email")
+	mobile := irma.NewAttributeTypeIdentifier("pbdf.pbdf.mobilenumber.mobilenumber")
+	conf := &Configuration{
+		Configuration: &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		Permissions:   Permissions{Disclosing: []string{"pbdf.pbdf.*"}},
+		Requestors: map[string]Requestor{
+			"requestor": {Validator: mandatoryAttributeValidator{email}},
+			"other":     {},
+		},
+	}
+	request := func(attrs ...irma.AttributeTypeIdentifier) irma.RequestorRequest {
+		return &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest(attrs...)}
+	}
+
+	require.Nil(t, conf.validateRequest("requestor", request(email, mobile)))
+	rerr := conf.validateRequest("requestor", request(mobile))
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorRequestRejected.Type), rerr.ErrorName)
+	require.Equal(t, "requests of requestor must disclose pbdf.pbdf.email.email", rerr.Message)
+	require.Nil(t, conf.validateRequest("other", request(mobile)))
+
+	// Permissions are checked before the validators
+	rerr = conf.validateRequest("requestor", request(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")))
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorUnauthorized.Type), rerr.ErrorName)
+}
+
+func TestMatchWildcard(t *testing.T) {
+	require.True(t, matchWildcard("abc", "abc"))
+	require.False(t, matchWildcard("abc", "abcd"))
+	require.True(t, matchWildcard("*", ""))
+	require.True(t, matchWildcard("a*c", "abbc"))
+	require.True(t, matchWildcard("a*b*c", "aXbYc"))
+	require.False(t, matchWildcard("a*b*c", "aXcYb"))
+	require.False(t, matchWildcard("ab*ba", "aba"))
+}
+
+func TestMatchesPermission(t *testing.T) {
+	attr := irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email")
+	tests := []struct {
+		perms   []string
+		matches bool
+	}{
+		{nil, false},
+		{[]string{}, false},
+		{[]string{"*"}, true},
+		{[]string{"pbdf.*"}, true},
+		{[]string{"pbdf.pbdf.*"}, true},
+		{[]string{"pbdf.pbdf.email.*"}, true},
+		{[]string{"pbdf.pbdf.email.email"}, true},
+		{[]string{"irma-demo.*"}, false},
+		{[]string{"pbdf.sidn-pbdf.*"}, false},
+		{[]string{"pbdf.pbdf.mobilenumber.*"}, false},
+		{[]string{"pbdf.pbdf.email.domain"}, false},
+		{[]string{"pbdf.pbdf.email"}, false},
+		{[]string{"pbdf.pbdf"}, false},
+		{[]string{"pbdf"}, false},
+		{[]string{"pbdf.pbdf.email.email.*"}, false},
+		{[]string{"pb*"}, false},
+		{[]string{"pbdf.pb*"}, false},
+		{[]string{"*.pbdf.email.email"}, false},
+		{[]string{"pbdf.*.email.email"}, false},
+		{[]string{"irma-demo.*", "pbdf.pbdf.email.email"}, true},
+		{[]string{"pbdf.pbdf.email.domain", "pbdf.pbdf.*"}, true},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.matches, MatchesPermission(attr, test.perms), "permissions %v", test.perms)
+	}
+}
+
+func TestMalformedPermission(t *testing.T) {
+	tests := map[string]bool{
+		"*":                     false,
+		"pbdf.*":                false,
+		"pbdf.pbdf.*":           false,
+		"pbdf.pbdf.email.*":     false,
+		"pbdf.pbdf.email.email": false,
+		"":                      true,
+		"pbdf.":                 true,
+		"pbdf..email":           true,
+		"pb*":                   true,
+		"pbdf.pb*":              true,
+		"*.pbdf":                true,
+		"pbdf.*.email.email":    true,
+		"pbdf.**":               true,
+	}
+	for permission, malformed := range tests {
+		require.Equal(t, malformed, malformedPermission(strings.Split(permission, ".")), "permission %s", permission)
+	}
+}
+
+func TestJwkThumbprint(t *testing.T) {
+	// Example from RFC 7638, section 3.1
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	require.NoError(t, err)
+	pk := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+	require.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jwkThumbprint(pk))
+
+	key := rsaJwk(pk, jwkThumbprint(pk))
+	require.Equal(t, "AQAB", key.Exponent)
+	require.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", key.KeyID)
+}
+
+func TestProductionRequiresTLS(t *testing.T) {
+	conf := &Configuration{
+		Configuration: &server.Configuration{Production: true, URL: "https://example.com/irma"},
+		Port:          8088,
+	}
+	err := conf.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TLS must be configured in production mode")
+
+	conf.DisableTLS = true
+	require.NoError(t, conf.Validate())
+
+	conf.DisableTLS = false
+	conf.TlsCertificateFile, conf.TlsPrivateKeyFile = "cert.pem", "key.pem"
+	require.NoError(t, conf.Validate())
+
+	// With a separate server for the IRMA app, that server needs TLS
+	conf.ClientPort = 8089
+	require.Error(t, conf.Validate())
+	conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKeyFile = "cert.pem", "key.pem"
+	require.NoError(t, conf.Validate())
+}
+
+func TestRequestTemplates(t *testing.T) {
+	conf := &Configuration{RequestTemplates: map[string]RequestTemplate{
+		"kyc-basic": {
+			Request: map[string]interface{}{
+				"label": "Order {{order}}",
+				"request": map[string]interface{}{
+					"@context": "https://irma.app/ld/request/disclosure/v2",
+					"disclose": [][][]map[string]interface{}{{{{"type": "pbdf.pbdf.email.email", "value": "{{email}}"}}}},
+				},
+			},
+			Params: map[string]string{"email": "", "order": "[0-9]+"},
+		},
+	}}
+	require.NoError(t, conf.parseRequestTemplates())
+
+	body, rerr := conf.resolveTemplate([]byte(`{"template":"kyc-basic","params":{"email":"\"}]]]}","order":"42"}}`))
+	require.Nil(t, rerr)
+	rrequest, err := server.ParseSessionRequest(body)
+	require.NoError(t, err)
+	require.Equal(t, "Order 42", rrequest.Base().Label)
+	attr := rrequest.SessionRequest().Disclosure().Disclose[0][0][0]
+	require.Equal(t, "pbdf.pbdf.email.email", attr.Type.String())
+	require.Equal(t, `"}]]]}`, *attr.Value)
+
+	// Other bodies are left alone
+	request := []byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[]}`)
+	body, rerr = conf.resolveTemplate(request)
+	require.Nil(t, rerr)
+	require.Equal(t, request, body)
+
+	_, rerr = conf.resolveTemplate([]byte(`{"template":"unknown"}`))
+	require.NotNil(t, rerr)
+	_, rerr = conf.resolveTemplate([]byte(`{"template":"kyc-basic","params":{"email":"a@example.com"}}`))
+	require.NotNil(t, rerr)
+	_, rerr = conf.resolveTemplate([]byte(`{"template":"kyc-basic","params":{"email":"a@example.com","order":"4a"}}`))
+	require.NotNil(t, rerr)
+	_, rerr = conf.resolveTemplate([]byte(`{"template":"kyc-basic","params":{"email":"a@example.com","order":"42","other":""}}`))
+	require.NotNil(t, rerr)
+
+	// All placeholders must be declared parameters
+	conf.RequestTemplates["other"] = RequestTemplate{Request: map[string]interface{}{"label": "{{undeclared}}"}}
+	require.Error(t, conf.parseRequestTemplates())
+
+	// Templates must be valid session requests
+	disclosure := map[string]interface{}{
+		"@context": "https://irma.app/ld/request/disclosure/v2",
+		"disclose": []interface{}{},
+	}
+	conf.RequestTemplates["other"] = RequestTemplate{
+		Request: map[string]interface{}{"label": "{{label}}", "request": disclosure},
+		Params:  map[string]string{"label": ""},
+	}
+	require.Error(t, conf.parseRequestTemplates())
+	disclosure["disclose"] = [][][]map[string]interface{}{{{{"type": "irma-demo.RU.studentCard.studentID"}}}}
+	require.NoError(t, conf.parseRequestTemplates())
+}
+
+func TestTlsCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsreload")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	certfile, keyfile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	// Writes a new self-signed certificate and its key, with the specified modification time
+	writeCert := func(name string, modified time.Time) {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		certbts, err := x509.CreateCertificate(rand.Reader, template, template, &sk.PublicKey, sk)
+		require.NoError(t, err)
+		keybts, err := x509.MarshalECPrivateKey(sk)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certbts}), 0600))
+		require.NoError(t, ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keybts}), 0600))
+		require.NoError(t, os.Chtimes(certfile, modified, modified))
+		require.NoError(t, os.Chtimes(keyfile, modified, modified))
+	}
+	commonName := func(tlsConf *tls.Config) string {
+		cert, err := tlsConf.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+
+	now := time.Now()
+	writeCert("first", now.Add(-time.Minute))
+	conf := &Configuration{
+		Configuration:      &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		TlsCertificateFile: certfile,
+		TlsPrivateKeyFile:  keyfile,
+	}
+	tlsConf, err := conf.tlsConfig()
+	require.NoError(t, err)
+	require.Empty(t, tlsConf.Certificates)
+	require.Equal(t, "first", commonName(tlsConf))
+
+	writeCert("second", now)
+	require.Equal(t, "second", commonName(tlsConf))
+
+	// A broken certificate file does not replace the current certificate
+	require.NoError(t, ioutil.WriteFile(certfile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(certfile, now.Add(time.Minute), now.Add(time.Minute)))
+	require.Equal(t, "second", commonName(tlsConf))
+
+	// Inline certificates are static
+	writeCert("third", now.Add(2*time.Minute))
+	certbts, err := ioutil.ReadFile(certfile)
+	require.NoError(t, err)
+	keybts, err := ioutil.ReadFile(keyfile)
+	require.NoError(t, err)
+	conf = &Configuration{
+		Configuration:  &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		TlsCertificate: string(certbts),
+		TlsPrivateKey:  string(keybts),
+	}
+	tlsConf, err = conf.tlsConfig()
+	require.NoError(t, err)
+	require.Nil(t, tlsConf.GetCertificate)
+	require.Len(t, tlsConf.Certificates, 1)
+}
@@ -0,0 +1,127 @@
+package requestorserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// startDebugServer serves profiling data and session counts at the debug address. If it fails the
+// error is logged, but unlike when the other servers fail, the remaining servers keep running.
+func (s *Server) startDebugServer() {
+	s.conf.Logger.Warnf("Debug server listening at %s: it exposes profiling data and must never be publicly reachable", s.conf.DebugAddress)
+
+	serv := &http.Server{
+		Addr:              s.conf.DebugAddress,
+		Handler:           debugHandler(s.sessionCounts),
+		ReadHeaderTimeout: time.Duration(s.conf.ReadTimeout) * time.Second,
+	}
+	err := s.addServer(serv)
+	if err == nil {
+		err = serv.ListenAndServe()
+	}
+	if err = filterStopError(err); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Debug server failed", 0))
+	}
+}
+
+// debugHandler returns the handler of the debug server. It serves the profiles of runtime/pprof
+// at the same paths and in the same formats as net/http/pprof, and the session counts along with
+// the command line and memory statistics at /debug/vars in the format of expvar. We do not use
+// net/http/pprof and expvar themselves, as importing them registers their handlers on
+// http.DefaultServeMux, exposing them on any server that an embedder of this package runs with it.
+func debugHandler(sessions func() map[server.Status]int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", debugProfile)
+	mux.HandleFunc("/debug/pprof/profile", debugCPUProfile)
+	mux.HandleFunc("/debug/pprof/trace", debugTrace)
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		var memstats runtime.MemStats
+		runtime.ReadMemStats(&memstats)
+		server.WriteJson(w, map[string]interface{}{
+			"cmdline":    os.Args,
+			"memstats":   memstats,
+			"irmaserver": map[string]interface{}{"sessions": sessions()},
+		})
+	})
+	return mux
+}
+
+// debugProfile serves an index of the available profiles at /debug/pprof/, and the profile of
+// the specified name at /debug/pprof/name, in text format if the debug parameter is nonzero.
+func debugProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, profile := range pprof.Profiles() {
+			_, _ = fmt.Fprintf(w, "%d\t%s\n", profile.Count(), profile.Name())
+		}
+		_, _ = fmt.Fprint(w, "-\tprofile\n-\ttrace\n")
+		return
+	}
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		http.NotFound(w, r)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if debug == 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	_ = profile.WriteTo(w, debug)
+}
+
+// debugCPUProfile serves a CPU profile of the amount of seconds in the seconds parameter (default 30).
+func debugCPUProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, "Could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	debugWait(r, 30)
+	pprof.StopCPUProfile()
+}
+
+// debugTrace serves an execution trace of the amount of seconds in the seconds parameter (default 1).
+func debugTrace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := trace.Start(w); err != nil {
+		http.Error(w, "Could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	debugWait(r, 1)
+	trace.Stop()
+}
+
+// debugWait waits for the amount of seconds in the seconds parameter of the request, or the
+// default if absent, or until the client goes away.
+func debugWait(r *http.Request, def int) {
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = def
+	}
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-r.Context().Done():
+	}
+}
+
+// sessionCounts returns the amount of sessions in the session store per status.
+func (s *Server) sessionCounts() map[server.Status]int {
+	counts := map[server.Status]int{}
+	for _, session := range s.irmaserv.Sessions() {
+		counts[session.Status]++
+	}
+	return counts
+}
@@ -0,0 +1,116 @@
+package requestorserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// dedupeCache remembers the sessions recently started by requestors that enabled deduplication,
+// so that identical session requests within the requestor's dedupe window return the existing
+// session instead of starting a new one.
+type dedupeCache struct {
+	sync.Mutex
+	sessions  map[string]dedupeEntry
+	locks     map[string]*dedupeLock
+	lastPrune time.Time
+}
+
+// dedupeLock is held while handling a session request with a given key, so that identical
+// concurrent requests don't both start a session.
+type dedupeLock struct {
+	sync.Mutex
+	users int // amount of requests holding or waiting for the lock
+}
+
+type dedupeEntry struct {
+	qr      *irma.Qr
+	token   string
+	expires time.Time
+}
+
+func newDedupeCache() *dedupeCache {
+	return &dedupeCache{sessions: map[string]dedupeEntry{}, locks: map[string]*dedupeLock{}}
+}
+
+// lock blocks until no other request with the specified key is being handled, and returns
+// the function that must be called when the request has been handled.
+func (c *dedupeCache) lock(key string) func() {
+	c.Lock()
+	l := c.locks[key]
+	if l == nil {
+		l = &dedupeLock{}
+		c.locks[key] = l
+	}
+	l.users++
+	c.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.Lock()
+		defer c.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(c.locks, key)
+		}
+	}
+}
+
+// dedupeKey hashes the requestor name and the session request, canonicalized by marshaling the
+// parsed request, so that requests differing only in formatting or JWT metadata are identical.
+func dedupeKey(requestor string, rrequest irma.RequestorRequest) (string, error) {
+	bts, err := json.Marshal(rrequest)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(requestor))
+	h.Write([]byte{0})
+	h.Write(bts)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// get returns the QR and token of the session started with the specified key, if its window has
+// not yet passed.
+func (c *dedupeCache) get(key string, now time.Time) (*irma.Qr, string) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.sessions[key]
+	if !ok || now.After(entry.expires) {
+		return nil, ""
+	}
+	return entry.qr, entry.token
+}
+
+// put remembers the session started with the specified key for the specified window.
+func (c *dedupeCache) put(key string, qr *irma.Qr, token string, window time.Duration, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.prune(now)
+	c.sessions[key] = dedupeEntry{qr: qr, token: token, expires: now.Add(window)}
+}
+
+// remove forgets the session started with the specified key.
+func (c *dedupeCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.sessions, key)
+}
+
+// prune removes the entries whose window has passed. The caller must hold the lock.
+func (c *dedupeCache) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+	for key, entry := range c.sessions {
+		if now.After(entry.expires) {
+			delete(c.sessions, key)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package requestorserver
+
+import (
+	"net/http"
+)
+
+// openAPISpec is an OpenAPI 3 description of the requestor endpoints of the server, served at
+// /openapi.json. It is maintained by hand; keep it in sync with the handlers and the structs
+// they (un)marshal when changing the API.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "IRMA server requestor API",
+    "description": "Endpoints with which requestors start and manage IRMA sessions.",
+    "version": "1"
+  },
+  "paths": {
+    "/session": {
+      "post": {
+        "summary": "Start a session",
+        "description": "Accepts a session request, either as JSON or as a JWT signed by the requestor, depending on the configured requestor authentication. JSON session requests may also be specified by instantiating a request template configured at the server.",
+        "parameters": [
+          {"name": "Idempotency-Key", "in": "header", "required": false, "schema": {"type": "string", "maxLength": 255}},
+          {"name": "qr", "in": "query", "required": false, "description": "Comma-separated encodings of the session pointer to include in the response", "schema": {"type": "string", "example": "json,url,image"}}
+        ],
+        "requestBody": {"required": true, "content": {
+          "application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/RequestorRequest"}, {"$ref": "#/components/schemas/TemplateInstance"}]}},
+          "text/plain": {"schema": {"type": "string", "description": "Session request JWT"}}
+        }},
+        "responses": {
+          "200": {"description": "Session started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SessionPackage"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/validate": {
+      "post": {
+        "summary": "Validate a session request without starting a session",
+        "requestBody": {"required": true, "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/RequestorRequest"}},
+          "text/plain": {"schema": {"type": "string", "description": "Session request JWT"}}
+        }},
+        "responses": {
+          "200": {"description": "The session request as parsed by the server", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RequestorRequest"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/status": {
+      "post": {
+        "summary": "Get the status of multiple sessions",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "maxItems": 100, "items": {"type": "string"}}}}},
+        "responses": {
+          "200": {"description": "Status per session token", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/Status"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/{token}": {
+      "parameters": [{"$ref": "#/components/parameters/Token"}],
+      "delete": {
+        "summary": "Cancel a session",
+        "responses": {
+          "200": {"description": "Session cancelled"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/{token}/status": {
+      "parameters": [{"$ref": "#/components/parameters/Token"}],
+      "get": {
+        "summary": "Get the session status",
+        "parameters": [
+          {"name": "wait", "in": "query", "required": false, "description": "Wait at most this many seconds (up to 60) for the status to differ from the status parameter", "schema": {"type": "integer", "minimum": 0}},
+          {"name": "status", "in": "query", "required": false, "schema": {"$ref": "#/components/schemas/Status"}}
+        ],
+        "responses": {
+          "200": {"description": "Session status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/{token}/statusevents": {
+      "parameters": [{"$ref": "#/components/parameters/Token"}],
+      "get": {
+        "summary": "Subscribe to status updates using server sent events, if enabled",
+        "responses": {
+          "200": {"description": "Event stream of JSON-encoded statuses", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/{token}/result": {
+      "parameters": [{"$ref": "#/components/parameters/Token"}],
+      "get": {
+        "summary": "Get the session result",
+        "responses": {
+          "200": {"description": "Session result", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SessionResult"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/{token}/result-jwt": {
+      "parameters": [{"$ref": "#/components/parameters/Token"}],
+      "get": {
+        "summary": "Get the session result as a JWT signed by the server",
+        "responses": {
+          "200": {"description": "Session result JWT", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/session/{token}/getproof": {
+      "parameters": [{"$ref": "#/components/parameters/Token"}],
+      "get": {
+        "summary": "Get the session result as a JWT in the format of the legacy IRMA API server",
+        "responses": {
+          "200": {"description": "Session result JWT", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/publickey": {
+      "get": {
+        "summary": "Get the PEM-encoded public key with which result JWTs are signed",
+        "responses": {
+          "200": {"description": "Public key", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/jwks.json": {
+      "get": {
+        "summary": "Get the public keys with which result JWTs are signed as a JSON Web Key Set",
+        "responses": {
+          "200": {"description": "JSON Web Key Set", "content": {"application/json": {"schema": {"type": "object", "properties": {"keys": {"type": "array", "items": {"type": "object"}}}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/sessions": {
+      "get": {
+        "summary": "List all sessions, if an admin token is configured",
+        "security": [{"AdminToken": []}],
+        "responses": {
+          "200": {"description": "Sessions", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SessionInfo"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "AdminToken": {"type": "apiKey", "in": "header", "name": "Authorization"}
+    },
+    "parameters": {
+      "Token": {"name": "token", "in": "path", "required": true, "description": "Requestor token of the session", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RemoteError"}}}}
+    },
+    "schemas": {
+      "Action": {"type": "string", "enum": ["disclosing", "signing", "issuing"]},
+      "Status": {"type": "string", "enum": ["INITIALIZED", "PAIRING", "CONNECTED", "COMMUNICATING", "CANCELLED", "DONE", "TIMEOUT", "UNKNOWN"]},
+      "RequestorRequest": {
+        "type": "object",
+        "description": "Session request along with requestor options. The request field contains a disclosure, signature or issuance request.",
+        "required": ["request"],
+        "properties": {
+          "request": {"type": "object"},
+          "validity": {"type": "integer", "description": "Validity of the session result JWT in seconds"},
+          "timeout": {"type": "integer", "description": "Seconds to wait for the IRMA app to connect"},
+          "callbackUrl": {"type": "string"},
+          "pairingMethod": {"type": "string", "enum": ["none", "pin"]},
+          "returnUrl": {"type": "string"},
+          "label": {"type": "string", "maxLength": 255},
+          "correlationId": {"type": "string", "maxLength": 255, "description": "Must be unique among the unexpired sessions of the requestor"},
+          "clientReturnClaims": {"type": "object"}
+        }
+      },
+      "TemplateInstance": {
+        "type": "object",
+        "required": ["template"],
+        "properties": {
+          "template": {"type": "string", "description": "Name of the request template"},
+          "params": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "Qr": {
+        "type": "object",
+        "required": ["u", "irmaqr"],
+        "properties": {
+          "u": {"type": "string", "description": "URL of the session at the server"},
+          "irmaqr": {"$ref": "#/components/schemas/Action"},
+          "v": {"type": "string", "description": "Minimum supported protocol version"},
+          "vmax": {"type": "string", "description": "Maximum supported protocol version"}
+        }
+      },
+      "SessionPackage": {
+        "type": "object",
+        "required": ["sessionPtr", "token"],
+        "properties": {
+          "sessionPtr": {"$ref": "#/components/schemas/Qr"},
+          "token": {"type": "string"},
+          "pairingCode": {"type": "string"},
+          "correlationId": {"type": "string"},
+          "qrJson": {"type": "string", "description": "The session pointer as JSON string"},
+          "qrUrl": {"type": "string", "description": "URL opening the session in the IRMA app"},
+          "qrImage": {"type": "string", "description": "Data URI of a PNG image of the QR"}
+        }
+      },
+      "DisclosedAttribute": {
+        "type": "object",
+        "properties": {
+          "rawvalue": {"type": "string", "nullable": true},
+          "value": {"type": "object", "additionalProperties": {"type": "string"}},
+          "id": {"type": "string"},
+          "status": {"type": "string", "enum": ["PRESENT", "EXTRA", "NULL"]},
+          "issuancetime": {"type": "integer", "description": "Unix timestamp"},
+          "expiry": {"type": "integer", "description": "Unix timestamp"},
+          "credentialtype": {"type": "string", "description": "Credential type from which the attribute was disclosed"},
+          "issuer": {"type": "string", "description": "Issuer of the credential from which the attribute was disclosed"}
+        }
+      },
+      "SessionResult": {
+        "type": "object",
+        "required": ["token", "status", "type"],
+        "properties": {
+          "token": {"type": "string"},
+          "status": {"$ref": "#/components/schemas/Status"},
+          "type": {"$ref": "#/components/schemas/Action"},
+          "proofStatus": {"type": "string", "enum": ["VALID", "INVALID", "INVALID_TIMESTAMP", "UNMATCHED_REQUEST", "MISSING_ATTRIBUTES", "EXPIRED"]},
+          "disclosed": {"type": "array", "items": {"type": "array", "items": {"$ref": "#/components/schemas/DisclosedAttribute"}}},
+          "signature": {"type": "object", "description": "Attribute-based signature"},
+          "error": {"$ref": "#/components/schemas/RemoteError"},
+          "disjunctions": {"type": "array", "items": {"type": "string", "enum": ["DISCLOSED", "SKIPPED", "MISSING"]}},
+          "nextSession": {"$ref": "#/components/schemas/Qr"},
+          "nextToken": {"type": "string"},
+          "prevToken": {"type": "string"},
+          "label": {"type": "string"},
+          "correlationId": {"type": "string"},
+          "createdAt": {"type": "string", "format": "date-time"},
+          "clientConnectedAt": {"type": "string", "format": "date-time"},
+          "finishedAt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "SessionInfo": {
+        "type": "object",
+        "properties": {
+          "token": {"type": "string"},
+          "requestor": {"type": "string"},
+          "label": {"type": "string"},
+          "type": {"$ref": "#/components/schemas/Action"},
+          "status": {"$ref": "#/components/schemas/Status"},
+          "created": {"type": "string", "format": "date-time"},
+          "lastActive": {"type": "string", "format": "date-time"}
+        }
+      },
+      "RemoteError": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "integer"},
+          "error": {"type": "string"},
+          "description": {"type": "string"},
+          "message": {"type": "string"},
+          "stacktrace": {"type": "string"}
+        }
+      }
+    }
+  }
+}`
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(openAPISpec))
+}
@@ -0,0 +1,83 @@
+package requestorserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"rsc.io/qr"
+)
+
+// Encodings of the session pointer that requestors may ask for in addition to the session pointer
+// itself when starting a session, with the qr query parameter (e.g. ?qr=json,url,image).
+const (
+	qrEncodingJSON  = "json"  // the session pointer as JSON string, i.e. the contents of the QR
+	qrEncodingURL   = "url"   // a URL opening the session in the IRMA app on the same device
+	qrEncodingImage = "image" // a data URI of a PNG image of the QR
+)
+
+// qrURLPrefix precedes the URL-encoded JSON session pointer in URLs opening the IRMA app.
+const qrURLPrefix = "irma://qr/json/"
+
+// parseQrEncodings parses the comma-separated list of encodings of the qr query parameter.
+func parseQrEncodings(param string) ([]string, error) {
+	if param == "" {
+		return nil, nil
+	}
+	encodings := strings.Split(param, ",")
+	for i, encoding := range encodings {
+		encodings[i] = strings.TrimSpace(encoding)
+		switch encodings[i] {
+		case qrEncodingJSON, qrEncodingURL, qrEncodingImage:
+		default:
+			return nil, errors.Errorf("unknown QR encoding %s", encodings[i])
+		}
+	}
+	return encodings, nil
+}
+
+// addQrEncodings adds the specified encodings of the session pointer to the session package.
+func addQrEncodings(pkg *server.SessionPackage, encodings []string) error {
+	if len(encodings) == 0 {
+		return nil
+	}
+	bts, err := json.Marshal(pkg.SessionPtr)
+	if err != nil {
+		return err
+	}
+	for _, encoding := range encodings {
+		switch encoding {
+		case qrEncodingJSON:
+			pkg.QrJSON = string(bts)
+		case qrEncodingURL:
+			pkg.QrURL = qrURLPrefix + url.PathEscape(string(bts))
+		case qrEncodingImage:
+			code, err := qr.Encode(string(bts), qr.L)
+			if err != nil {
+				return err
+			}
+			pkg.QrImage = "data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())
+		}
+	}
+	return nil
+}
+
+// withHost returns a copy of the session pointer whose URL has the specified host, or the session
+// pointer itself if host is empty.
+func withHost(qr *irma.Qr, host string) *irma.Qr {
+	if host == "" {
+		return qr
+	}
+	u, err := url.Parse(qr.URL)
+	if err != nil { // can't happen, we generated it ourselves
+		return qr
+	}
+	u.Host = host
+	cpy := *qr
+	cpy.URL = u.String()
+	return &cpy
+}
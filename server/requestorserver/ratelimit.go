@@ -0,0 +1,82 @@
+package requestorserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/server"
+)
+
+// rateLimiter limits the rate at which each client IP may make requests, using a token bucket
+// per IP: each request takes a token, and tokens are replenished at a fixed rate up to the burst.
+type rateLimiter struct {
+	sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from the bucket of the specified key, returning false if it is empty.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes the buckets that have been refilled completely, as these are equivalent to
+// absent buckets, so that memory usage does not grow with the amount of distinct clients.
+// The caller must hold the lock.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitHandler is middleware that refuses requests with a 429 response if their client IP
+// exceeds the session creation rate limit, if configured.
+func (s *Server) rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.sessionLimiter != nil && !s.sessionLimiter.allow(ClientIP(r).String(), time.Now()) {
+			server.WriteError(w, server.ErrorRateLimited, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -7,14 +7,22 @@ package requestorserver
 import (
 	"bytes"
 	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -25,6 +33,8 @@ import (
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -32,10 +42,33 @@ import (
 type Server struct {
 	conf     *Configuration
 	irmaserv *irmaserver.Server
-	stop     chan struct{}
-	stopped  chan struct{}
+
+	// Limits the rate at which clients may start sessions, if configured
+	sessionLimiter *rateLimiter
+
+	// Recently started sessions of requestors that enabled deduplication
+	dedupe *dedupeCache
+
+	// Authenticators of the requestors, unless a custom authenticator is configured
+	authenticators map[AuthenticationMethod]Authenticator
+	// Guards the requestors, permissions and authenticators, which may be changed by Reload()
+	confLock sync.RWMutex
+
+	serversLock sync.Mutex
+	servers     []*http.Server
+	stopping    bool
 }
 
+// IdempotencyKeyHeader is the HTTP header with which requestors can make starting a session safe
+// to retry: repeated requests with the same key return the same session.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	maxIdempotencyKeyLength = 255
+	maxStatusWait           = 60  // Maximum amount of seconds that long-polling requestors may wait for the session status to change
+	maxBatchStatusTokens    = 100 // Maximum amount of sessions whose status may be requested at once
+)
+
 // Start the server. If successful then it will not return until Stop() is called.
 func (s *Server) Start(config *Configuration) error {
 	if s.conf.LogJSON {
@@ -53,13 +86,16 @@ func (s *Server) Start(config *Configuration) error {
 	// - any unexpected error is dealt with here instead of when stopping using Stop().
 	// Inspired by https://dave.cheney.net/practical-go/presentations/qcon-china.html#_never_start_a_goroutine_without_when_it_will_stop
 
+	// The debug server, if any, is not essential, so it is left out of the above
+	if s.conf.DebugAddress != "" {
+		go s.startDebugServer()
+	}
+
 	count := 1
 	if s.conf.separateClientServer() {
 		count = 2
 	}
 	done := make(chan error, count)
-	s.stop = make(chan struct{})
-	s.stopped = make(chan struct{}, count)
 
 	if s.conf.separateClientServer() {
 		go func() {
@@ -78,7 +114,21 @@ func (s *Server) Start(config *Configuration) error {
 		}
 		if !stopped {
 			stopped = true
-			close(s.stop)
+			// If we are not being stopped by Stop(), one of our servers returned by itself,
+			// so we stop the other one as well
+			s.serversLock.Lock()
+			stopping := s.stopping
+			s.stopping = true // Servers that have not yet started must not do so anymore
+			s.serversLock.Unlock()
+			if !stopping {
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+					defer cancel()
+					if err := s.shutdown(ctx); err != nil {
+						_ = server.LogError(err)
+					}
+				}()
+			}
 		}
 	}
 
@@ -99,21 +149,20 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 	fulladdr := fmt.Sprintf("%s:%d", addr, port)
 	s.conf.Logger.Info(name, " listening at ", fulladdr)
 
+	// The http.Server's ReadTimeout and WriteTimeout are left unset, as they would also cut off server
+	// sent event streams and long-polling requests; instead, readTimeoutHandler enforces the read
+	// timeout on request bodies and timeoutHandler the write timeout on the responses.
 	serv := &http.Server{
-		Addr:      fulladdr,
-		Handler:   handler,
-		TLSConfig: tlsConf,
+		Addr:              fulladdr,
+		Handler:           s.readTimeoutHandler(s.timeoutHandler(handler)),
+		TLSConfig:         tlsConf,
+		ReadHeaderTimeout: time.Duration(s.conf.ReadTimeout) * time.Second,
+		IdleTimeout:       time.Duration(s.conf.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    s.conf.MaxHeaderBytes,
+	}
+	if err := s.addServer(serv); err != nil {
+		return filterStopError(err)
 	}
-
-	go func() {
-		<-s.stop
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		if err := serv.Shutdown(ctx); err != nil {
-			_ = server.LogError(err)
-		}
-		s.stopped <- struct{}{}
-	}()
 
 	if tlsConf != nil {
 		// Disable HTTP/2 (see package documentation of http): it breaks server side events :(
@@ -125,6 +174,72 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 	}
 }
 
+// timeoutHandler is middleware that aborts requests with a 503 response if they are not handled
+// within the write timeout. Server sent event streams and long-polling status requests are exempt:
+// the former are long-lived, and the latter end by themselves after at most maxStatusWait seconds.
+// The response of other requests is buffered until the handler finishes, so that flushing it has
+// no effect; handlers that stream their response must therefore be exempted here as well.
+func (s *Server) timeoutHandler(next http.Handler) http.Handler {
+	timeout := http.TimeoutHandler(next, time.Duration(s.conf.WriteTimeout)*time.Second, "")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/statusevents") ||
+			(strings.HasSuffix(r.URL.Path, "/status") && r.URL.Query().Get("wait") != "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout.ServeHTTP(w, r)
+	})
+}
+
+// readTimeoutHandler is middleware that gives clients at most the read timeout to send the body of
+// their request, so that slow clients cannot keep connections open indefinitely. The deadline is
+// set on the connection, and lifted again once the body has been read: after that the http.Server
+// keeps reading from the connection in the background to notice clients going away, and hitting
+// the deadline there would cancel the request. Server sent event streams are exempt.
+func (s *Server) readTimeoutHandler(next http.Handler) http.Handler {
+	timeout := time.Duration(s.conf.ReadTimeout) * time.Second
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 || strings.HasSuffix(r.URL.Path, "/statusevents") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer func() { _ = rc.SetReadDeadline(time.Time{}) }()
+		r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineBody lifts the read deadline of the connection once the request body has been read.
+type deadlineBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// addServer registers the server so that it is shut down when stopping. If we are already
+// stopping, it returns http.ErrServerClosed, and the server must not be started.
+func (s *Server) addServer(serv *http.Server) error {
+	s.serversLock.Lock()
+	defer s.serversLock.Unlock()
+	if s.stopping {
+		return http.ErrServerClosed
+	}
+	s.servers = append(s.servers, serv)
+	return nil
+}
+
 func filterStopError(err error) error {
 	if err == http.ErrServerClosed {
 		return nil
@@ -132,16 +247,84 @@ func filterStopError(err error) error {
 	return err
 }
 
-func (s *Server) Stop() {
+// Stop gracefully shuts down the server: it stops accepting new connections, closes all server
+// sent event connections, and waits for in-flight requests to finish until ctx expires, after
+// which it returns ctx.Err(). This causes Start() to return.
+func (s *Server) Stop(ctx context.Context) error {
+	s.serversLock.Lock()
+	s.stopping = true
+	s.serversLock.Unlock()
+
 	s.irmaserv.Stop()
-	s.stop <- struct{}{}
-	<-s.stopped
-	if s.conf.separateClientServer() {
-		<-s.stopped
+	return s.shutdown(ctx)
+}
+
+// Reload applies the requestors and permissions from the specified configuration to the running
+// server, and updates the IRMA schemes from their remote locations. Listeners and existing sessions
+// are left untouched; changed permissions apply only to sessions started afterwards.
+// The following fields are reloadable: Requestors and Permissions (i.e. the disclose, sign and
+// issue permissions of all requestors). All other fields, including
+// DisableRequestorAuthentication, static sessions, ports, and TLS and JWT configuration, require
+// a restart; changes to them in conf are ignored. Changes to schemes made directly on disk
+// (i.e. not by updating them at their remote location) also require a restart.
+func (s *Server) Reload(conf *Configuration) error {
+	if conf.DisableRequestorAuthentication != s.conf.DisableRequestorAuthentication {
+		return errors.New("Enabling or disabling requestor authentication requires a restart")
+	}
+
+	if !s.conf.DisableSchemesUpdate {
+		if err := s.conf.IrmaConfiguration.UpdateSchemes(); err != nil {
+			return errors.WrapPrefix(err, "Failed to update schemes", 0)
+		}
+	}
+
+	// Check the new permissions against the current schemes
+	if conf.Configuration == nil {
+		conf.Configuration = &server.Configuration{}
+	}
+	conf.IrmaConfiguration = s.conf.IrmaConfiguration
+	conf.MaxRequestAge = s.conf.MaxRequestAge
+	conf.RequestClockSkew = s.conf.RequestClockSkew
+	conf.MinJwtKeyBits = s.conf.MinJwtKeyBits
+	if err := conf.validatePermissions(); err != nil {
+		return err
+	}
+	auths := s.authenticators
+	if !s.conf.DisableRequestorAuthentication && s.conf.Authenticator == nil {
+		var err error
+		if auths, err = conf.newAuthenticators(); err != nil {
+			return err
+		}
+	}
+
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+	s.authenticators = auths
+	s.conf.Requestors = conf.Requestors
+	s.conf.Permissions = conf.Permissions
+	s.conf.Logger.WithField("requestors", len(conf.Requestors)).Info("Reloaded requestors and permissions")
+	return nil
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	s.serversLock.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.serversLock.Unlock()
+
+	var err error
+	for _, serv := range servers {
+		if e := serv.Shutdown(ctx); e != nil {
+			err = e
+		}
 	}
+	return err
 }
 
 func New(config *Configuration) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	irmaserv, err := irmaserver.New(config.Configuration)
 	if err != nil {
 		return nil, err
@@ -149,10 +332,20 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
-	return &Server{
-		conf:     config,
-		irmaserv: irmaserv,
-	}, nil
+	auths, err := config.authenticators()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conf:           config,
+		irmaserv:       irmaserv,
+		authenticators: auths,
+		dedupe:         newDedupeCache(),
+	}
+	if config.SessionCreateRateLimit > 0 {
+		s.sessionLimiter = newRateLimiter(config.SessionCreateRateLimit, config.SessionCreateBurst)
+	}
+	return s, nil
 }
 
 var corsOptions = cors.Options{
@@ -163,11 +356,40 @@ var corsOptions = cors.Options{
 
 func (s *Server) ClientHandler() http.Handler {
 	router := chi.NewRouter()
+	router.Use(s.clientIPHandler)
+	router.Use(s.compressHandler)
 	router.Use(cors.New(corsOptions).Handler)
 	s.attachClientEndpoints(router)
 	return router
 }
 
+// requestorCorsOptions returns the CORS options for the requestor endpoints, using the configured
+// allowed origins if any.
+func (s *Server) requestorCorsOptions() cors.Options {
+	opts := corsOptions
+	opts.AllowedHeaders = append([]string{IdempotencyKeyHeader}, corsOptions.AllowedHeaders...)
+	if len(s.conf.CorsAllowedOrigins) > 0 {
+		opts.AllowedOrigins = s.conf.CorsAllowedOrigins
+	}
+	return opts
+}
+
+// corsHandler is middleware applying CORS to all requests. Endpoints for the irmaclient are always
+// accessible from any origin, while the requestor endpoints are restricted to the configured origins.
+// This is done at the router level instead of in the route groups, so that preflight OPTIONS
+// requests are also handled.
+func (s *Server) corsHandler(next http.Handler) http.Handler {
+	client := cors.New(corsOptions).Handler(next)
+	requestor := cors.New(s.requestorCorsOptions()).Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.conf.separateClientServer() && strings.HasPrefix(r.URL.Path, "/irma/") {
+			client.ServeHTTP(w, r)
+		} else {
+			requestor.ServeHTTP(w, r)
+		}
+	})
+}
+
 func (s *Server) attachClientEndpoints(router *chi.Mux) {
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
 	if s.conf.StaticPath != "" {
@@ -177,7 +399,7 @@ func (s *Server) attachClientEndpoints(router *chi.Mux) {
 		if s.conf.Verbose >= 2 {
 			r.Use(s.logHandler("staticsession", true, true, true))
 		}
-		r.Post("/irma/session/{name}", s.handleCreateStatic)
+		r.With(s.rateLimitHandler).Post("/irma/session/{name}", s.handleCreateStatic)
 	})
 }
 
@@ -185,26 +407,32 @@ func (s *Server) attachClientEndpoints(router *chi.Mux) {
 // and IRMA client messages.
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
-	router.Use(cors.New(corsOptions).Handler)
+	router.Use(s.clientIPHandler)
+	router.Use(s.compressHandler)
+	router.Use(s.corsHandler)
 
 	if !s.conf.separateClientServer() {
 		// Mount server for irmaclient
 		s.attachClientEndpoints(router)
 	}
 
+	// Health check endpoint for e.g. load balancers; not logged, as it may be polled often
+	router.Get(s.conf.HealthCheckPath, s.handleHealth)
+
 	router.NotFound(s.logHandler("requestor", false, true, true)(router.NotFoundHandler()).ServeHTTP)
 	router.MethodNotAllowed(s.logHandler("requestor", false, true, true)(router.MethodNotAllowedHandler()).ServeHTTP)
 
 	// Group main API endpoints, so we can attach our request/response logger to it
 	// while not adding it to the endpoints already added above (which do their own logging).
 	router.Group(func(r chi.Router) {
-		r.Use(cors.New(corsOptions).Handler)
 		if s.conf.Verbose >= 2 {
 			r.Use(s.logHandler("requestor", true, true, true))
 		}
 
 		// Server routes
-		r.Post("/session", s.handleCreate)
+		r.With(s.rateLimitHandler).Post("/session", s.handleCreate)
+		r.Post("/session/validate", s.handleValidate)
+		r.Post("/session/status", s.handleBatchStatus)
 		r.Delete("/session/{token}", s.handleDelete)
 		r.Get("/session/{token}/status", s.handleStatus)
 		r.Get("/session/{token}/statusevents", s.handleStatusEvents)
@@ -215,8 +443,22 @@ func (s *Server) Handler() http.Handler {
 		r.Get("/session/{token}/getproof", s.handleJwtProofs) // irma_api_server-compatible JWT
 
 		r.Get("/publickey", s.handlePublicKey)
+		r.Get("/jwks.json", s.handleJwks)
+		r.Get("/openapi.json", s.handleOpenAPI)
 	})
 
+	if s.conf.AdminToken != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(s.adminAuthenticator)
+			r.Get("/admin/sessions", s.handleAdminSessions)
+			if s.conf.EnableMetrics {
+				registry := prometheus.NewRegistry()
+				registry.MustRegister(s.conf.Metrics, prometheus.NewGoCollector())
+				r.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+			}
+		})
+	}
+
 	return router
 }
 
@@ -240,7 +482,7 @@ func (s *Server) logHandler(typ string, logResponse, logHeaders, logFrom bool) f
 				headers = r.Header
 			}
 			if logFrom {
-				from = r.RemoteAddr
+				from = ClientIP(r).String()
 			}
 			server.LogRequest(typ, r.Method, r.URL.String(), from, headers, message)
 
@@ -281,82 +523,235 @@ func (s *Server) StaticFilesHandler() http.Handler {
 	)
 }
 
+// HealthStatus is returned by the health check endpoint. The endpoint responds with 503 if no
+// schemes are loaded or if the last scheme update failed. While the schemes are being updated
+// the status is "updating", but the server keeps serving sessions using the current schemes, so
+// the endpoint then responds with 200.
+type HealthStatus struct {
+	Status   string `json:"status"`
+	Schemes  int    `json:"schemes"`
+	Sessions int    `json:"sessions"`
+
+	// Number of consecutive failed scheme updates, and completion time of the last successful one
+	SchemeUpdateFailures int        `json:"scheme_update_failures,omitempty"`
+	LastSchemeUpdate     *time.Time `json:"last_scheme_update,omitempty"`
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := HealthStatus{
+		Status:   "ok",
+		Schemes:  s.conf.IrmaConfiguration.SchemeCount(),
+		Sessions: s.irmaserv.SessionCount(),
+	}
+	status := http.StatusOK
+
+	failures, lastSuccess := s.conf.IrmaConfiguration.SchemeUpdateHistory()
+	health.SchemeUpdateFailures = failures
+	if !lastSuccess.IsZero() {
+		health.LastSchemeUpdate = &lastSuccess
+	}
+
+	updating, err := s.conf.IrmaConfiguration.SchemeUpdateStatus()
+	switch {
+	case err != nil || health.Schemes == 0:
+		health.Status = "error"
+		status = http.StatusServiceUnavailable
+	case updating:
+		health.Status = "updating"
+	}
+
+	bts, _ := json.Marshal(health)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bts)
+}
+
+// adminAuthenticator is middleware that allows only requests with the admin token in the
+// Authorization header, optionally as a bearer token (as e.g. Prometheus sends it).
+func (s *Server) adminAuthenticator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare(token, []byte(s.conf.AdminToken)) != 1 {
+			s.conf.Logger.Warn("Unauthorized request to admin endpoint from ", s.conf.clientIP(r))
+			server.WriteError(w, server.ErrorUnauthorized, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.irmaserv.Sessions())
+}
+
 func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	rrequest, requestor, ok := s.authorizedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Everything is authenticated and parsed, we're good to go!
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		server.WriteError(w, server.ErrorInvalidRequest, "idempotency key too long")
+		return
+	}
+	encodings, err := parseQrEncodings(r.URL.Query().Get("qr"))
 	if err != nil {
-		s.conf.Logger.Error("Could not read session request HTTP POST body")
-		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
+	qr, token, err := s.startDedupedSession(r.Context(), rrequest, requestor, idempotencyKey)
+	if err != nil {
+		writeStartSessionError(w, err)
+		return
+	}
+	qr = withHost(qr, s.conf.requestHost(r))
+
+	pkg := server.SessionPackage{
+		SessionPtr:    qr,
+		Token:         token,
+		PairingCode:   s.irmaserv.GetPairingCodeContext(r.Context(), token),
+		CorrelationID: rrequest.Base().CorrelationID,
+	}
+	if err = addQrEncodings(&pkg, encodings); err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, pkg)
+}
+
+// startDedupedSession starts the session, unless the requestor enabled deduplication and recently
+// started an identical session that no client has connected to yet, in which case the QR and
+// token of that session are returned. Idempotency keys take precedence over deduplication.
+func (s *Server) startDedupedSession(ctx context.Context, rrequest irma.RequestorRequest, requestor, idempotencyKey string) (*irma.Qr, string, error) {
+	window := s.conf.Requestors[requestor].DedupeWindow
+	if window <= 0 || idempotencyKey != "" {
+		opts := &server.SessionOptions{Requestor: requestor, IdempotencyKey: idempotencyKey}
+		return s.irmaserv.StartSessionContext(ctx, rrequest, opts, s.doResultCallback)
+	}
+
+	// Hash the request before starting the session, which may modify it
+	key, err := dedupeKey(requestor, rrequest)
+	if err != nil {
+		return nil, "", err
+	}
+	// Look up, start and remember the session while holding the lock of the key, so that
+	// identical concurrent requests return the session started by the first one
+	unlock := s.dedupe.lock(key)
+	defer unlock()
+	if qr, token := s.dedupe.get(key, time.Now()); qr != nil {
+		res := s.irmaserv.GetSessionResultContext(ctx, token)
+		if res != nil && res.Status == server.StatusInitialized {
+			s.conf.Logger.WithFields(logrus.Fields{"session": token, "requestor": requestor}).
+				Info("Identical session request within dedupe window, returning existing session")
+			return qr, token, nil
+		}
+		s.dedupe.remove(key)
+	}
+
+	qr, token, err := s.irmaserv.StartSessionContext(ctx, rrequest, &server.SessionOptions{Requestor: requestor}, s.doResultCallback)
+	if err != nil {
+		return nil, "", err
+	}
+	s.dedupe.put(key, qr, token, time.Duration(window)*time.Second, time.Now())
+	return qr, token, nil
+}
+
+// handleValidate checks a session request like handleCreate does, and returns it as parsed by the
+// server, without starting a session.
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	rrequest, _, ok := s.authorizedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rrequest, err := s.irmaserv.ValidateRequest(rrequest)
+	if err != nil {
+		writeStartSessionError(w, err)
+		return
+	}
+	server.WriteJson(w, rrequest)
+}
+
+// authorizedRequest reads the session request from the HTTP request, authenticates the requestor,
+// and checks that the requestor is authorized to start the session. If not, an error is written to
+// w and false is returned. The caller must hold a read lock on confLock.
+func (s *Server) authorizedRequest(w http.ResponseWriter, r *http.Request) (irma.RequestorRequest, string, bool) {
+	body, rerr := server.ReadBody(w, r, s.conf.MaxRequestBodyBytes)
+	if rerr != nil {
+		s.conf.Logger.Error("Could not read session request HTTP POST body")
+		server.WriteResponse(w, nil, rerr)
+		return nil, "", false
+	}
+	if body, rerr = s.conf.resolveTemplate(body); rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return nil, "", false
+	}
 
 	// Authenticate request: check if the requestor is known and allowed to submit requests.
-	// We do this by feeding the HTTP POST details to all known authenticators, and see if
-	// one of them is applicable and able to authenticate the request.
+	// Unless a custom authenticator is configured, we do this by feeding the HTTP POST details
+	// to all known authenticators, and see if one of them is applicable and able to authenticate
+	// the request.
 	var (
 		rrequest  irma.RequestorRequest
-		request   irma.SessionRequest
 		requestor string
-		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
-		applies, rrequest, requestor, rerr = authenticator.Authenticate(r.Header, body)
-		if applies || rerr != nil {
-			break
+	if s.conf.Authenticator != nil {
+		applies = true
+		rrequest, requestor, rerr = s.customAuthenticate(r, body)
+	} else {
+		for _, authenticator := range s.authenticators { // rrequest abbreviates "requestor request"
+			applies, rrequest, requestor, rerr = authenticator.Authenticate(r.Header, body)
+			if applies || rerr != nil {
+				break
+			}
 		}
 	}
 	if rerr != nil {
 		_ = server.LogError(rerr)
 		server.WriteResponse(w, nil, rerr)
-		return
+		return nil, "", false
 	}
 	if !applies {
 		s.conf.Logger.Warnf("Session request uses unknown authentication method, HTTP headers: %s, HTTP POST body: %s",
 			server.ToJson(r.Header), string(body))
 		server.WriteError(w, server.ErrorInvalidRequest, "Request could not be authorized")
-		return
+		return nil, "", false
 	}
 
-	// Authorize request: check if the requestor is allowed to verify or issue
-	// the requested attributes or credentials
-	request = rrequest.SessionRequest()
-	if request.Action() == irma.ActionIssuing {
-		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
-	}
-	condiscon := request.Disclosure().Disclose
-	if len(condiscon) > 0 {
-		allowed, reason := s.conf.CanVerifyOrSign(requestor, request.Action(), condiscon)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
+	// Authorize request: check if the requestor is allowed to verify or issue the requested
+	// attributes or credentials, and apply any custom validators
+	if rerr = s.conf.validateRequest(requestor, rrequest); rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return nil, "", false
 	}
 	if rrequest.Base().CallbackURL != "" && s.conf.jwtPrivateKey == nil {
 		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided callbackUrl but no JWT private key is installed")
 		server.WriteError(w, server.ErrorUnsupported, "")
-		return
+		return nil, "", false
 	}
 
-	// Everything is authenticated and parsed, we're good to go!
-	qr, token, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	return rrequest, requestor, true
+}
+
+// customAuthenticate parses the session request from the HTTP request body and authenticates its
+// requestor using the custom authenticator of the configuration.
+func (s *Server) customAuthenticate(r *http.Request, body []byte) (irma.RequestorRequest, string, *irma.RemoteError) {
+	rrequest, err := server.ParseSessionRequest(body)
 	if err != nil {
-		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
-		return
+		return nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
-
-	server.WriteJson(w, server.SessionPackage{
-		SessionPtr: qr,
-		Token:      token,
-	})
+	requestor, err := s.conf.Authenticator.Authenticate(r, rrequest)
+	if err != nil {
+		return nil, "", server.RemoteError(server.ErrorUnauthorized, err.Error())
+	}
+	return rrequest, requestor, nil
 }
 
 func (s *Server) handleCreateStatic(w http.ResponseWriter, r *http.Request) {
@@ -368,14 +763,47 @@ func (s *Server) handleCreateStatic(w http.ResponseWriter, r *http.Request) {
 	}
 	qr, _, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
 	if err != nil {
-		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		writeStartSessionError(w, err)
 		return
 	}
-	server.WriteJson(w, qr)
+	server.WriteJson(w, withHost(qr, s.conf.requestHost(r)))
 }
 
+// writeStartSessionError writes an error returned by StartSession() to the requestor: as is, if the
+// session could not be started for a reason not attributable to the request (e.g. too many sessions),
+// and as an invalid request otherwise.
+func writeStartSessionError(w http.ResponseWriter, err error) {
+	if rerr, ok := err.(*irma.RemoteError); ok {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+}
+
+// handleStatus returns the status of the session as a bare JSON string, which existing clients
+// (e.g. irmajs) parse as is. The label of the session is therefore not included here nor in the
+// batch status and server sent event responses; requestors can obtain it from the session result.
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
-	res := s.irmaserv.GetSessionResult(chi.URLParam(r, "token"))
+	// Long polling: if asked to, wait until the status differs from the one the requestor last saw
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		seconds, err := strconv.Atoi(wait)
+		if err != nil || seconds < 0 {
+			server.WriteError(w, server.ErrorInvalidRequest, "wait must be a nonnegative amount of seconds")
+			return
+		}
+		if seconds > maxStatusWait {
+			seconds = maxStatusWait
+		}
+		status, err := s.irmaserv.WaitStatusContext(r.Context(), chi.URLParam(r, "token"), server.Status(r.URL.Query().Get("status")), time.Duration(seconds)*time.Second)
+		if err != nil {
+			server.WriteError(w, server.ErrorSessionUnknown, "")
+			return
+		}
+		server.WriteJson(w, status)
+		return
+	}
+
+	res := s.irmaserv.GetSessionResultContext(r.Context(), chi.URLParam(r, "token"))
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
@@ -383,31 +811,63 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, res.Status)
 }
 
+// handleBatchStatus returns the statuses of the sessions whose tokens are posted as a JSON array,
+// as a map from token to status. Unknown or expired sessions have status StatusUnknown. Like
+// handleStatus, this omits the session labels so that statuses have a single representation.
+func (s *Server) handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	body, rerr := server.ReadBody(w, r, s.conf.MaxRequestBodyBytes)
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	var tokens []string
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	if len(tokens) > maxBatchStatusTokens {
+		server.WriteError(w, server.ErrorInvalidRequest, fmt.Sprintf("at most %d tokens allowed", maxBatchStatusTokens))
+		return
+	}
+
+	statuses := make(map[string]server.Status, len(tokens))
+	for _, token := range tokens {
+		statuses[token] = server.StatusUnknown
+		if res := s.irmaserv.GetSessionResultContext(r.Context(), token); res != nil {
+			statuses[token] = res.Status
+		}
+	}
+	server.WriteJson(w, statuses)
+}
+
 func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.conf.EnableSSE {
+		server.WriteError(w, server.ErrorSSEDisabled, "")
+		return
+	}
 	token := chi.URLParam(r, "token")
 	s.conf.Logger.WithFields(logrus.Fields{"session": token}).Debug("new client subscribed to server sent events")
 	if err := s.irmaserv.SubscribeServerSentEvents(w, r, token, true); err != nil {
-		server.WriteResponse(w, nil, &irma.RemoteError{
-			Status:      server.ErrorUnsupported.Status,
-			ErrorName:   string(server.ErrorUnsupported.Type),
-			Description: server.ErrorUnsupported.Description,
-		})
+		server.WriteResponse(w, nil, irma.NewRemoteError(
+			server.ErrorUnsupported.Status, string(server.ErrorUnsupported.Type), server.ErrorUnsupported.Description, "",
+		))
 	}
 }
 
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	err := s.irmaserv.CancelSession(chi.URLParam(r, "token"))
+	err := s.irmaserv.CancelSessionContext(r.Context(), chi.URLParam(r, "token"))
 	if err != nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 	}
 }
 
 func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
-	res := s.irmaserv.GetSessionResult(chi.URLParam(r, "token"))
+	res := s.irmaserv.GetSessionResultContext(r.Context(), chi.URLParam(r, "token"))
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
 	}
+	res = s.conf.RedactResult(res)
 	if res.LegacySession {
 		server.WriteJson(w, res.Legacy())
 	} else {
@@ -423,7 +883,7 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessiontoken := chi.URLParam(r, "token")
-	res := s.irmaserv.GetSessionResult(sessiontoken)
+	res := s.irmaserv.GetSessionResultContext(r.Context(), sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
@@ -447,7 +907,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessiontoken := chi.URLParam(r, "token")
-	res := s.irmaserv.GetSessionResult(sessiontoken)
+	res := s.irmaserv.GetSessionResultContext(r.Context(), sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
@@ -472,7 +932,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 		claims["iss"] = s.conf.JwtIssuer
 	}
 	claims["status"] = res.ProofStatus
-	validity := s.irmaserv.GetRequest(sessiontoken).Base().ResultJwtValidity
+	validity := s.irmaserv.GetRequestContext(r.Context(), sessiontoken).Base().ResultJwtValidity
 	if validity != 0 {
 		claims["exp"] = time.Now().Unix() + int64(validity)
 	}
@@ -490,8 +950,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.jwtPrivateKey)
+	resultJwt, err := s.signJwt(claims)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
@@ -519,30 +978,80 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(pubBytes)
 }
 
+// jwk is a JSON Web Key (RFC 7517) containing an RSA public key.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+func rsaJwk(pk *rsa.PublicKey, kid string) jwk {
+	return jwk{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: jwt.SigningMethodRS256.Name,
+		KeyID:     kid,
+		Modulus:   base64.RawURLEncoding.EncodeToString(pk.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pk.E)).Bytes()),
+	}
+}
+
+// jwkThumbprint computes the JWK thumbprint (RFC 7638) of the public key, which is used as its
+// key ID. As it depends only on the key, it remains the same across restarts.
+func jwkThumbprint(pk *rsa.PublicKey) string {
+	key := rsaJwk(pk, "")
+	// Required members only, in lexicographic order and without whitespace, as per the RFC
+	hash := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.Exponent, key.Modulus)))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func (s *Server) handleJwks(w http.ResponseWriter, r *http.Request) {
+	if s.conf.jwtPrivateKey == nil {
+		server.WriteError(w, server.ErrorUnsupported, "")
+		return
+	}
+	server.WriteJson(w, struct {
+		Keys []jwk `json:"keys"`
+	}{s.conf.jwtPublicKeys})
+}
+
 func (s *Server) resultJwt(sessionresult *server.SessionResult) (string, error) {
 	standardclaims := jwt.StandardClaims{
 		Issuer:   s.conf.JwtIssuer,
 		IssuedAt: time.Now().Unix(),
 		Subject:  string(sessionresult.Type) + "_result",
 	}
-	validity := s.irmaserv.GetRequest(sessionresult.Token).Base().ResultJwtValidity
-	standardclaims.ExpiresAt = time.Now().Unix() + int64(validity)
+	base := s.irmaserv.GetRequest(sessionresult.Token).Base()
+	standardclaims.ExpiresAt = time.Now().Unix() + int64(base.ResultJwtValidity)
 
+	// The claims of the requestor are namespaced in a single claim, so they cannot override ours
 	var claims jwt.Claims
 	if sessionresult.LegacySession {
 		claims = struct {
 			jwt.StandardClaims
 			*server.LegacySessionResult
-		}{standardclaims, sessionresult.Legacy()}
+			ClientReturnClaims map[string]interface{} `json:"clientReturnClaims,omitempty"`
+		}{standardclaims, sessionresult.Legacy(), base.ClientReturnClaims}
 	} else {
 		claims = struct {
 			jwt.StandardClaims
 			*server.SessionResult
-		}{standardclaims, sessionresult}
+			ClientReturnClaims map[string]interface{} `json:"clientReturnClaims,omitempty"`
+		}{standardclaims, sessionresult, base.ClientReturnClaims}
 	}
 
 	// Sign the jwt and return it
+	return s.signJwt(claims)
+}
+
+// signJwt signs a JWT containing the specified claims with the JWT private key, including
+// the ID of the key in the header so that verifiers can select it from our JWK set.
+func (s *Server) signJwt(claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.conf.jwtKeyID
 	return token.SignedString(s.conf.jwtPrivateKey)
 }
 
@@ -568,7 +1077,7 @@ func (s *Server) doResultCallback(result *server.SessionResult) {
 			return
 		}
 	} else {
-		bts, err := json.Marshal(result)
+		bts, err := json.Marshal(s.conf.RedactResult(result))
 		if err != nil {
 			_ = server.LogError(errors.WrapPrefix(err, "Failed to marshal session result for result callback", 0))
 			return
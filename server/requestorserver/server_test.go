@@ -0,0 +1,680 @@
+package requestorserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer returns a server using the test schemes, configured with conf if not nil.
+// Requestor authentication is disabled unless conf configures requestors or an authenticator.
+func newTestServer(t *testing.T, conf *Configuration) *Server {
+	irmaconf, err := irma.NewConfigurationReadOnly(filepath.Join("..", "..", "testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+
+	if conf == nil {
+		conf = &Configuration{}
+	}
+	if conf.Configuration == nil {
+		conf.Configuration = &server.Configuration{}
+	}
+	conf.IrmaConfiguration = irmaconf
+	conf.Logger = server.NewLogger(0, true, false)
+	conf.DisableSchemesUpdate = true
+	if conf.Port == 0 {
+		conf.Port = 8088
+	}
+	if len(conf.Requestors) == 0 && conf.Authenticator == nil {
+		conf.DisableRequestorAuthentication = true
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	return s
+}
+
+// startSession posts a disclosure request to the handler, authenticated with the specified
+// preshared key if not empty.
+func startSession(t *testing.T, handler http.Handler, token string) *httptest.ResponseRecorder {
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/session", bytes.NewReader(bts))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	s := &Server{conf: &Configuration{WriteTimeout: 1}}
+	handler := s.timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/token/status", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Server sent event streams and long-polling requests are exempt from the write timeout
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/token/statusevents", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/token/status?wait=2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLongPollPastWriteTimeout(t *testing.T) {
+	s := newTestServer(t, &Configuration{WriteTimeout: 1})
+	defer s.Stop(context.Background())
+	handler := s.timeoutHandler(s.Handler())
+
+	w := startSession(t, handler, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+
+	// The status does not change, so the request waits for 2 seconds, longer than the write timeout
+	start := time.Now()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/"+pkg.Token+"/status?wait=2&status=INITIALIZED", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, time.Since(start) >= 2*time.Second)
+	var status server.Status
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, server.StatusInitialized, status)
+}
+
+func TestReadTimeoutHandler(t *testing.T) {
+	s := &Server{conf: &Configuration{ReadTimeout: 1}}
+	errs := make(chan error, 1)
+	ts := httptest.NewServer(s.readTimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			errs <- err
+			return
+		}
+		// Once the body has been read, the request may take longer than the read timeout
+		select {
+		case <-time.After(1500 * time.Millisecond):
+			errs <- nil
+		case <-r.Context().Done():
+			errs <- r.Context().Err()
+		}
+	})))
+	defer ts.Close()
+
+	// A client that does not finish sending its body is cut off after the read timeout
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /session HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n{"))
+	require.NoError(t, err)
+	select {
+	case err = <-errs:
+		require.Error(t, err)
+	case <-time.After(3 * time.Second):
+		require.Fail(t, "reading the request body did not time out")
+	}
+
+	// A client that sends its body in time is not
+	res, err := http.Post(ts.URL+"/session", "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.NoError(t, <-errs)
+}
+
+func TestStatusEventsDisabled(t *testing.T) {
+	s := &Server{conf: &Configuration{Configuration: &server.Configuration{}}}
+	w := httptest.NewRecorder()
+	s.handleStatusEvents(w, httptest.NewRequest(http.MethodGet, "/session/token/statusevents", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 2)
+	now := time.Now()
+	require.True(t, l.allow("a", now))
+	require.True(t, l.allow("a", now))
+	require.False(t, l.allow("a", now))
+	require.True(t, l.allow("b", now)) // buckets are per key
+
+	// Tokens are replenished at one per second
+	require.False(t, l.allow("a", now.Add(500*time.Millisecond)))
+	require.True(t, l.allow("a", now.Add(1500*time.Millisecond)))
+}
+
+func TestClientIP(t *testing.T) {
+	conf := &Configuration{}
+	r := httptest.NewRequest(http.MethodPost, "/session", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.1, 10.0.0.2")
+	require.Equal(t, "10.0.0.1", conf.clientIP(r).String())
+
+	// X-Forwarded-For is only used if the request comes from a trusted proxy, and trusted proxies are skipped
+	var err error
+	conf.trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", conf.clientIP(r).String())
+	r.RemoteAddr = "192.0.2.2:1234"
+	require.Equal(t, "192.0.2.2", conf.clientIP(r).String())
+
+	// The address is made available to handlers through ClientIP
+	r.RemoteAddr = "10.0.0.1:1234"
+	s := &Server{conf: conf}
+	s.clientIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "192.0.2.1", ClientIP(r).String())
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(t, "10.0.0.1", ClientIP(r).String())
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Server{}).handleOpenAPI(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var spec struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+	require.Equal(t, "3.0.3", spec.OpenAPI)
+	for _, path := range []string{"/session", "/session/{token}/status", "/session/{token}/result", "/admin/sessions"} {
+		require.Contains(t, spec.Paths, path)
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	s := &Server{conf: &Configuration{EnableCompression: true, CompressionMinBytes: 100}}
+	body := []byte(`{"status":"DONE"}`)
+	handler := s.compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i := 0; i < 10; i++ {
+			_, _ = w.Write(body)
+		}
+	}))
+	request := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("/session/token/result", "deflate, gzip;q=0.5")
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Empty(t, w.Header().Get("Content-Length"))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat(body, 10), decompressed)
+
+	// Not compressed if not accepted by the client, for server sent events, or below the threshold
+	for _, w = range []*httptest.ResponseRecorder{
+		request("/session/token/result", "gzip;q=0"),
+		request("/session/token/statusevents", "gzip"),
+	} {
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Equal(t, bytes.Repeat(body, 10), w.Body.Bytes())
+	}
+	s.conf.CompressionMinBytes = 1000
+	w = request("/session/token/result", "gzip")
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Equal(t, "170", w.Header().Get("Content-Length"))
+	require.Equal(t, bytes.Repeat(body, 10), w.Body.Bytes())
+}
+
+func TestCompressHandlerEncoded(t *testing.T) {
+	s := &Server{conf: &Configuration{EnableCompression: true, CompressionMinBytes: 10}}
+	request := func(handler http.Handler) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		s.compressHandler(handler).ServeHTTP(w, r)
+		return w
+	}
+
+	// The metrics handler gzips its response itself, which must not be compressed again
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	w := request(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Contains(t, string(decompressed), "go_goroutines")
+
+	// Handlers can flush the response, which is then written uncompressed
+	w = request(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		_, _ = w.Write([]byte("event"))
+		flusher.Flush()
+		_, _ = w.Write([]byte(": ping, which makes it large enough to compress"))
+	}))
+	require.True(t, w.Flushed)
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Equal(t, "event: ping, which makes it large enough to compress", w.Body.String())
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Stop(context.Background())
+	health := func() (int, HealthStatus) {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var status HealthStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return w.Code, status
+	}
+
+	code, status := health()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", status.Status)
+	require.Equal(t, len(s.conf.IrmaConfiguration.SchemeManagers), status.Schemes)
+
+	// Without schemes the server is unhealthy
+	dir, err := ioutil.TempDir("", "schemes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	empty, err := irma.NewConfigurationReadOnly(dir)
+	require.NoError(t, err)
+	require.NoError(t, empty.ParseFolder())
+	s.conf.IrmaConfiguration = empty
+	code, status = health()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "error", status.Status)
+	require.Zero(t, status.Schemes)
+}
+
+func TestReload(t *testing.T) {
+	requestor := func(token string) Requestor {
+		return Requestor{AuthenticationMethod: AuthenticationMethodToken, AuthenticationKey: token}
+	}
+	permissions := Permissions{Disclosing: []string{"*"}}
+	s := newTestServer(t, &Configuration{
+		Permissions: permissions,
+		Requestors:  map[string]Requestor{"old": requestor("oldtoken")},
+	})
+	defer s.Stop(context.Background())
+	handler := s.Handler()
+	require.Equal(t, http.StatusOK, startSession(t, handler, "oldtoken").Code)
+	require.Equal(t, http.StatusForbidden, startSession(t, handler, "newtoken").Code)
+
+	require.NoError(t, s.Reload(&Configuration{
+		Permissions: permissions,
+		Requestors:  map[string]Requestor{"new": requestor("newtoken")},
+	}))
+	require.Equal(t, http.StatusOK, startSession(t, handler, "newtoken").Code)
+	require.Equal(t, http.StatusForbidden, startSession(t, handler, "oldtoken").Code)
+
+	// Servers do not share their requestors
+	other := newTestServer(t, &Configuration{
+		Permissions: permissions,
+		Requestors:  map[string]Requestor{"other": requestor("othertoken")},
+	})
+	defer other.Stop(context.Background())
+	require.Equal(t, http.StatusOK, startSession(t, other.Handler(), "othertoken").Code)
+	require.Equal(t, http.StatusForbidden, startSession(t, handler, "othertoken").Code)
+	require.Equal(t, http.StatusOK, startSession(t, handler, "newtoken").Code)
+}
+
+func TestCorsAllowedOrigins(t *testing.T) {
+	// allowedOrigin returns the origin allowed by the server in response to a preflight request
+	allowedOrigin := func(handler http.Handler, path, origin string) string {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	// By default, all origins are allowed
+	s := newTestServer(t, nil)
+	defer s.Stop(context.Background())
+	require.NotEmpty(t, allowedOrigin(s.Handler(), "/session", "https://evil.example.org"))
+
+	s = newTestServer(t, &Configuration{CorsAllowedOrigins: []string{"https://example.com"}})
+	defer s.Stop(context.Background())
+	handler := s.Handler()
+	require.Equal(t, "https://example.com", allowedOrigin(handler, "/session", "https://example.com"))
+	require.Empty(t, allowedOrigin(handler, "/session", "https://evil.example.org"))
+	require.Empty(t, allowedOrigin(handler, "/session/token/result", "https://evil.example.org"))
+
+	// The endpoints of the IRMA app remain accessible from any origin
+	require.NotEmpty(t, allowedOrigin(handler, "/irma/session/token", "https://evil.example.org"))
+}
+
+func TestMaxSessions(t *testing.T) {
+	s := newTestServer(t, &Configuration{Configuration: &server.Configuration{MaxSessions: 1}})
+	defer s.Stop(context.Background())
+	handler := s.Handler()
+	require.Equal(t, http.StatusOK, startSession(t, handler, "").Code)
+
+	// The error is passed on as is instead of as an invalid request, as it is not the requestor's fault
+	w := startSession(t, handler, "")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var rerr irma.RemoteError
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerr))
+	require.Equal(t, string(server.ErrorTooManySessions.Type), rerr.ErrorName)
+}
+
+func TestAdminSessions(t *testing.T) {
+	sessions := func(handler http.Handler, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without an admin token the endpoint does not exist
+	s := newTestServer(t, nil)
+	defer s.Stop(context.Background())
+	require.Equal(t, http.StatusNotFound, sessions(s.Handler(), "").Code)
+
+	s = newTestServer(t, &Configuration{
+		Permissions: Permissions{Disclosing: []string{"*"}},
+		Requestors:  map[string]Requestor{"requestor": {AuthenticationMethod: AuthenticationMethodToken, AuthenticationKey: "token"}},
+		AdminToken:  "admintoken",
+	})
+	defer s.Stop(context.Background())
+	handler := s.Handler()
+	w := startSession(t, handler, "token")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+
+	require.Equal(t, http.StatusForbidden, sessions(handler, "token").Code)
+	w = sessions(handler, "admintoken")
+	require.Equal(t, http.StatusOK, w.Code)
+	var infos []server.SessionInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+	require.Equal(t, pkg.Token, infos[0].Token)
+	require.Equal(t, "requestor", infos[0].Requestor)
+	require.Equal(t, irma.ActionDisclosing, infos[0].Type)
+	require.Equal(t, server.StatusInitialized, infos[0].Status)
+	require.False(t, infos[0].Created.IsZero())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := newTestServer(t, &Configuration{
+		Configuration: &server.Configuration{EnableMetrics: true},
+		Permissions:   Permissions{Disclosing: []string{"*"}},
+		AdminToken:    "admintoken",
+	})
+	defer s.Stop(context.Background())
+	handler := s.Handler()
+	require.Equal(t, http.StatusOK, startSession(t, handler, "").Code)
+
+	metrics := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	require.Equal(t, http.StatusForbidden, metrics("").Code)
+	require.Equal(t, http.StatusForbidden, metrics("Bearer wrong").Code)
+
+	// Unauthorized requests are logged with the client IP, taking trusted proxies into account
+	var logs bytes.Buffer
+	s.conf.Logger.Out = &logs
+	s.conf.trustedProxies, _ = parseTrustedProxies([]string{"192.0.2.1"})
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	require.Contains(t, logs.String(), "198.51.100.7")
+	for _, token := range []string{"admintoken", "Bearer admintoken"} {
+		w := metrics(token)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `irma_server_sessions_created_total{action="disclosing"} 1`+"\n")
+		require.Contains(t, w.Body.String(), `irma_server_sessions_active{action="disclosing"} 1`+"\n")
+	}
+
+	// Metrics cannot be enabled without authenticating them
+	conf := &Configuration{Configuration: &server.Configuration{EnableMetrics: true}, Port: 8088}
+	require.Error(t, conf.Validate())
+	conf.AdminToken = "admintoken"
+	require.NoError(t, conf.Validate())
+}
+
+func TestQrEncodings(t *testing.T) {
+	encodings, err := parseQrEncodings("json, url,image")
+	require.NoError(t, err)
+	require.Equal(t, []string{"json", "url", "image"}, encodings)
+	_, err = parseQrEncodings("json,svg")
+	require.Error(t, err)
+
+	qr := &irma.Qr{URL: "https://example.com/irma/session/abc", Type: irma.ActionDisclosing}
+	pkg := server.SessionPackage{SessionPtr: qr}
+	require.NoError(t, addQrEncodings(&pkg, nil))
+	require.Empty(t, pkg.QrJSON)
+
+	require.NoError(t, addQrEncodings(&pkg, encodings))
+	var parsed irma.Qr
+	require.NoError(t, json.Unmarshal([]byte(pkg.QrJSON), &parsed))
+	require.Equal(t, *qr, parsed)
+	require.True(t, strings.HasPrefix(pkg.QrURL, qrURLPrefix))
+	unescaped, err := url.PathUnescape(strings.TrimPrefix(pkg.QrURL, qrURLPrefix))
+	require.NoError(t, err)
+	require.Equal(t, pkg.QrJSON, unescaped)
+
+	require.True(t, strings.HasPrefix(pkg.QrImage, "data:image/png;base64,"))
+	png, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pkg.QrImage, "data:image/png;base64,"))
+	require.NoError(t, err)
+	require.Equal(t, "image/png", http.DetectContentType(png))
+}
+
+func TestDeriveURLFromRequest(t *testing.T) {
+	conf := &Configuration{
+		Configuration:  &server.Configuration{URL: "https://irma.example.com/irma/", Logger: server.NewLogger(0, true, false)},
+		AllowedHosts:   []string{"irma.internal", "irma.example.org:8443"},
+		TrustedProxies: []string{"10.0.0.1"},
+	}
+	var err error
+	conf.trustedProxies, err = parseTrustedProxies(conf.TrustedProxies)
+	require.NoError(t, err)
+	qr := &irma.Qr{URL: "https://irma.example.com/irma/session/abc", Type: irma.ActionDisclosing}
+	host := func(host, remote, forwarded string) string {
+		r := httptest.NewRequest(http.MethodPost, "/session", nil)
+		r.Host, r.RemoteAddr = host, remote+":1234"
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-Host", forwarded)
+		}
+		return withHost(qr, conf.requestHost(r)).URL
+	}
+
+	// Disabled by default
+	require.Equal(t, qr.URL, host("irma.internal", "192.0.2.1", ""))
+
+	conf.DeriveURLFromRequest = true
+	require.Equal(t, "https://irma.internal/irma/session/abc", host("irma.internal", "192.0.2.1", ""))
+	require.Equal(t, "https://irma.internal:8080/irma/session/abc", host("irma.internal:8080", "192.0.2.1", ""))
+	require.Equal(t, qr.URL, host("irma.example.org", "192.0.2.1", ""))
+	require.Equal(t, "https://irma.example.org:8443/irma/session/abc", host("irma.example.org:8443", "192.0.2.1", ""))
+	require.Equal(t, qr.URL, host("evil.example", "192.0.2.1", ""))
+
+	// X-Forwarded-Host is only used from trusted proxies
+	require.Equal(t, "https://irma.internal/irma/session/abc", host("irma.internal", "192.0.2.1", "evil.example"))
+	require.Equal(t, qr.URL, host("evil.example", "192.0.2.1", "irma.internal"))
+	require.Equal(t, "https://irma.internal/irma/session/abc", host("proxy", "10.0.0.1", "evil.example, irma.internal"))
+	require.Equal(t, qr.URL, host("irma.internal", "10.0.0.1", "evil.example"))
+	require.Equal(t, "https://irma.example.com/irma/session/abc", qr.URL) // not modified
+
+	conf.URL = ""
+	err = conf.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "derive_url_from_request requires url and allowed_hosts")
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	s := &Server{conf: &Configuration{
+		Configuration: &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		DebugAddress:  "127.0.0.1:0",
+	}}
+	s.stopping = true
+
+	// Servers that are started after stopping return immediately instead of running forever
+	done := make(chan error, 1)
+	go func() {
+		s.startDebugServer()
+		done <- s.startServer(http.NotFoundHandler(), "Server", "127.0.0.1", 0, nil)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server started after stopping")
+	}
+	require.Empty(t, s.servers)
+}
+
+func TestDebugHandler(t *testing.T) {
+	counts := func(status server.Status) func() map[server.Status]int {
+		return func() map[server.Status]int { return map[server.Status]int{status: 1} }
+	}
+	handler := debugHandler(counts(server.StatusConnected))
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/heap", "/debug/pprof/profile?seconds=1", "/debug/vars"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, w.Code, path)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/nonexisting", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// Each handler reports the sessions of its own server
+	other := debugHandler(counts(server.StatusDone))
+	for status, h := range map[server.Status]http.Handler{server.StatusConnected: handler, server.StatusDone: other} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+		var vars struct {
+			Irmaserver struct {
+				Sessions map[server.Status]int `json:"sessions"`
+			} `json:"irmaserver"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+		require.Equal(t, map[server.Status]int{status: 1}, vars.Irmaserver.Sessions)
+	}
+
+	// Nothing is registered on the default mux
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, path, nil))
+		require.Empty(t, pattern, path)
+	}
+
+	conf := &Configuration{
+		Configuration: &server.Configuration{URL: "http://localhost/irma"},
+		Port:          8088,
+		DebugAddress:  "localhost",
+	}
+	require.Error(t, conf.Validate())
+	conf.DebugAddress = "localhost:6060"
+	require.NoError(t, conf.Validate())
+}
+
+func TestDedupeCache(t *testing.T) {
+	request := func(label string) irma.RequestorRequest {
+		req := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"))
+		req.Labels = map[int]irma.TranslatedString{0: {"en": label}}
+		return &irma.ServiceProviderRequest{Request: req}
+	}
+	key, err := dedupeKey("requestor", request("a"))
+	require.NoError(t, err)
+	same, err := dedupeKey("requestor", request("a"))
+	require.NoError(t, err)
+	require.Equal(t, key, same)
+	other, err := dedupeKey("requestor", request("b"))
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+	other, err = dedupeKey("other", request("a"))
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+
+	cache := newDedupeCache()
+	now := time.Now()
+	qr := &irma.Qr{URL: "https://example.com/irma/session/abc", Type: irma.ActionDisclosing}
+	cache.put(key, qr, "token", 10*time.Second, now)
+	gotqr, token := cache.get(key, now.Add(5*time.Second))
+	require.Equal(t, qr, gotqr)
+	require.Equal(t, "token", token)
+	gotqr, _ = cache.get(key, now.Add(11*time.Second))
+	require.Nil(t, gotqr)
+
+	// Expired entries are pruned
+	cache.put(other, qr, "token2", 10*time.Second, now.Add(2*time.Minute))
+	require.Len(t, cache.sessions, 1)
+
+	conf := &Configuration{
+		Configuration: &server.Configuration{URL: "http://localhost/irma"},
+		Port:          8088,
+		Requestors:    map[string]Requestor{"requestor": {DedupeWindow: -1}},
+	}
+	err = conf.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dedupe_window of requestor requestor must not be negative")
+}
+
+func TestDedupeConcurrentRequests(t *testing.T) {
+	s := newTestServer(t, &Configuration{
+		Permissions: Permissions{Disclosing: []string{"*"}},
+		Requestors: map[string]Requestor{"requestor": {
+			AuthenticationMethod: AuthenticationMethodToken,
+			AuthenticationKey:    "token",
+			DedupeWindow:         60,
+		}},
+	})
+	defer s.Stop(context.Background())
+
+	// Identical requests started at the same time all return the same session
+	tokens := make(chan string, 10)
+	for i := 0; i < cap(tokens); i++ {
+		go func() {
+			request := &irma.ServiceProviderRequest{
+				Request: irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+			}
+			_, token, err := s.startDedupedSession(context.Background(), request, "requestor", "")
+			if err != nil {
+				token = err.Error()
+			}
+			tokens <- token
+		}()
+	}
+	first := <-tokens
+	for i := 1; i < cap(tokens); i++ {
+		require.Equal(t, first, <-tokens)
+	}
+	require.Equal(t, 1, s.irmaserv.SessionCount())
+	require.Empty(t, s.dedupe.locks)
+}
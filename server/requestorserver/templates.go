@@ -0,0 +1,159 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// RequestTemplate is a session request registered in the configuration, with which requestors can
+// start sessions by posting {"template": "name", "params": {...}} as JSON to /session instead of
+// the entire session request. The resulting session request is authorized as usual, so templates
+// cannot be used to circumvent the permissions of requestors.
+type RequestTemplate struct {
+	// Session request, in which each occurrence of {{param}} in a string is replaced by the
+	// value of that parameter. It must be a valid session request also with the placeholders in place.
+	Request interface{} `json:"request" mapstructure:"request"`
+	// Parameters of the template, mapping their names to a regular expression that their values
+	// must match entirely (any value if empty). All parameters must be supplied, and no others.
+	Params map[string]string `json:"params" mapstructure:"params"`
+}
+
+// requestTemplate is a RequestTemplate as parsed by parseRequestTemplates().
+type requestTemplate struct {
+	request  interface{}               // JSON-unmarshaled session request
+	patterns map[string]*regexp.Regexp // nil for parameters accepting any value
+}
+
+// templateInstance is posted by requestors to start a session using a RequestTemplate.
+type templateInstance struct {
+	Template string            `json:"template"`
+	Params   map[string]string `json:"params"`
+}
+
+var (
+	templateNamePattern  = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+	templateParamPattern = regexp.MustCompile(`\{\{([a-zA-Z0-9_]+)\}\}`)
+)
+
+func (conf *Configuration) parseRequestTemplates() error {
+	conf.requestTemplates = make(map[string]*requestTemplate, len(conf.RequestTemplates))
+	for name, t := range conf.RequestTemplates {
+		if !templateNamePattern.MatchString(name) {
+			return errors.Errorf("request template name %s not allowed, must be alphanumeric", name)
+		}
+		template, err := parseRequestTemplate(t)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse request template "+name, 0)
+		}
+		conf.requestTemplates[name] = template
+	}
+	return nil
+}
+
+func parseRequestTemplate(t RequestTemplate) (*requestTemplate, error) {
+	// Normalize the request, which may be of any type when configured programmatically
+	bts, err := json.Marshal(t.Request)
+	if err != nil {
+		return nil, err
+	}
+	template := &requestTemplate{patterns: make(map[string]*regexp.Regexp, len(t.Params))}
+	if err = json.Unmarshal(bts, &template.request); err != nil {
+		return nil, err
+	}
+	if _, ok := template.request.(map[string]interface{}); !ok {
+		return nil, errors.New("session request must be a JSON object")
+	}
+
+	for param, pattern := range t.Params {
+		if !templateParamPattern.MatchString("{{" + param + "}}") {
+			return nil, errors.Errorf("parameter name %s not allowed, must be alphanumeric", param)
+		}
+		if pattern == "" {
+			template.patterns[param] = nil
+			continue
+		}
+		if template.patterns[param], err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return nil, errors.WrapPrefix(err, "invalid pattern of parameter "+param, 0)
+		}
+	}
+	for _, match := range templateParamPattern.FindAllStringSubmatch(string(bts), -1) {
+		if _, ok := template.patterns[match[1]]; !ok {
+			return nil, errors.Errorf("session request contains undeclared parameter %s", match[1])
+		}
+	}
+
+	// Catch invalid templates at startup instead of when requestors use them. The instances are
+	// still validated when starting their sessions, as parameter values may invalidate them.
+	if _, err = server.ParseSessionRequest(bts); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid session request", 0)
+	}
+	return template, nil
+}
+
+// instantiate checks the parameters against the template, and returns the JSON session request
+// of the template with the parameters substituted.
+func (t *requestTemplate) instantiate(params map[string]string) ([]byte, error) {
+	for param := range params {
+		if _, ok := t.patterns[param]; !ok {
+			return nil, errors.Errorf("unknown template parameter %s", param)
+		}
+	}
+	for param, pattern := range t.patterns {
+		value, ok := params[param]
+		if !ok {
+			return nil, errors.Errorf("template parameter %s missing", param)
+		}
+		if pattern != nil && !pattern.MatchString(value) {
+			return nil, errors.Errorf("value of template parameter %s not allowed", param)
+		}
+	}
+	return json.Marshal(substituteParams(t.request, params))
+}
+
+// substituteParams replaces the parameter placeholders in all strings within the JSON-unmarshaled
+// value. Substituting in the unmarshaled value instead of in the JSON text ensures that parameter
+// values cannot alter the structure of the session request.
+func substituteParams(val interface{}, params map[string]string) interface{} {
+	switch v := val.(type) {
+	case string:
+		return templateParamPattern.ReplaceAllStringFunc(v, func(placeholder string) string {
+			return params[placeholder[2:len(placeholder)-2]]
+		})
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = substituteParams(value, params)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = substituteParams(value, params)
+		}
+		return s
+	default:
+		return val
+	}
+}
+
+// resolveTemplate returns the session request resulting from the template if the HTTP request
+// body instantiates a RequestTemplate, and the body itself otherwise.
+func (conf *Configuration) resolveTemplate(body []byte) ([]byte, *irma.RemoteError) {
+	var instance templateInstance
+	if err := json.Unmarshal(body, &instance); err != nil || instance.Template == "" {
+		return body, nil
+	}
+	template := conf.requestTemplates[instance.Template]
+	if template == nil {
+		return nil, server.RemoteError(server.ErrorInvalidRequest, "unknown request template "+instance.Template)
+	}
+	request, err := template.instantiate(instance.Params)
+	if err != nil {
+		return nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return request, nil
+}
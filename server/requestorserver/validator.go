@@ -0,0 +1,74 @@
+package requestorserver
+
+import (
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestValidator validates session requests of an authenticated requestor, allowing integrators
+// to enforce rules of their own for that requestor (e.g. mandatory attributes); rules for all
+// requestors belong in the RequestFilter of the server configuration. Validators are invoked
+// after the request has been parsed and the requestor authenticated, but before the session is
+// started.
+// If Validate returns an error, the request is refused: with the error as is if it is an
+// *irma.RemoteError, otherwise as ErrorRequestRejected with the error message.
+type RequestValidator interface {
+	Validate(requestor string, request irma.RequestorRequest) error
+}
+
+// permissionValidator is the default RequestValidator, which enforces the permissions of the
+// configuration: which session types the requestor may start, and which attributes and
+// credentials it may verify and issue. It is always applied, before the validator of the requestor.
+type permissionValidator struct {
+	conf *Configuration
+}
+
+func (v permissionValidator) Validate(requestor string, rrequest irma.RequestorRequest) error {
+	conf := v.conf
+	request := rrequest.SessionRequest()
+	if !conf.CanStart(requestor, request.Action()) {
+		conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "type": request.Action()}).
+			Warn("Requestor not authorized to start session of this type; full request: ", server.ToJson(request))
+		return server.RemoteError(server.ErrorUnauthorized, "session type "+string(request.Action())+" not allowed")
+	}
+	if request.Action() == irma.ActionIssuing {
+		allowed, reason := conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
+		if !allowed {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
+				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
+			return server.RemoteError(server.ErrorUnauthorized, reason)
+		}
+	}
+	condiscon := request.Disclosure().Disclose
+	if len(condiscon) > 0 {
+		allowed, reason := conf.CanVerifyOrSign(requestor, request.Action(), condiscon)
+		if !allowed {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
+				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
+			return server.RemoteError(server.ErrorUnauthorized, reason)
+		}
+	}
+	return nil
+}
+
+// validateRequest applies the permission validator and the validator of the requestor, if any,
+// to the request.
+func (conf *Configuration) validateRequest(requestor string, rrequest irma.RequestorRequest) *irma.RemoteError {
+	validators := []RequestValidator{permissionValidator{conf}, conf.Requestors[requestor].Validator}
+	for _, validator := range validators {
+		if validator == nil {
+			continue
+		}
+		err := validator.Validate(requestor, rrequest)
+		if err == nil {
+			continue
+		}
+		if rerr, ok := err.(*irma.RemoteError); ok {
+			return rerr
+		}
+		conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Session request rejected by validator: ", err.Error())
+		return server.RemoteError(server.ErrorRequestRejected, err.Error())
+	}
+	return nil
+}
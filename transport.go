@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -22,13 +29,55 @@ import (
 	"github.com/privacybydesign/irmago/internal/fs"
 )
 
+// DefaultUserAgent is the User-Agent header sent by HTTPTransport unless configured otherwise.
+const DefaultUserAgent = "irmago/" + Version
+
 // HTTPTransport sends and receives JSON messages to a HTTP server.
 type HTTPTransport struct {
-	Server  string
-	client  *retryablehttp.Client
-	headers map[string]string
+	Server string
+	// If set, errors returned by the server include the body of the request that caused them,
+	// for debugging. JWTs are redacted from it, but it may still contain e.g. attribute values.
+	Debug bool
+
+	client    *retryablehttp.Client
+	transport *http.Transport
+	headers   map[string]string
+	userAgent string
+	metrics   MetricsObserver
+	limiter   *rateLimiter
+	captured  *capturedHeaders
+	slow      time.Duration // requests taking longer than this are logged, if nonzero
+	shared    bool          // if the HTTP client is shared with the transport from which this one was copied
+}
+
+// capturedHeaders holds the values of a set of response headers of the last response received.
+type capturedHeaders struct {
+	sync.Mutex
+	names []string // in canonical form
+	last  http.Header
+}
+
+// rateLimiter is a token bucket: it holds at most burst tokens, refilling at rate tokens per second.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// MetricsObserver is notified of each HTTP request made by a HTTPTransport, for example in order
+// to keep metrics on the latency and error rate of the servers that it talks to.
+type MetricsObserver interface {
+	// ObserveRequest is called after each request, including requests that failed. In the latter
+	// case status is 0 if no HTTP response was received.
+	ObserveRequest(method, url string, status int, duration time.Duration)
 }
 
+// maxRetryAfter is the longest Retry-After delay that we honor by retrying the request ourselves;
+// in case of longer delays ErrorRateLimited is returned immediately.
+const maxRetryAfter = 5 * time.Second
+
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
 var Logger *logrus.Logger
 
@@ -54,7 +103,7 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 	}
 
 	// Create a transport that dials with a SIGPIPE handler (which is only active on iOS)
-	var innerTransport http.Transport
+	innerTransport := &http.Transport{}
 
 	innerTransport.Dial = func(network, addr string) (c net.Conn, err error) {
 		c, err = net.Dial(network, addr)
@@ -72,29 +121,251 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 		RetryWaitMin: 100 * time.Millisecond,
 		RetryWaitMax: 200 * time.Millisecond,
 		RetryMax:     2,
-		Backoff:      retryablehttp.DefaultBackoff,
+		Backoff: func(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+			if delay, ok := retryAfter(resp); ok {
+				return delay
+			}
+			return retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+		},
 		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
-			// Don't retry on 5xx (which retryablehttp does by default)
+			// Don't retry on 5xx (which retryablehttp does by default), unless the server asked us to
+			// retry after a short while
+			if err == nil && resp != nil {
+				if delay, ok := retryAfter(resp); ok {
+					return delay <= maxRetryAfter, nil
+				}
+			}
 			return err != nil || resp.StatusCode == 0, err
 		},
+		ErrorHandler: func(resp *http.Response, err error, numTries int) (*http.Response, error) {
+			// Return the error of the last attempt instead of retryablehttp's generic one,
+			// so that the cause (e.g. failing certificate pinning) is not lost
+			if err == nil && resp != nil {
+				// Retries exhausted after a response asking us to retry: let the caller handle it
+				return resp, nil
+			}
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+			if err == nil {
+				err = errors.Errorf("giving up after %d attempts", numTries)
+			}
+			return nil, err
+		},
 		HTTPClient: &http.Client{
 			Timeout:   time.Second * 3,
-			Transport: &innerTransport,
+			Transport: innerTransport,
 		},
 	}
 
 	return &HTTPTransport{
-		Server:  url,
-		headers: map[string]string{},
-		client:  client,
+		Server:    url,
+		headers:   map[string]string{},
+		client:    client,
+		transport: innerTransport,
 	}
 }
 
+// NewHTTPTransportWithProxy returns a new HTTPTransport that sends all of its requests
+// through the HTTP proxy at the specified URL.
+func NewHTTPTransportWithProxy(serverURL, proxyURL string) (*HTTPTransport, error) {
+	transport := NewHTTPTransport(serverURL)
+	if err := transport.SetProxy(proxyURL); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// WithBaseURL returns a copy of the transport that sends its requests to the server at the
+// specified URL, preserving the configuration of the transport. The copy has its own headers,
+// but shares the HTTP client (and thus the timeout, retry policy and proxy), the rate limiter and
+// the metrics observer with the original.
+func (transport *HTTPTransport) WithBaseURL(serverURL string) *HTTPTransport {
+	cpy := *transport
+	cpy.shared = true
+	cpy.Server = serverURL
+	if serverURL != "" && !strings.HasSuffix(serverURL, "/") {
+		cpy.Server += "/"
+	}
+	cpy.headers = make(map[string]string, len(transport.headers))
+	for name, val := range transport.headers {
+		cpy.headers[name] = val
+	}
+	if transport.captured != nil {
+		cpy.captured = &capturedHeaders{names: transport.captured.names}
+	}
+	return &cpy
+}
+
+// Close releases the idle keep-alive connections of the transport. Embedders that create many
+// transports should call it when they are done with a transport, as otherwise these connections
+// stay open until the server closes them. Transports obtained using WithBaseURL share their
+// connections with the original transport, so for those this is a no-op.
+func (transport *HTTPTransport) Close() {
+	if transport.shared {
+		return
+	}
+	transport.transport.CloseIdleConnections()
+}
+
+// SetProxy configures the transport to send all of its requests through the HTTP proxy at the
+// specified URL. An empty URL disables the proxy. This should be called before the transport is used.
+func (transport *HTTPTransport) SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		transport.transport.Proxy = nil
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return errors.WrapPrefix(err, "invalid proxy URL", 0)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return errors.Errorf("invalid proxy URL %s: scheme and host required", proxyURL)
+	}
+	transport.transport.Proxy = http.ProxyURL(u)
+	return nil
+}
+
 // SetHeader sets a header to be sent in requests.
 func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers[name] = val
 }
 
+// SetUserAgent sets the User-Agent header sent with each request, e.g. "MyApp/1.2 irmago/0.4.1".
+// An empty string resets it to the default, DefaultUserAgent. A User-Agent header set with
+// SetHeader() takes precedence.
+func (transport *HTTPTransport) SetUserAgent(userAgent string) {
+	transport.userAgent = userAgent
+}
+
+// SetMetricsObserver sets an observer that is notified of each request made by this transport.
+func (transport *HTTPTransport) SetMetricsObserver(observer MetricsObserver) {
+	transport.metrics = observer
+}
+
+// CaptureResponseHeaders configures the transport to remember the specified headers of each
+// response it receives, which can be retrieved afterwards using LastResponseHeaders(). Calling
+// this without names disables capturing, which is the default.
+func (transport *HTTPTransport) CaptureResponseHeaders(names ...string) {
+	if len(names) == 0 {
+		transport.captured = nil
+		return
+	}
+	captured := &capturedHeaders{names: make([]string, len(names))}
+	for i, name := range names {
+		captured.names[i] = http.CanonicalHeaderKey(name)
+	}
+	transport.captured = captured
+}
+
+// LastResponseHeaders returns the headers configured with CaptureResponseHeaders() that were
+// present in the last response received by the transport, or nil if none has been received yet
+// or capturing is disabled. If the transport is used concurrently, it is unspecified of which
+// of the concurrent requests the response headers are returned.
+func (transport *HTTPTransport) LastResponseHeaders() http.Header {
+	if transport.captured == nil {
+		return nil
+	}
+	transport.captured.Lock()
+	defer transport.captured.Unlock()
+	return transport.captured.last
+}
+
+// capture remembers the configured headers of the response.
+func (c *capturedHeaders) capture(res *http.Response) {
+	headers := http.Header{}
+	for _, name := range c.names {
+		if vals, ok := res.Header[name]; ok {
+			headers[name] = append([]string(nil), vals...)
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.last = headers
+}
+
+// SetSlowRequestThreshold makes the transport log a warning for each request that takes longer
+// than the specified duration, including requests that failed. A zero duration disables this.
+func (transport *HTTPTransport) SetSlowRequestThreshold(d time.Duration) {
+	transport.slow = d
+}
+
+// SetRateLimit limits the amount of requests that this transport sends to at most rps requests
+// per second on average, with bursts of at most burst requests. When the limit is reached, requests
+// block until they are allowed. A zero rps disables rate limiting.
+func (transport *HTTPTransport) SetRateLimit(rps float64, burst int) {
+	if rps <= 0 {
+		transport.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	transport.limiter = &rateLimiter{
+		rate:   rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available and takes it, or until ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		l.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// PinPublicKey restricts the TLS connections of this transport to servers whose leaf certificate
+// contains one of the specified public keys. Each pin is the base64 encoding of the SHA-256 hash of
+// a DER-encoded SubjectPublicKeyInfo, as in HPKP's pin-sha256. The usual certificate chain
+// verification is still performed as well. Calling this again replaces any previous pins.
+func (transport *HTTPTransport) PinPublicKey(spkiSHA256 ...string) {
+	pins := make(map[string]struct{}, len(spkiSHA256))
+	for _, pin := range spkiSHA256 {
+		pins[pin] = struct{}{}
+	}
+	if transport.transport.TLSClientConfig == nil {
+		transport.transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.transport.TLSClientConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("certificate pinning failed: server presented no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.WrapPrefix(err, "certificate pinning failed", 0)
+		}
+		hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		pin := base64.StdEncoding.EncodeToString(hash[:])
+		if _, ok := pins[pin]; !ok {
+			return errors.Errorf("certificate pinning failed: public key %s of %s is not pinned", pin, leaf.Subject.CommonName)
+		}
+		return nil
+	}
+}
+
 func (transport *HTTPTransport) request(
 	url string, method string, reader io.Reader, isstr bool,
 ) (response *http.Response, err error) {
@@ -104,7 +375,11 @@ func (transport *HTTPTransport) request(
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
 
-	req.Header.Set("User-Agent", "irmago")
+	userAgent := transport.userAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
 	if reader != nil {
 		if isstr {
 			req.Header.Set("Content-Type", "text/plain; charset=UTF-8")
@@ -116,15 +391,92 @@ func (transport *HTTPTransport) request(
 		req.Header.Set(name, val)
 	}
 
+	if transport.limiter != nil {
+		if err = transport.limiter.wait(req.Context()); err != nil {
+			return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		}
+	}
+
+	start := time.Now()
 	res, err := transport.client.Do(&req)
+	duration := time.Since(start)
+	if transport.metrics != nil {
+		var status int
+		if res != nil {
+			status = res.StatusCode
+		}
+		transport.metrics.ObserveRequest(method, transport.Server+url, status, duration)
+	}
+	if transport.slow > 0 && duration > transport.slow {
+		Logger.WithFields(logrus.Fields{"method": method, "url": transport.Server + url, "duration": duration}).
+			Warn("Slow HTTP request")
+	}
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	if transport.captured != nil {
+		transport.captured.capture(res)
+	}
+	delay, ok := retryAfter(res)
+	if res.StatusCode == http.StatusTooManyRequests || ok {
+		return nil, rateLimitedError(res, delay)
+	}
 	return res, nil
 }
 
+// retryAfter parses the Retry-After header of 429 and 503 responses, which may contain either
+// an amount of seconds or a HTTP date.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil || (res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	header := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	delay := time.Until(date)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+func rateLimitedError(res *http.Response, delay time.Duration) *SessionError {
+	serr := &SessionError{ErrorType: ErrorRateLimited, RemoteStatus: res.StatusCode, RetryAfter: delay}
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err == nil {
+		apierr := &RemoteError{}
+		if json.Unmarshal(body, apierr) == nil && apierr.ErrorName != "" {
+			serr.RemoteError = apierr
+		}
+	}
+	return serr
+}
+
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+
+// debugBody returns the specified request body with JWTs redacted if the Debug flag is enabled,
+// and nil otherwise.
+func (transport *HTTPTransport) debugBody(body []byte) []byte {
+	if !transport.Debug || len(body) == 0 {
+		return nil
+	}
+	return jwtPattern.ReplaceAll(body, []byte("[redacted JWT]"))
+}
+
 func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
-	if method != http.MethodPost && method != http.MethodGet && method != http.MethodDelete {
+	if method != http.MethodPost && method != http.MethodPut && method != http.MethodGet && method != http.MethodDelete {
 		panic("Unsupported HTTP method " + method)
 	}
 	if method == http.MethodGet && object != nil {
@@ -133,41 +485,44 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 
 	var isstr bool
 	var reader io.Reader
+	var reqbody []byte
 	if object != nil {
 		var objstr string
 		if objstr, isstr = object.(string); isstr {
 			Logger.Trace("transport: body: ", objstr)
-			reader = bytes.NewBuffer([]byte(objstr))
+			reqbody = []byte(objstr)
 		} else {
 			marshaled, err := json.Marshal(object)
 			if err != nil {
 				return &SessionError{ErrorType: ErrorSerialization, Err: err}
 			}
 			Logger.Trace("transport: body: ", string(marshaled))
-			reader = bytes.NewBuffer(marshaled)
+			reqbody = marshaled
 		}
+		reader = bytes.NewBuffer(reqbody)
 	}
 
 	res, err := transport.request(url, method, reader, isstr)
 	if err != nil {
 		return err
 	}
-	if method == http.MethodDelete {
-		return nil
-	}
+	defer func() { _ = res.Body.Close() }()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 	}
-	if res.StatusCode != 200 {
+	if res.StatusCode != 200 && (method != http.MethodDelete || res.StatusCode != http.StatusNoContent) {
 		apierr := &RemoteError{}
 		err = json.Unmarshal(body, apierr)
 		if err != nil || apierr.ErrorName == "" { // Not an ApiErrorMessage
-			return &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+			return &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode, RequestBody: transport.debugBody(reqbody)}
 		}
 		Logger.Tracef("transport: error: %+v", apierr)
-		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr}
+		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr, RequestBody: transport.debugBody(reqbody)}
+	}
+	if method == http.MethodDelete {
+		return nil
 	}
 
 	Logger.Tracef("transport: response: %s", string(body))
@@ -186,7 +541,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	res, err := transport.request(url, http.MethodGet, nil, false)
 	if err != nil {
-		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		return nil, err
 	}
 
 	if res.StatusCode != 200 {
@@ -223,12 +578,75 @@ func (transport *HTTPTransport) Post(url string, result interface{}, object inte
 	return transport.jsonRequest(url, http.MethodPost, result, object)
 }
 
+// Put sends the object to the server using a PUT request and parses its response into result.
+func (transport *HTTPTransport) Put(url string, result interface{}, object interface{}) error {
+	return transport.jsonRequest(url, http.MethodPut, result, object)
+}
+
 // Get performs a GET request and parses the server's response into result.
 func (transport *HTTPTransport) Get(url string, result interface{}) error {
 	return transport.jsonRequest(url, http.MethodGet, result, nil)
 }
 
-// Delete performs a DELETE.
-func (transport *HTTPTransport) Delete() {
-	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
+// Delete performs a DELETE at the specified path, returning a *SessionError if the server
+// responded with an error. E.g., Delete("") cancels the session if the transport's server URL is
+// that of a session.
+func (transport *HTTPTransport) Delete(url string) error {
+	return transport.jsonRequest(url, http.MethodDelete, nil, nil)
+}
+
+// PollStatus polls the status of the specified session every interval at the
+// GET /session/{token}/status endpoint of the IRMA server at the URL of the transport, as an
+// alternative to server sent events for when a proxy buffers those. It sends the current status and
+// each subsequent change over the returned channel, which is closed when the session is finished,
+// when the server no longer knows the session (e.g. because it expired), or when ctx is done.
+// An error is returned only if the initial status cannot be retrieved; later failures are logged
+// and retried at the next interval. The statuses are those of the server package's Status type,
+// which this package cannot import.
+func (transport *HTTPTransport) PollStatus(ctx context.Context, token string, interval time.Duration) (<-chan string, error) {
+	if interval <= 0 {
+		return nil, errors.New("Polling interval must be positive")
+	}
+	url := "session/" + token + "/status"
+	var status string
+	if err := transport.Get(url, &status); err != nil {
+		return nil, err
+	}
+
+	statuschan := make(chan string)
+	go func() {
+		defer close(statuschan)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case statuschan <- status:
+			case <-ctx.Done():
+				return
+			}
+			if status == "DONE" || status == "CANCELLED" || status == "TIMEOUT" {
+				return
+			}
+
+			// Poll until the status changes
+			for prev := status; status == prev; {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				var polled string
+				if err := transport.Get(url, &polled); err != nil {
+					if serr, ok := err.(*SessionError); ok && serr.RemoteError != nil &&
+						serr.RemoteError.ErrorName == "SESSION_UNKNOWN" {
+						return
+					}
+					Logger.Warn("Failed to poll session status: ", err)
+					continue
+				}
+				status = polled
+			}
+		}
+	}()
+	return statuschan, nil
 }
@@ -0,0 +1,62 @@
+// Package transportmetrics keeps Prometheus metrics on the requests made by irma.HTTPTransport
+// instances.
+//
+// Example usage:
+//   observer, err := transportmetrics.NewPrometheusObserver(prometheus.DefaultRegisterer)
+//   ...
+//   transport := irma.NewHTTPTransport(url)
+//   transport.SetMetricsObserver(observer)
+package transportmetrics
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusObserver is an irma.MetricsObserver that records the duration and outcome of each
+// request in Prometheus metrics, labeled by HTTP method, server host and HTTP status code
+// ("0" if no response was received). Full URLs are not used as labels as they contain session tokens.
+type PrometheusObserver struct {
+	duration *prometheus.HistogramVec
+	requests *prometheus.CounterVec
+}
+
+// NewPrometheusObserver creates a new PrometheusObserver whose metrics are registered at the
+// specified registerer.
+func NewPrometheusObserver(registerer prometheus.Registerer) (*PrometheusObserver, error) {
+	o := &PrometheusObserver{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "irma",
+			Subsystem: "transport",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests made by the IRMA transport.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "host"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "irma",
+			Subsystem: "transport",
+			Name:      "requests_total",
+			Help:      "Amount of HTTP requests made by the IRMA transport, by status code.",
+		}, []string{"method", "host", "code"}),
+	}
+	if err := registerer.Register(o.duration); err != nil {
+		return nil, err
+	}
+	if err := registerer.Register(o.requests); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ObserveRequest implements irma.MetricsObserver.
+func (o *PrometheusObserver) ObserveRequest(method, rawurl string, status int, duration time.Duration) {
+	var host string
+	if u, err := url.Parse(rawurl); err == nil {
+		host = u.Host
+	}
+	o.duration.WithLabelValues(method, host).Observe(duration.Seconds())
+	o.requests.WithLabelValues(method, host, strconv.Itoa(status)).Inc()
+}
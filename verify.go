@@ -36,6 +36,41 @@ type DisclosedAttribute struct {
 	Identifier   AttributeTypeIdentifier `json:"id"`
 	Status       AttributeProofStatus    `json:"status"`
 	IssuanceTime Timestamp               `json:"issuancetime"`
+	Expiry       *Timestamp              `json:"expiry,omitempty"` // Absent if not known from the proof
+
+	// Credential type and issuer of the credential from which the attribute was disclosed, e.g.
+	// for when a disjunction allows attributes from multiple issuers. These are conveniences derived
+	// from Identifier (which for credential presence is the credential type itself), and are absent
+	// in results from servers predating them.
+	CredentialTypeID *CredentialTypeIdentifier `json:"credentialtype,omitempty"`
+	IssuerID         *IssuerIdentifier         `json:"issuer,omitempty"`
+}
+
+// DisjunctionStatus reports whether or not attributes were disclosed for a disjunction of a
+// disclosure request.
+type DisjunctionStatus string
+
+const (
+	DisjunctionStatusDisclosed = DisjunctionStatus("DISCLOSED") // Attributes were disclosed for the disjunction
+	DisjunctionStatusSkipped   = DisjunctionStatus("SKIPPED")   // The disjunction is optional, and no attributes were disclosed for it
+	DisjunctionStatusMissing   = DisjunctionStatus("MISSING")   // The disjunction is not optional, but it was not satisfied
+)
+
+// DisjunctionStatuses returns for each disjunction whether or not attributes were disclosed for it,
+// given the disclosed attributes per disjunction as returned by e.g. Disclosure.Verify.
+func (cdc AttributeConDisCon) DisjunctionStatuses(disclosed [][]*DisclosedAttribute) []DisjunctionStatus {
+	statuses := make([]DisjunctionStatus, len(cdc))
+	for i, discon := range cdc {
+		switch {
+		case i < len(disclosed) && len(disclosed[i]) > 0:
+			statuses[i] = DisjunctionStatusDisclosed
+		case discon.Optional() && i < len(disclosed) && disclosed[i] != nil:
+			statuses[i] = DisjunctionStatusSkipped
+		default:
+			statuses[i] = DisjunctionStatusMissing
+		}
+	}
+	return statuses
 }
 
 // ProofList is a gabi.ProofList with some extra methods.
@@ -243,12 +278,18 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 	if attrval == nil {
 		status = AttributeProofStatusNull
 	}
+	// The metadata attribute is always disclosed, so the proof commits to the expiry date
+	expiry := Timestamp(metadata.Expiry())
+	credid, issid := credtype.Identifier(), credtype.IssuerIdentifier()
 	return &DisclosedAttribute{
-		Identifier:   attrid,
-		RawValue:     attrval,
-		Value:        NewTranslatedString(attrval),
-		Status:       status,
-		IssuanceTime: Timestamp(metadata.SigningDate()),
+		Identifier:       attrid,
+		RawValue:         attrval,
+		Value:            NewTranslatedString(attrval),
+		Status:           status,
+		IssuanceTime:     Timestamp(metadata.SigningDate()),
+		Expiry:           &expiry,
+		CredentialTypeID: &credid,
+		IssuerID:         &issid,
 	}, attrval, nil
 }
 
@@ -381,11 +422,15 @@ func ParseApiServerJwt(inputJwt string, signingKey *rsa.PublicKey) (map[Attribut
 
 	disclosedAttributes := make(map[AttributeTypeIdentifier]*DisclosedAttribute, len(claims.Attributes))
 	for id, value := range claims.Attributes {
+		credid := id.CredentialTypeIdentifier()
+		issid := credid.IssuerIdentifier()
 		disclosedAttributes[id] = &DisclosedAttribute{
-			Identifier: id,
-			RawValue:   &value,
-			Value:      NewTranslatedString(&value),
-			Status:     AttributeProofStatusPresent,
+			Identifier:       id,
+			RawValue:         &value,
+			Value:            NewTranslatedString(&value),
+			Status:           AttributeProofStatusPresent,
+			CredentialTypeID: &credid,
+			IssuerID:         &issid,
 		}
 	}
 